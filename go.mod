@@ -19,6 +19,7 @@ require (
 	github.com/openebs/maya v1.12.1-0.20210416090832-ad9c32f086d5
 	github.com/openebs/zfs-localpv v1.6.1-0.20210504173514-62b3a0b7fe5d
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.7.1
 	github.com/sirupsen/logrus v1.6.0
 	github.com/spf13/pflag v1.0.5
 	github.com/vmware-tanzu/velero v1.5.0
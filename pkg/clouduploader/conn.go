@@ -110,11 +110,41 @@ type Conn struct {
 	// partSize for multi-part upload, default value 5MB for AWS (8MB for GCP)
 	partSize int64
 
-	// exitServer, if server connection needs to be stopped or not
-	ExitServer bool
+	// exitServer, if server connection needs to be stopped or not.
+	// It is set by the goroutine tracking the transfer, use SetExitServer.
+	exitServer int32
 
 	// ConnReady describes the connection ready state
 	ConnReady *chan bool
+
+	// OnTransferStart, if set, is called when remote client connects for data transfer,
+	// after it is authenticated using the transfer token or TLS handshake. If neither of
+	// them is enabled, it is called once the connection is accepted.
+	OnTransferStart func()
+
+	// tlsConfig is used by data server, if TLS is enabled
+	tlsConfig *tls.Config
+
+	// tlsClientSecret is the secret remote client should use for TLS
+	tlsClientSecret string
+
+	// tlsServerName is the server name remote client should verify
+	tlsServerName string
+
+	// requireToken, if remote client needs to authenticate using transfer token
+	requireToken bool
+
+	// transferToken is one-time token for current transfer
+	transferToken string
+
+	// tokenUses is the number of clients which can still authenticate using transferToken
+	tokenUses int32
+
+	// retry defines the retries of cloud object operation on transient error
+	retry retryPolicy
+
+	// pushGateway is the URL of pushgateway to push the metrics
+	pushGateway string
 }
 
 // setupBucket creates a connection to a particular cloud provider's blob storage.
@@ -270,6 +300,21 @@ func (c *Conn) Init(config map[string]string) error {
 	}
 	c.backupPathPrefix = backupPathPrefix
 
+	if tokenVal, ok := config[DataTransferToken]; ok {
+		requireToken, err := strconv.ParseBool(tokenVal)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse %s (expected format bool)", DataTransferToken)
+		}
+		c.requireToken = requireToken
+	}
+
+	retry, err := getRetryPolicy(config)
+	if err != nil {
+		return err
+	}
+	c.retry = retry
+	c.pushGateway = config[MetricsPushGateway]
+
 	c.ctx = context.Background()
 	b, err := c.setupBucket(c.ctx, provider, bucketName, config)
 	if err != nil {
@@ -286,7 +331,12 @@ func (c *Conn) Create(opType ServerOperation) ReadWriter {
 	}
 	switch opType {
 	case OpBackup:
-		w, err := c.bucket.NewWriter(c.ctx, c.file, &blob.WriterOptions{BufferSize: int(c.partSize)})
+		var w *blob.Writer
+		err := c.withRetry("write", c.file, func() error {
+			var err error
+			w, err = c.bucket.NewWriter(c.ctx, c.file, &blob.WriterOptions{BufferSize: int(c.partSize)})
+			return err
+		})
 		if err != nil {
 			c.Log.Errorf("Failed to obtain writer: %s", err.Error())
 			return nil
@@ -298,7 +348,12 @@ func (c *Conn) Create(opType ServerOperation) ReadWriter {
 		}
 		return wConn
 	case OpRestore:
-		r, err := c.bucket.NewReader(c.ctx, c.file, nil)
+		var r *blob.Reader
+		err := c.withRetry("read", c.file, func() error {
+			var err error
+			r, err = c.bucket.NewReader(c.ctx, c.file, nil)
+			return err
+		})
 		if err != nil {
 			c.Log.Errorf("Failed to obtain reader: %s", err.Error())
 			return nil
@@ -0,0 +1,236 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clouduploader
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// ManifestSuffix is the suffix of remote file having snapshot manifest
+	ManifestSuffix = ".manifest"
+
+	// BackupTimestampFormat is the format of timestamp in scheduled backup name
+	BackupTimestampFormat = "20060102150405"
+)
+
+// SnapshotManifest describes the uploaded snapshot
+type SnapshotManifest struct {
+	// Backup is the name of backup for this snapshot
+	Backup string `json:"backup"`
+
+	// Parent is the name of backup, this snapshot is incremental to.
+	// Parent is empty for full snapshot.
+	Parent string `json:"parent"`
+
+	// Timestamp is the creation time of snapshot
+	Timestamp time.Time `json:"timestamp"`
+
+	// Size is the size, in bytes, of uploaded snapshot
+	Size int64 `json:"size,omitempty"`
+
+	// Replica is the name of volume replica, snapshot is uploaded from
+	Replica string `json:"replica,omitempty"`
+
+	// Group is the name of consistency group, snapshot is created with
+	Group string `json:"group,omitempty"`
+
+	// Source is the name of local snapshot, uploaded by this backup
+	Source string `json:"source,omitempty"`
+
+	// Policy is the backup policy applied, i.e. why this snapshot is full or incremental
+	Policy string `json:"policy,omitempty"`
+
+	// Chain is the name of schedule, or backup chain, the backup belongs to
+	Chain string `json:"chain,omitempty"`
+}
+
+// WriteManifest uploads the manifest for the given snapshot file
+func (c *Conn) WriteManifest(filename string, m *SnapshotManifest) error {
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode manifest for %s", filename)
+	}
+
+	if ok := c.Write(data, filename+ManifestSuffix); !ok {
+		return errors.Errorf("failed to upload manifest for %s", filename)
+	}
+	return nil
+}
+
+// ReadManifest downloads the manifest for the given snapshot file
+// If manifest doesn't exist, snapshot created by older plugin, then it will return nil
+func (c *Conn) ReadManifest(filename string) (*SnapshotManifest, error) {
+	exists, err := c.Exists(filename + ManifestSuffix)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to check manifest for %s", filename)
+	}
+
+	if !exists {
+		return nil, nil
+	}
+
+	data, ok := c.Read(filename + ManifestSuffix)
+	if !ok {
+		return nil, errors.Errorf("failed to download manifest for %s", filename)
+	}
+
+	m := &SnapshotManifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode manifest for %s", filename)
+	}
+	return m, nil
+}
+
+// DeleteManifest removes the manifest for the given snapshot file, if exists
+func (c *Conn) DeleteManifest(filename string) error {
+	exists, err := c.Exists(filename + ManifestSuffix)
+	if err != nil {
+		return errors.Wrapf(err, "failed to check manifest for %s", filename)
+	}
+
+	if exists && !c.Delete(filename+ManifestSuffix) {
+		return errors.Errorf("failed to remove manifest for %s", filename)
+	}
+	return nil
+}
+
+// ResolveChain return the list of backups, from full snapshot to the target backup,
+// by following the parent links recorded in the manifests.
+// filename should return the remote file name of snapshot for the given backup.
+// If target backup, or any of its parent, is created by older plugin then it will return nil.
+func (c *Conn) ResolveChain(target string, filename func(backup string) string) ([]string, error) {
+	var chain []string
+	visited := map[string]bool{}
+
+	for bkp := target; bkp != ""; {
+		if visited[bkp] {
+			return nil, errors.Errorf("loop detected in snapshot chain of %s at %s", target, bkp)
+		}
+		visited[bkp] = true
+
+		m, err := c.ReadManifest(filename(bkp))
+		if err != nil {
+			return nil, err
+		}
+
+		if m == nil {
+			if bkp == target {
+				return nil, nil
+			}
+
+			// parent may be created by older plugin, chain can't be resolved from links
+			exists, err := c.Exists(filename(bkp))
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to check snapshot %s", bkp)
+			}
+			if exists {
+				c.Log.Warnf("Manifest not found for %s, chain of %s can't be resolved from parent links", bkp, target)
+				return nil, nil
+			}
+			return nil, errors.Errorf("snapshot %s not found, snapshot chain of %s is broken", bkp, target)
+		}
+
+		chain = append([]string{bkp}, chain...)
+		bkp = m.Parent
+	}
+	return chain, nil
+}
+
+// GetChainBackups return the backups, having snapshot of the given file, of the given schedule or backup chain.
+// Backup belongs to the chain if its manifest has the chain name, so backups named differently
+// are also returned. Backups created by older plugin, without chain in the manifest, are selected
+// using the chain name as prefix of backup name, same as GetSnapListFromCloud.
+// filename should return the remote file name of snapshot for the given backup.
+func (c *Conn) GetChainBackups(file, chain string, filename func(backup string) string) ([]string, error) {
+	var backups []string
+
+	list, err := c.GetSnapListFromCloud(file, "")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, bkp := range list {
+		m, err := c.ReadManifest(filename(bkp))
+		if err != nil {
+			return nil, err
+		}
+
+		if m != nil && m.Chain != "" {
+			if m.Chain == chain {
+				backups = append(backups, bkp)
+			}
+			continue
+		}
+
+		if strings.HasPrefix(bkp, chain) {
+			backups = append(backups, bkp)
+		}
+	}
+	return backups, nil
+}
+
+// SelectPointInTime return the latest backup, from the given list, created at or before t
+// Creation time is taken from the manifest, if exists, else from the backup name.
+func (c *Conn) SelectPointInTime(backups []string, t time.Time, filename func(backup string) string) (string, error) {
+	var selected string
+	var selectedTime time.Time
+
+	sort.Strings(backups)
+
+	for _, bkp := range backups {
+		ts, err := c.backupTimestamp(bkp, filename(bkp))
+		if err != nil {
+			c.Log.Warnf("Skipping backup=%s for point-in-time restore : %s", bkp, err.Error())
+			continue
+		}
+
+		if ts.After(t) {
+			continue
+		}
+
+		if selected == "" || !ts.Before(selectedTime) {
+			selected = bkp
+			selectedTime = ts
+		}
+	}
+
+	if selected == "" {
+		return "", errors.Errorf("no backup found at or before %s", t.Format(time.RFC3339))
+	}
+	return selected, nil
+}
+
+// backupTimestamp return the creation time of given backup
+func (c *Conn) backupTimestamp(backup, filename string) (time.Time, error) {
+	m, err := c.ReadManifest(filename)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if m != nil && !m.Timestamp.IsZero() {
+		return m.Timestamp, nil
+	}
+
+	s := strings.Split(backup, "-")
+	return time.Parse(BackupTimestampFormat, s[len(s)-1])
+}
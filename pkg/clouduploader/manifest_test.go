@@ -0,0 +1,198 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clouduploader
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gocloud.dev/blob/memblob"
+)
+
+func newTestConn() *Conn {
+	return &Conn{
+		Log:    logrus.New(),
+		ctx:    context.Background(),
+		bucket: memblob.OpenBucket(nil),
+	}
+}
+
+func testFilename(backup string) string {
+	return "backups/vol/" + backup
+}
+
+// uploadTestBackup uploads the snapshot of given backup, with manifest if m is not nil
+func uploadTestBackup(t *testing.T, c *Conn, backup string, m *SnapshotManifest) {
+	if !c.Write([]byte("data"), testFilename(backup)) {
+		t.Fatalf("failed to upload snapshot of %s", backup)
+	}
+	if m == nil {
+		return
+	}
+	m.Backup = backup
+	if err := c.WriteManifest(testFilename(backup), m); err != nil {
+		t.Fatalf("failed to upload manifest of %s : %v", backup, err)
+	}
+}
+
+func TestResolveChain(t *testing.T) {
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := map[string]struct {
+		// backups maps backup to its parent, backup without manifest has parent "-"
+		backups  map[string]string
+		target   string
+		chain    []string
+		hasError bool
+	}{
+		"full backup": {
+			map[string]string{"schd-1": ""}, "schd-1", []string{"schd-1"}, false,
+		},
+		"incremental chain": {
+			map[string]string{"schd-1": "", "schd-2": "schd-1", "schd-3": "schd-2"},
+			"schd-3", []string{"schd-1", "schd-2", "schd-3"}, false,
+		},
+		"chain skipping failed backup": {
+			map[string]string{"schd-1": "", "schd-3": "schd-1", "schd-4": "schd-3"},
+			"schd-4", []string{"schd-1", "schd-3", "schd-4"}, false,
+		},
+		"middle of chain": {
+			map[string]string{"schd-1": "", "schd-2": "schd-1", "schd-3": "schd-2"},
+			"schd-2", []string{"schd-1", "schd-2"}, false,
+		},
+		"new full backup": {
+			map[string]string{"schd-1": "", "schd-2": "schd-1", "schd-3": "", "schd-4": "schd-3"},
+			"schd-4", []string{"schd-3", "schd-4"}, false,
+		},
+		"target created by older plugin": {
+			map[string]string{"schd-1": "-"}, "schd-1", nil, false,
+		},
+		"parent created by older plugin": {
+			map[string]string{"schd-1": "-", "schd-2": "schd-1"}, "schd-2", nil, false,
+		},
+		"missing parent": {
+			map[string]string{"schd-2": "schd-1"}, "schd-2", nil, true,
+		},
+		"loop": {
+			map[string]string{"schd-1": "schd-2", "schd-2": "schd-1"}, "schd-2", nil, true,
+		},
+	}
+
+	for name, test := range tests {
+		c := newTestConn()
+		for bkp, parent := range test.backups {
+			var m *SnapshotManifest
+			if parent != "-" {
+				m = &SnapshotManifest{Parent: parent, Timestamp: base}
+			}
+			uploadTestBackup(t, c, bkp, m)
+		}
+
+		chain, err := c.ResolveChain(test.target, testFilename)
+		if (err != nil) != test.hasError {
+			t.Errorf("%s: unexpected error %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(chain, test.chain) {
+			t.Errorf("%s: chain is %v, expected %v", name, chain, test.chain)
+		}
+	}
+}
+
+func TestSelectPointInTime(t *testing.T) {
+	at := func(hhmm string) time.Time {
+		ts, err := time.Parse("2006-01-02 15:04", "2020-01-01 "+hhmm)
+		if err != nil {
+			t.Fatalf("invalid time %s : %v", hhmm, err)
+		}
+		return ts
+	}
+
+	c := newTestConn()
+	// manifest time is used, if exists, else time from the backup name
+	uploadTestBackup(t, c, "schd-20200101140000", &SnapshotManifest{Timestamp: at("14:00")})
+	uploadTestBackup(t, c, "schd-20200101140500", &SnapshotManifest{Timestamp: at("14:06")})
+	uploadTestBackup(t, c, "schd-20200101141000", nil)
+	uploadTestBackup(t, c, "manual", nil)
+
+	backups := []string{"schd-20200101141000", "schd-20200101140000", "schd-20200101140500", "manual"}
+
+	tests := map[string]struct {
+		t        time.Time
+		selected string
+		hasError bool
+	}{
+		"before all":         {at("13:59"), "", true},
+		"at first":           {at("14:00"), "schd-20200101140000", false},
+		"before snapshot":    {at("14:05"), "schd-20200101140000", false},
+		"at manifest time":   {at("14:06"), "schd-20200101140500", false},
+		"from backup name":   {at("14:10"), "schd-20200101141000", false},
+		"after all":          {at("23:00"), "schd-20200101141000", false},
+		"between the backup": {at("14:09"), "schd-20200101140500", false},
+	}
+
+	for name, test := range tests {
+		selected, err := c.SelectPointInTime(backups, test.t, testFilename)
+		if (err != nil) != test.hasError {
+			t.Errorf("%s: unexpected error %v", name, err)
+			continue
+		}
+		if selected != test.selected {
+			t.Errorf("%s: selected %s, expected %s", name, selected, test.selected)
+		}
+	}
+}
+
+func TestGetChainBackups(t *testing.T) {
+	c := newTestConn()
+	c.prefix = "cstor"
+
+	filename := func(backup string) string {
+		return c.GenerateRemoteFilename("vol", backup)
+	}
+
+	upload := func(backup, chain string, manifest bool) {
+		if !c.Write([]byte("data"), filename(backup)) {
+			t.Fatalf("failed to upload snapshot of %s", backup)
+		}
+		if manifest {
+			if err := c.WriteManifest(filename(backup), &SnapshotManifest{Backup: backup, Chain: chain}); err != nil {
+				t.Fatalf("failed to upload manifest of %s : %v", backup, err)
+			}
+		}
+	}
+
+	// backups created by older plugin are selected by name
+	upload("schd-20200101000000", "", false)
+	upload("schd-20200102000000", "schd", true)
+	upload("adhoc-b", "schd", true)
+	upload("schd-other-1", "schd-other", true)
+	upload("ci-1", "ci", true)
+
+	backups, err := c.GetChainBackups("vol", "schd", filename)
+	if err != nil {
+		t.Fatalf("failed to get backups of chain : %v", err)
+	}
+
+	expected := []string{"adhoc-b", "schd-20200101000000", "schd-20200102000000"}
+	if !reflect.DeepEqual(backups, expected) {
+		t.Errorf("backups of chain are %v, expected %v", backups, expected)
+	}
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clouduploader
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+const (
+	// MetricsPushGateway config key for the URL of prometheus pushgateway,
+	// plugin metrics are pushed to it
+	MetricsPushGateway = "metricsPushGateway"
+
+	metricsNamespace = "openebs_velero_plugin"
+
+	// metricsJob is the job name of the metrics pushed to pushgateway
+	metricsJob = "openebs-velero-plugin"
+
+	// failurePermanent is the reason of failure on permanent error
+	failurePermanent = "permanent"
+
+	// failureRetriesExhausted is the reason of failure when all the retries failed
+	failureRetriesExhausted = "retries_exhausted"
+)
+
+var (
+	// cloudOperationRetries counts the retries of cloud object operations
+	cloudOperationRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "cloud_operation_retries_total",
+			Help:      "Number of retries of cloud object operations on transient error",
+		},
+		[]string{"operation"},
+	)
+
+	// cloudOperationFailures counts the failed cloud object operations
+	cloudOperationFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "cloud_operation_failures_total",
+			Help:      "Number of failed cloud object operations",
+		},
+		[]string{"operation", "reason"},
+	)
+
+	// registry has the plugin metrics. Plugin runs as a child process of velero
+	// and can't serve the metrics, so these are pushed to the pushgateway.
+	registry = prometheus.NewRegistry()
+
+	// metricsInstance identifies this plugin process in the pushgateway
+	metricsInstance = getMetricsInstance()
+)
+
+func init() {
+	registry.MustRegister(cloudOperationRetries, cloudOperationFailures)
+}
+
+func getMetricsInstance() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// pushMetrics pushes the plugin metrics to the pushgateway, if configured
+func (c *Conn) pushMetrics() {
+	if c.pushGateway == "" {
+		return
+	}
+
+	err := push.New(c.pushGateway, metricsJob).
+		Gatherer(registry).
+		Grouping("instance", metricsInstance).
+		Push()
+	if err != nil {
+		c.Log.Warnf("Failed to push metrics to %s : %s", c.pushGateway, err.Error())
+	}
+}
@@ -19,11 +19,13 @@ package clouduploader
 import (
 	"io"
 	"strings"
+	"sync/atomic"
 
 	"github.com/pkg/errors"
 
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
 )
 
 const (
@@ -51,6 +53,8 @@ func (c *Conn) Upload(file string, fileSize int64, port int) bool {
 	c.Log.Infof("Uploading snapshot to '%s' with provider{%s} to bucket{%s}", file, c.provider, c.bucketname)
 
 	c.file = file
+	defer c.resetTransferToken()
+
 	if c.partSize == 0 {
 		// MaxUploadParts is limited to 10k
 		// 100 is arbitrary value considering snapshot metadata
@@ -68,8 +72,8 @@ func (c *Conn) Upload(file string, fileSize int64, port int) bool {
 	err := s.Run(OpBackup, port)
 	if err != nil {
 		c.Log.Errorf("Failed to upload snapshot to bucket: %s", err.Error())
-		if c.bucket.Delete(c.ctx, file) != nil {
-			c.Log.Errorf("Failed to delete uncompleted snapshot{%s} from cloud", file)
+		if err = c.deleteObject(file); err != nil {
+			c.Log.Errorf("Failed to delete uncompleted snapshot{%s} from cloud : %s", file, err.Error())
 		}
 		return false
 	}
@@ -82,8 +86,11 @@ func (c *Conn) Upload(file string, fileSize int64, port int) bool {
 func (c *Conn) Delete(file string) bool {
 	c.Log.Infof("Removing snapshot:'%s' from bucket{%s} provider{%s}", file, c.bucketname, c.provider)
 
-	if c.bucket.Delete(c.ctx, file) != nil {
-		c.Log.Errorf("Failed to remove snapshot{%s} from cloud", file)
+	err := c.withRetry("delete", file, func() error {
+		return c.bucket.Delete(c.ctx, file)
+	})
+	if err != nil {
+		c.Log.Errorf("Failed to remove snapshot{%s} from cloud : %s", file, err.Error())
 		return false
 	}
 	return true
@@ -94,6 +101,8 @@ func (c *Conn) Delete(file string) bool {
 // connect and download data from cloud blob storage file
 func (c *Conn) Download(file string, port int) bool {
 	c.file = file
+	defer c.resetTransferToken()
+
 	s := &Server{
 		Log: c.Log,
 		cl:  c,
@@ -111,24 +120,28 @@ func (c *Conn) Download(file string, port int) bool {
 func (c *Conn) Write(data []byte, file string) bool {
 	c.Log.Infof("Writing to {%s} with provider{%v} to bucket{%v}", file, c.provider, c.bucketname)
 
-	w, err := c.bucket.NewWriter(c.ctx, file, nil)
-	if err != nil {
-		c.Log.Errorf("Failed to obtain writer: %s", err.Error())
-		return false
-	}
-	_, err = w.Write(data)
+	err := c.withRetry("write", file, func() error {
+		w, err := c.bucket.NewWriter(c.ctx, file, nil)
+		if err != nil {
+			return errors.Wrapf(err, "failed to obtain writer")
+		}
+
+		if _, err = w.Write(data); err != nil {
+			if cerr := w.Close(); cerr != nil {
+				c.Log.Warnf("Failed to close writer of file{%s} : %s", file, cerr.Error())
+			}
+			return errors.Wrapf(err, "failed to write data")
+		}
+
+		return errors.Wrapf(w.Close(), "failed to close cloud conn")
+	})
 	if err != nil {
 		c.Log.Errorf("Failed to write data to file{%s} : %s", file, err.Error())
-		if err = c.bucket.Delete(c.ctx, file); err != nil {
+		if err = c.deleteObject(file); err != nil {
 			c.Log.Warnf("Failed to delete file {%v} : %s", file, err.Error())
 		}
 		return false
 	}
-
-	if err = w.Close(); err != nil {
-		c.Log.Errorf("Failed to close cloud conn : %s", err.Error())
-		return false
-	}
 	c.Log.Infof("successfully writtern object{%s} to {%s}", file, c.provider)
 	return true
 }
@@ -137,7 +150,12 @@ func (c *Conn) Write(data []byte, file string) bool {
 func (c *Conn) Read(file string) ([]byte, bool) {
 	c.Log.Infof("Reading from {%s} with provider{%s} to bucket{%s}", file, c.provider, c.bucketname)
 
-	data, err := c.bucket.ReadAll(c.ctx, file)
+	var data []byte
+	err := c.withRetry("read", file, func() error {
+		var err error
+		data, err = c.bucket.ReadAll(c.ctx, file)
+		return err
+	})
 	if err != nil {
 		c.Log.Errorf("Failed to read data from file{%s} : %s", file, err.Error())
 		return nil, false
@@ -177,7 +195,21 @@ func (c *Conn) GetFileNameWithSchd(file, schdname string) string {
 func (c *Conn) ConnStateReset() {
 	ch := make(chan bool, 1)
 	c.ConnReady = &ch
-	c.ExitServer = false
+	c.SetExitServer(false)
+}
+
+// SetExitServer sets if the data server needs to be stopped once the clients are done
+func (c *Conn) SetExitServer(exit bool) {
+	var v int32
+	if exit {
+		v = 1
+	}
+	atomic.StoreInt32(&c.exitServer, v)
+}
+
+// shouldExitServer returns true if the data server needs to be stopped
+func (c *Conn) shouldExitServer() bool {
+	return atomic.LoadInt32(&c.exitServer) == 1
 }
 
 // ConnReadyWait will return when connection is ready to accept the connection
@@ -198,8 +230,22 @@ func (c *Conn) listKeys(prefix string, keyType int) ([]string, error) {
 		Prefix:    prefix,
 	})
 	for {
-		obj, err := lister.Next(c.ctx)
-		if err == io.EOF {
+		var (
+			obj  *blob.ListObject
+			done bool
+		)
+
+		// failed page is fetched again by the next call
+		err := c.withRetry("list", prefix, func() error {
+			var err error
+			obj, err = lister.Next(c.ctx)
+			if err == io.EOF {
+				done = true
+				return nil
+			}
+			return err
+		})
+		if done {
 			break
 		}
 
@@ -273,11 +319,47 @@ func (c *Conn) GetSnapListFromCloud(file, backup string) ([]string, error) {
 	return snapList, nil
 }
 
+// deleteObject removes the given remote file, it doesn't fail if file doesn't exist
+func (c *Conn) deleteObject(filename string) error {
+	err := c.withRetry("delete", filename, func() error {
+		return c.bucket.Delete(c.ctx, filename)
+	})
+	if err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+		return err
+	}
+	return nil
+}
+
+// Exists check if the given remote file exists or not
+func (c *Conn) Exists(filename string) (bool, error) {
+	var exists bool
+	err := c.withRetry("exists", filename, func() error {
+		var err error
+		exists, err = c.bucket.Exists(c.ctx, filename)
+		return err
+	})
+	return exists, err
+}
+
+// ObjectSize return the size of given remote file
+func (c *Conn) ObjectSize(filename string) (int64, error) {
+	var size int64
+	err := c.withRetry("attributes", filename, func() error {
+		attr, err := c.bucket.Attributes(c.ctx, filename)
+		if err != nil {
+			return err
+		}
+		size = attr.Size
+		return nil
+	})
+	return size, err
+}
+
 // FileExists check if the given file exists or not in the given backup
 // the argument should be the same as that of GenerateRemoteFilename(file, backup) call
 // used while doing the backup of the volume
 func (c *Conn) FileExists(file, backup string) (bool, error) {
 	c.Log.Debugf("Checking if file=%s exist", c.GenerateRemoteFilename(file, backup))
 
-	return c.bucket.Exists(c.ctx, c.GenerateRemoteFilename(file, backup))
+	return c.Exists(c.GenerateRemoteFilename(file, backup))
 }
@@ -0,0 +1,248 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clouduploader
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/pkg/errors"
+	"gocloud.dev/gcerrors"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// MaxRetries config key for the number of retries of cloud object operation on transient error
+	MaxRetries = "maxRetries"
+
+	// RetryBaseDelay config key for the delay before the first retry, delay is doubled for each retry
+	RetryBaseDelay = "retryBaseDelay"
+
+	// RetryMaxDelay config key for the maximum delay between the retries
+	RetryMaxDelay = "retryMaxDelay"
+
+	defaultMaxRetries     = 3
+	defaultRetryBaseDelay = time.Second
+	defaultRetryMaxDelay  = 30 * time.Second
+)
+
+// permanentCodes are the error codes of object storage for which retry doesn't help
+var permanentCodes = map[string]bool{
+	"NoSuchBucket":          true,
+	"NoSuchKey":             true,
+	"NotFound":              true,
+	"AccessDenied":          true,
+	"AllAccessDisabled":     true,
+	"AccountProblem":        true,
+	"InvalidAccessKeyId":    true,
+	"InvalidBucketName":     true,
+	"SignatureDoesNotMatch": true,
+}
+
+// throttleCodes are the error codes of object storage returned on throttling
+var throttleCodes = map[string]bool{
+	"SlowDown":             true,
+	"Throttling":           true,
+	"ThrottlingException":  true,
+	"RequestLimitExceeded": true,
+	"TooManyRequests":      true,
+	"RequestTimeout":       true,
+	"InternalError":        true,
+	"ServiceUnavailable":   true,
+}
+
+// gcsRateLimitReasons are the reasons of GCS error returned on throttling
+var gcsRateLimitReasons = map[string]bool{
+	"rateLimitExceeded":     true,
+	"userRateLimitExceeded": true,
+}
+
+// retryPolicy defines the retries of cloud object operation
+type retryPolicy struct {
+	// maxRetries is the number of retries on transient error
+	maxRetries int
+
+	// baseDelay is the delay before the first retry
+	baseDelay time.Duration
+
+	// maxDelay is the maximum delay between the retries
+	maxDelay time.Duration
+}
+
+// getRetryPolicy returns the retry policy from the config
+func getRetryPolicy(config map[string]string) (retryPolicy, error) {
+	r := retryPolicy{
+		maxRetries: defaultMaxRetries,
+		baseDelay:  defaultRetryBaseDelay,
+		maxDelay:   defaultRetryMaxDelay,
+	}
+
+	if val, ok := config[MaxRetries]; ok {
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 0 {
+			return r, errors.Errorf("failed to parse %s=%s (expected non-negative number)", MaxRetries, val)
+		}
+		r.maxRetries = n
+	}
+
+	if val, ok := config[RetryBaseDelay]; ok {
+		d, err := time.ParseDuration(val)
+		if err != nil || d <= 0 {
+			return r, errors.Errorf("failed to parse %s=%s (expected positive duration)", RetryBaseDelay, val)
+		}
+		r.baseDelay = d
+	}
+
+	if val, ok := config[RetryMaxDelay]; ok {
+		d, err := time.ParseDuration(val)
+		if err != nil || d <= 0 {
+			return r, errors.Errorf("failed to parse %s=%s (expected positive duration)", RetryMaxDelay, val)
+		}
+		r.maxDelay = d
+	}
+
+	if r.maxDelay < r.baseDelay {
+		r.maxDelay = r.baseDelay
+	}
+	return r, nil
+}
+
+// backoff returns the delay before the given retry, starting from 0.
+// Delay is doubled for each retry, up to maxDelay, and half of it is random
+// so that parallel operations don't retry together.
+func (r retryPolicy) backoff(retry int) time.Duration {
+	d := r.maxDelay
+	if retry < 32 {
+		if exp := r.baseDelay << uint(retry); exp > 0 && exp < r.maxDelay {
+			d = exp
+		}
+	}
+
+	half := int64(d / 2)
+	/* #nosec */
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// withRetry executes the given cloud object operation, and retries it on transient error
+// as per the retry policy. op and key are used for logs and metrics.
+func (c *Conn) withRetry(op, key string, fn func() error) error {
+	for retry := 0; ; retry++ {
+		err := fn()
+		if err == nil {
+			if retry > 0 {
+				c.Log.Infof("Cloud operation %s on {%s} succeeded after %d retries", op, key, retry)
+				c.pushMetrics()
+			}
+			return nil
+		}
+
+		if !isTransientError(err) {
+			cloudOperationFailures.WithLabelValues(op, failurePermanent).Inc()
+			c.pushMetrics()
+			return err
+		}
+
+		if retry >= c.retry.maxRetries {
+			cloudOperationFailures.WithLabelValues(op, failureRetriesExhausted).Inc()
+			c.pushMetrics()
+			return errors.Wrapf(err, "%s failed after %d retries", op, retry)
+		}
+
+		delay := c.retry.backoff(retry)
+		cloudOperationRetries.WithLabelValues(op).Inc()
+		c.Log.Warnf("Cloud operation %s on {%s} failed with transient error, retry %d/%d in %v : %s",
+			op, key, retry+1, c.retry.maxRetries, delay, err.Error())
+		time.Sleep(delay)
+	}
+}
+
+// isTransientError checks if the given error of cloud object operation is transient,
+// like throttling, server error or connection reset, and operation can be retried.
+func isTransientError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	switch gcerrors.Code(err) {
+	case gcerrors.NotFound, gcerrors.PermissionDenied, gcerrors.InvalidArgument,
+		gcerrors.FailedPrecondition, gcerrors.AlreadyExists, gcerrors.Unimplemented, gcerrors.Canceled:
+		return false
+	case gcerrors.ResourceExhausted, gcerrors.Internal, gcerrors.DeadlineExceeded:
+		return true
+	}
+
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) {
+		if permanentCodes[reqErr.Code()] {
+			return false
+		}
+		if throttleCodes[reqErr.Code()] || isTransientStatus(reqErr.StatusCode()) {
+			return true
+		}
+		if reqErr.StatusCode() >= http.StatusBadRequest {
+			return false
+		}
+	}
+
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		if permanentCodes[awsErr.Code()] {
+			return false
+		}
+		// RequestError is returned on network error, sdk checks for the connection reset
+		return throttleCodes[awsErr.Code()] || request.IsErrorThrottle(awsErr) ||
+			(awsErr.Code() != request.ErrCodeRequestError && request.IsErrorRetryable(awsErr)) ||
+			(awsErr.OrigErr() != nil && isNetworkError(awsErr.OrigErr()))
+	}
+
+	var gErr *googleapi.Error
+	if errors.As(err, &gErr) {
+		for _, e := range gErr.Errors {
+			if gcsRateLimitReasons[e.Reason] {
+				return true
+			}
+		}
+		return isTransientStatus(gErr.Code)
+	}
+
+	return isNetworkError(err)
+}
+
+// isTransientStatus checks if the given HTTP status is of throttling or server error
+func isTransientStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
+
+// isNetworkError checks if the given error is due to connection reset or timeout
+func isNetworkError(err error) bool {
+	if errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,181 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clouduploader
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+)
+
+func TestIsTransientError(t *testing.T) {
+	connReset := &url.Error{
+		Op:  "Put",
+		URL: "https://bucket.s3.amazonaws.com/file",
+		Err: &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)},
+	}
+
+	tests := map[string]struct {
+		err       error
+		transient bool
+	}{
+		"nil":                  {nil, false},
+		"unknown":              {errors.New("invalid data"), false},
+		"s3 no such bucket":    {awserr.NewRequestFailure(awserr.New("NoSuchBucket", "bucket not found", nil), 404, "id"), false},
+		"s3 access denied":     {awserr.NewRequestFailure(awserr.New("AccessDenied", "access denied", nil), 403, "id"), false},
+		"s3 slow down":         {awserr.NewRequestFailure(awserr.New("SlowDown", "reduce request rate", nil), 503, "id"), true},
+		"s3 internal error":    {awserr.NewRequestFailure(awserr.New("InternalError", "internal error", nil), 500, "id"), true},
+		"s3 bad gateway":       {awserr.NewRequestFailure(awserr.New("BadGateway", "bad gateway", nil), 502, "id"), true},
+		"s3 connection reset":  {awserr.New(request.ErrCodeRequestError, "send request failed", connReset), true},
+		"s3 invalid cert":      {awserr.New(request.ErrCodeRequestError, "send request failed", errors.New("x509: unknown authority")), false},
+		"gcs server error":     {&googleapi.Error{Code: 503}, true},
+		"gcs rate limit":       {&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}, true},
+		"gcs forbidden":        {&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "forbidden"}}}, false},
+		"connection reset":     {connReset, true},
+		"unexpected eof":       {errors.Wrapf(io.ErrUnexpectedEOF, "read failed"), true},
+		"wrapped s3 throttled": {errors.Wrapf(awserr.NewRequestFailure(awserr.New("Throttling", "rate exceeded", nil), 400, "id"), "list"), true},
+	}
+
+	for name, test := range tests {
+		if got := isTransientError(test.err); got != test.transient {
+			t.Errorf("%s: isTransientError=%v, expected %v", name, got, test.transient)
+		}
+	}
+}
+
+func TestGetRetryPolicy(t *testing.T) {
+	r, err := getRetryPolicy(map[string]string{})
+	if err != nil {
+		t.Fatalf("failed to get default retry policy : %v", err)
+	}
+	if r.maxRetries != defaultMaxRetries || r.baseDelay != defaultRetryBaseDelay || r.maxDelay != defaultRetryMaxDelay {
+		t.Errorf("invalid default retry policy %+v", r)
+	}
+
+	r, err = getRetryPolicy(map[string]string{MaxRetries: "5", RetryBaseDelay: "2s", RetryMaxDelay: "1m"})
+	if err != nil {
+		t.Fatalf("failed to get retry policy : %v", err)
+	}
+	if r.maxRetries != 5 || r.baseDelay != 2*time.Second || r.maxDelay != time.Minute {
+		t.Errorf("invalid retry policy %+v", r)
+	}
+
+	for _, config := range []map[string]string{
+		{MaxRetries: "-1"},
+		{MaxRetries: "three"},
+		{RetryBaseDelay: "0s"},
+		{RetryMaxDelay: "10"},
+	} {
+		if _, err := getRetryPolicy(config); err == nil {
+			t.Errorf("expected error for config %v", config)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	r := retryPolicy{maxRetries: 10, baseDelay: 100 * time.Millisecond, maxDelay: time.Second}
+
+	for retry := 0; retry < 40; retry++ {
+		max := r.baseDelay << uint(retry)
+		if retry >= 4 {
+			max = r.maxDelay
+		}
+
+		d := r.backoff(retry)
+		if d < max/2 || d > max {
+			t.Errorf("backoff of retry %d is %v, expected between %v and %v", retry, d, max/2, max)
+		}
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	c := &Conn{
+		Log:   logrus.New(),
+		retry: retryPolicy{maxRetries: 3, baseDelay: time.Millisecond, maxDelay: 2 * time.Millisecond},
+	}
+	throttled := awserr.NewRequestFailure(awserr.New("SlowDown", "reduce request rate", nil), 503, "id")
+
+	tests := map[string]struct {
+		errs     []error
+		calls    int
+		hasError bool
+	}{
+		"success":            {nil, 1, false},
+		"transient":          {[]error{throttled, throttled}, 3, false},
+		"permanent":          {[]error{awserr.NewRequestFailure(awserr.New("NoSuchBucket", "not found", nil), 404, "id")}, 1, true},
+		"transient then bad": {[]error{throttled, awserr.NewRequestFailure(awserr.New("AccessDenied", "denied", nil), 403, "id")}, 2, true},
+		"retries exhausted":  {[]error{throttled, throttled, throttled, throttled, throttled}, 4, true},
+	}
+
+	for name, test := range tests {
+		calls := 0
+		err := c.withRetry("write", "file", func() error {
+			calls++
+			if calls <= len(test.errs) {
+				return test.errs[calls-1]
+			}
+			return nil
+		})
+
+		if calls != test.calls {
+			t.Errorf("%s: operation called %d times, expected %d", name, calls, test.calls)
+		}
+		if (err != nil) != test.hasError {
+			t.Errorf("%s: unexpected error %v", name, err)
+		}
+	}
+}
+
+func TestPushMetrics(t *testing.T) {
+	var pushed int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/metrics/job/"+metricsJob) {
+			atomic.AddInt32(&pushed, 1)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	c := &Conn{
+		Log:         logrus.New(),
+		retry:       retryPolicy{maxRetries: 1, baseDelay: time.Millisecond, maxDelay: time.Millisecond},
+		pushGateway: server.URL,
+	}
+
+	_ = c.withRetry("delete", "file", func() error {
+		return awserr.NewRequestFailure(awserr.New("AccessDenied", "denied", nil), 403, "id")
+	})
+
+	if atomic.LoadInt32(&pushed) != 1 {
+		t.Errorf("metrics pushed %d times, expected 1", pushed)
+	}
+}
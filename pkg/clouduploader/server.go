@@ -55,6 +55,10 @@ type ServerState struct {
 	// failedCount defines number of client
 	// who didn't completed operation successfully
 	failedCount int
+
+	// rejectedCount defines number of client rejected
+	// due to invalid transfer token or failed TLS handshake
+	rejectedCount int
 }
 
 // Server defines resource used for uploading/downloading
@@ -95,6 +99,12 @@ type Client struct {
 	// status represents current status for client operation(upload/download)
 	status TransferStatus
 
+	// authenticated is true if client has sent valid transfer token
+	authenticated bool
+
+	// authBuf stores partially received transfer token
+	authBuf []byte
+
 	// for link-list
 	next *Client
 }
@@ -147,34 +157,34 @@ func (s *Server) acceptClient(fd, epfd int) (int, error) {
 		return (-1), err
 	}
 
-	readerWriter := s.cl.Create(s.OpType)
-	if readerWriter == nil {
-		s.Log.Errorf("Failed to create file interface")
-		if err = syscall.Close(connFd); err != nil {
-			s.Log.Warnf("Failed to close cline {%v} : %s", connFd, err.Error())
-		}
-		return (-1), errors.New("failed to create file interface")
-	}
-
 	c = new(Client)
 	c.fd = connFd
-	c.file = readerWriter
 	c.bufferLen = ReadBufferLen
 	c.buffer = make([]byte, c.bufferLen)
 	c.status = TransferStatusInit
 	c.next = nil
 
 	event = new(syscall.EpollEvent)
-	if s.OpType == OpBackup {
-		event.Events = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLHUP | syscall.EPOLLERR | EPOLLET
+	if s.cl.transferToken != "" {
+		// file interface will be created once client sends the valid transfer token
+		event.Events = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLHUP | syscall.EPOLLERR
 	} else {
-		err := syscall.SetsockoptInt(connFd, syscall.SOL_TCP, syscall.TCP_NODELAY, 1)
-		if err != nil {
-			s.Log.Errorf("Failed to set TCP_NODELAY for {%v} : %s", connFd, err.Error())
+		readerWriter := s.cl.Create(s.OpType)
+		if readerWriter == nil {
+			s.Log.Errorf("Failed to create file interface")
+			if err = syscall.Close(connFd); err != nil {
+				s.Log.Warnf("Failed to close cline {%v} : %s", connFd, err.Error())
+			}
+			return (-1), errors.New("failed to create file interface")
+		}
+		c.file = readerWriter
+		c.authenticated = true
+
+		if err = s.setTransferEvents(c, event); err != nil {
 			return (-1), err
 		}
-		event.Events = syscall.EPOLLOUT | syscall.EPOLLRDHUP | syscall.EPOLLHUP | syscall.EPOLLERR
 	}
+
 	s.addClientToEvent(c, event)
 	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, connFd, event); err != nil {
 		s.Log.Errorf("Failed to add client fd{%v} to epoll: %s", connFd, err.Error())
@@ -185,9 +195,88 @@ func (s *Server) acceptClient(fd, epfd int) (int, error) {
 		return (-1), err
 	}
 	s.appendToClientList(c)
+
+	if c.authenticated && s.cl.OnTransferStart != nil {
+		s.cl.OnTransferStart()
+	}
 	return connFd, nil
 }
 
+// setTransferEvents sets the epoll events, for the given client, required for data transfer
+func (s *Server) setTransferEvents(c *Client, event *syscall.EpollEvent) error {
+	if s.OpType == OpBackup {
+		event.Events = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLHUP | syscall.EPOLLERR | EPOLLET
+		return nil
+	}
+
+	err := syscall.SetsockoptInt(c.fd, syscall.SOL_TCP, syscall.TCP_NODELAY, 1)
+	if err != nil {
+		s.Log.Errorf("Failed to set TCP_NODELAY for {%v} : %s", c.fd, err.Error())
+		return err
+	}
+	event.Events = syscall.EPOLLOUT | syscall.EPOLLRDHUP | syscall.EPOLLHUP | syscall.EPOLLERR
+	return nil
+}
+
+// handleAuth reads the transfer token from client and, if token is valid,
+// creates the file interface and switches the client to data transfer
+func (s *Server) handleAuth(event syscall.EpollEvent, epfd int) error {
+	var c = s.getClientFromEvent(event)
+	tokenLen := len(s.cl.transferToken)
+
+	for len(c.authBuf) < tokenLen {
+		// read only the token, remaining data belongs to the transfer
+		nbytes, e := syscall.Read(c.fd, c.buffer[:tokenLen-len(c.authBuf)])
+		if nbytes > 0 {
+			c.authBuf = append(c.authBuf, c.buffer[:nbytes]...)
+			continue
+		}
+		if e == syscall.EAGAIN {
+			// wait for remaining token
+			return nil
+		}
+		if e != nil {
+			return errors.Errorf("read returned error for fd{%v} : %s", c.fd, e.Error())
+		}
+		return errors.Errorf("connection closed for fd{%v} before authentication", c.fd)
+	}
+
+	if !s.cl.authenticateClient(c.authBuf) {
+		s.state.rejectedCount++
+		s.Log.Warningf("Rejecting client{%v}, invalid or already used transfer token", c.fd)
+		return errors.Errorf("invalid transfer token from fd{%v}", c.fd)
+	}
+	c.authBuf = nil
+
+	readerWriter := s.cl.Create(s.OpType)
+	if readerWriter == nil {
+		s.Log.Errorf("Failed to create file interface")
+		return errors.New("failed to create file interface")
+	}
+	c.file = readerWriter
+	c.authenticated = true
+	s.Log.Infof("Client{%v} authenticated", c.fd)
+
+	if err := s.setTransferEvents(c, &event); err != nil {
+		return err
+	}
+
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_MOD, c.fd, &event); err != nil {
+		s.Log.Errorf("Failed to modify client fd{%v} in epoll: %s", c.fd, err.Error())
+		return err
+	}
+
+	if s.cl.OnTransferStart != nil {
+		s.cl.OnTransferStart()
+	}
+
+	if s.OpType == OpBackup {
+		// data may have arrived with the token, edge-triggered epoll won't report it again
+		return s.handleRead(event)
+	}
+	return nil
+}
+
 func (s *Server) handleRead(event syscall.EpollEvent) error {
 	var c = s.getClientFromEvent(event)
 	var writer *blob.Writer
@@ -245,6 +334,10 @@ func (s *Server) Run(opType ServerOperation, port int) error {
 	var event syscall.EpollEvent
 	var events [MaxEpollEvents]syscall.EpollEvent
 
+	if s.cl.tlsConfig != nil {
+		return s.runTLS(opType, port)
+	}
+
 	fd, err := syscall.Socket(syscall.AF_INET, syscall.O_NONBLOCK|syscall.SOCK_STREAM, 0)
 	if err != nil {
 		s.Log.Errorf("Failed to initialize socket : %s", err.Error())
@@ -307,7 +400,7 @@ func (s *Server) Run(opType ServerOperation, port int) error {
 			return err
 		}
 
-		if nevents == 0 && s.cl.ExitServer {
+		if nevents == 0 && s.cl.shouldExitServer() {
 			s.Log.Infof("Transfer done.. closing the server")
 			s.disconnectAllClient(epfd)
 			goto exit
@@ -322,7 +415,10 @@ func (s *Server) Run(opType ServerOperation, port int) error {
 					continue
 				}
 			} else {
-				if events[ev].Events == syscall.EPOLLIN {
+				if !s.getClientFromEvent(events[ev]).authenticated &&
+					events[ev].Events == syscall.EPOLLIN {
+					err = s.handleAuth(events[ev], epfd)
+				} else if events[ev].Events == syscall.EPOLLIN {
 					err = s.handleRead(events[ev])
 				} else if events[ev].Events == syscall.EPOLLOUT {
 					err = s.handleWrite(events[ev])
@@ -346,5 +442,17 @@ exit:
 	if err := syscall.Close(fd); err != nil {
 		s.Log.Warnf("Failed to close {%v} : %s", fd, err.Error())
 	}
-	return nil
+	return s.rejectedClientsError()
+}
+
+// rejectedClientsError returns error if remote clients were rejected and none of the
+// clients completed the transfer. Remote client not supporting the transfer token or
+// TLS connects without it, transfer is failed instead of silently running without them.
+func (s *Server) rejectedClientsError() error {
+	if s.state.rejectedCount == 0 || s.state.successCount > 0 {
+		return nil
+	}
+	return errors.Errorf("%d remote client(s) rejected due to invalid transfer token or TLS handshake, "+
+		"make sure storage engine version supports %s and %s annotations",
+		s.state.rejectedCount, DataTransferTokenAnnotation, DataTLSAnnotation)
 }
@@ -0,0 +1,247 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clouduploader
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"gocloud.dev/blob"
+)
+
+const (
+	// TLSHandshakeTimeout defines timeout for TLS handshake with client
+	TLSHandshakeTimeout = 30 * time.Second
+)
+
+// tlsConnTracker tracks the TLS clients connected to server
+type tlsConnTracker struct {
+	sync.Mutex
+	sync.WaitGroup
+
+	conns map[net.Conn]struct{}
+
+	// lastActivity is unix time, in nanosecond, of last data transfer
+	lastActivity int64
+}
+
+// activityConn updates the tracker on every data transfer
+type activityConn struct {
+	net.Conn
+	t *tlsConnTracker
+}
+
+func (a *activityConn) Read(b []byte) (int, error) {
+	n, err := a.Conn.Read(b)
+	atomic.StoreInt64(&a.t.lastActivity, time.Now().UnixNano())
+	return n, err
+}
+
+func (a *activityConn) Write(b []byte) (int, error) {
+	n, err := a.Conn.Write(b)
+	atomic.StoreInt64(&a.t.lastActivity, time.Now().UnixNano())
+	return n, err
+}
+
+// idle returns true if there was no data transfer for the given duration
+func (t *tlsConnTracker) idle(d time.Duration) bool {
+	last := atomic.LoadInt64(&t.lastActivity)
+	return time.Since(time.Unix(0, last)) >= d
+}
+
+// runTLS will start TLS server
+// Unlike Run, each client is served from its own goroutine since the
+// TLS record layer can't be driven from edge-triggered epoll events.
+func (s *Server) runTLS(opType ServerOperation, port int) error {
+	ln, err := net.Listen("tcp4", ":"+strconv.Itoa(port))
+	if err != nil {
+		s.Log.Errorf("Failed to listen on port {%v} : %s", port, err.Error())
+		return err
+	}
+
+	tcpLn := ln.(*net.TCPListener)
+
+	if s.cl.ConnReady != nil {
+		// Connection has started listening on the specified port
+		*s.cl.ConnReady <- true
+	}
+
+	s.OpType = opType
+	s.state.status = TransferStatusInit
+
+	tracker := &tlsConnTracker{
+		conns:        make(map[net.Conn]struct{}),
+		lastActivity: time.Now().UnixNano(),
+	}
+
+	timeout := EPOLLTIMEOUT * time.Millisecond
+	for {
+		if err = tcpLn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			s.Log.Errorf("Failed to set deadline on listener : %s", err.Error())
+			break
+		}
+
+		conn, err := tcpLn.Accept()
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				if s.cl.shouldExitServer() && tracker.idle(timeout) {
+					s.Log.Infof("Transfer done.. closing the server")
+					break
+				}
+				continue
+			}
+
+			s.Log.Errorf("Failed to accept connection : %s", err.Error())
+			s.closeTLSClients(tracker)
+			if cerr := ln.Close(); cerr != nil {
+				s.Log.Warnf("Failed to close listener : %s", cerr.Error())
+			}
+			return err
+		}
+
+		tracker.Lock()
+		tracker.conns[conn] = struct{}{}
+		tracker.Unlock()
+
+		tracker.Add(1)
+		go s.serveTLSClient(tls.Server(conn, s.cl.tlsConfig), conn, tracker)
+	}
+
+	s.closeTLSClients(tracker)
+	if err := ln.Close(); err != nil {
+		s.Log.Warnf("Failed to close listener : %s", err.Error())
+	}
+	return s.rejectedClientsError()
+}
+
+// serveTLSClient performs upload/download operation for the given client
+func (s *Server) serveTLSClient(tlsConn *tls.Conn, rawConn net.Conn, tracker *tlsConnTracker) {
+	var err error
+	var rejected bool
+	status := TransferStatusFailed
+	addr := rawConn.RemoteAddr().String()
+
+	defer func() {
+		if err := tlsConn.Close(); err != nil {
+			s.Log.Debugf("Failed to close client{%s} : %s", addr, err.Error())
+		}
+
+		tracker.Lock()
+		delete(tracker.conns, rawConn)
+		if status == TransferStatusDone {
+			s.state.successCount++
+		} else {
+			s.state.failedCount++
+		}
+		if rejected {
+			s.state.rejectedCount++
+		}
+		s.state.runningCount--
+		tracker.Unlock()
+
+		s.Log.Infof("Client{%s} operation completed.. status{%s}", addr, status)
+		tracker.Done()
+	}()
+
+	tracker.Lock()
+	s.state.runningCount++
+	tracker.Unlock()
+
+	// deadline covers both, TLS handshake and transfer token
+	if err = tlsConn.SetDeadline(time.Now().Add(TLSHandshakeTimeout)); err == nil {
+		err = tlsConn.Handshake()
+	}
+	if err != nil {
+		rejected = true
+		var recErr tls.RecordHeaderError
+		if errors.As(err, &recErr) {
+			s.Log.Errorf("Rejecting client{%s}, client is not using TLS, "+
+				"storage engine may not support %s annotation", addr, DataTLSAnnotation)
+			return
+		}
+		s.Log.Errorf("TLS handshake failed for client{%s} : %s", addr, err.Error())
+		return
+	}
+
+	if s.cl.transferToken != "" {
+		token := make([]byte, len(s.cl.transferToken))
+		if _, err = io.ReadFull(tlsConn, token); err != nil {
+			s.Log.Errorf("Failed to read transfer token from client{%s} : %s", addr, err.Error())
+			return
+		}
+
+		if !s.cl.authenticateClient(token) {
+			rejected = true
+			s.Log.Warningf("Rejecting client{%s}, invalid or already used transfer token", addr)
+			return
+		}
+		s.Log.Infof("Client{%s} authenticated", addr)
+	}
+
+	if err = tlsConn.SetDeadline(time.Time{}); err != nil {
+		s.Log.Errorf("Failed to reset deadline for client{%s} : %s", addr, err.Error())
+		return
+	}
+
+	rw := s.cl.Create(s.OpType)
+	if rw == nil {
+		s.Log.Errorf("Failed to create file interface for client{%s}", addr)
+		return
+	}
+	defer s.cl.Destroy(rw, s.OpType)
+
+	conn := &activityConn{Conn: tlsConn, t: tracker}
+
+	if s.cl.OnTransferStart != nil {
+		s.cl.OnTransferStart()
+	}
+
+	switch s.OpType {
+	case OpBackup:
+		_, err = io.Copy((*blob.Writer)(rw), conn)
+	case OpRestore:
+		_, err = io.Copy(conn, (*blob.Reader)(rw))
+	default:
+		err = errors.Errorf("Invalid server operation {%v}", s.OpType)
+	}
+
+	if err != nil {
+		s.Log.Errorf("Transfer failed for client{%s} : %s", addr, err.Error())
+		return
+	}
+	status = TransferStatusDone
+}
+
+// closeTLSClients disconnects all TLS clients and waits for them to finish
+func (s *Server) closeTLSClients(tracker *tlsConnTracker) {
+	tracker.Lock()
+	for conn := range tracker.conns {
+		s.Log.Infof("Disconnecting Client{%s}", conn.RemoteAddr().String())
+		if err := conn.Close(); err != nil {
+			s.Log.Warnf("Failed to close {%s}: %s", conn.RemoteAddr().String(), err.Error())
+		}
+	}
+	tracker.Unlock()
+
+	tracker.Wait()
+}
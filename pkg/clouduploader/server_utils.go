@@ -174,7 +174,9 @@ func (s *Server) handleClientError(err error, event syscall.EpollEvent, efd int)
 		s.Log.Warnf("Failed to close {%v}: %s", c.fd, err.Error())
 	}
 
-	s.cl.Destroy(c.file, s.OpType)
+	if c.file != nil {
+		s.cl.Destroy(c.file, s.OpType)
+	}
 	s.Log.Infof("Client{%v} operation completed.. completed count{%v}", c.fd, s.state.successCount)
 	s.removeFromClientList(c)
 }
@@ -203,7 +205,9 @@ func (s *Server) disconnectAllClient(efd int) {
 			s.Log.Warnf("Failed to close {%v}: %s", curClient.fd, err.Error())
 		}
 
-		s.cl.Destroy(curClient.file, s.OpType)
+		if curClient.file != nil {
+			s.cl.Destroy(curClient.file, s.OpType)
+		}
 		s.Log.Infof("Disconnecting Client{%v}", curClient.fd)
 
 		nextClient = curClient.next
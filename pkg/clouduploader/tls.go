@@ -0,0 +1,108 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clouduploader
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// DataTLSSecret config key for the secret having certificates for the data server
+	DataTLSSecret = "dataTLSSecret"
+
+	// DataTLSClientSecret config key for the secret, in openebs namespace, used by remote client
+	DataTLSClientSecret = "dataTLSClientSecret"
+
+	// DataTLSServerName config key for the server name remote client should verify
+	DataTLSServerName = "dataTLSServerName"
+
+	// TLSCertKey is the key for server certificate in data TLS secret
+	TLSCertKey = v1.TLSCertKey
+
+	// TLSPrivateKeyKey is the key for server private key in data TLS secret
+	TLSPrivateKeyKey = v1.TLSPrivateKeyKey
+
+	// TLSCAKey is the key for CA certificate, in data TLS secret, used to verify remote client
+	TLSCAKey = "ca.crt"
+)
+
+const (
+	// DataTLSAnnotation is set on backup/restore request if data server is using TLS
+	DataTLSAnnotation = "openebs.io/data-tls"
+
+	// DataTLSSecretAnnotation is the secret remote client should use to connect to data server
+	DataTLSSecretAnnotation = "openebs.io/data-tls-secret"
+
+	// DataTLSServerNameAnnotation is the server name remote client should verify
+	DataTLSServerNameAnnotation = "openebs.io/data-tls-server-name"
+)
+
+// InitTLS configures TLS for the data server using certificates from the given secret.
+// If secret is having CA certificate then remote client must present a certificate
+// signed by it.
+func (c *Conn) InitTLS(secret *v1.Secret, config map[string]string) error {
+	cert, err := tls.X509KeyPair(secret.Data[TLSCertKey], secret.Data[TLSPrivateKeyKey])
+	if err != nil {
+		return errors.Wrapf(err, "failed to load certificate from secret=%s", secret.Name)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if ca, ok := secret.Data[TLSCAKey]; ok && len(ca) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return errors.Errorf("failed to parse %s from secret=%s", TLSCAKey, secret.Name)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	c.tlsConfig = tlsConfig
+	c.tlsClientSecret = config[DataTLSClientSecret]
+	c.tlsServerName = config[DataTLSServerName]
+
+	c.Log.Infof("TLS enabled for data server, client verification=%v", tlsConfig.ClientCAs != nil)
+	return nil
+}
+
+// TLSAnnotations returns annotations, for backup/restore request, having trust settings
+// remote client needs to connect to the data server
+func (c *Conn) TLSAnnotations() map[string]string {
+	if c == nil || c.tlsConfig == nil {
+		return nil
+	}
+
+	annotations := map[string]string{
+		DataTLSAnnotation: "true",
+	}
+
+	if c.tlsClientSecret != "" {
+		annotations[DataTLSSecretAnnotation] = c.tlsClientSecret
+	}
+
+	if c.tlsServerName != "" {
+		annotations[DataTLSServerNameAnnotation] = c.tlsServerName
+	}
+	return annotations
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clouduploader
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DataTransferToken config key to enable per-transfer token authentication
+	DataTransferToken = "dataTransferToken"
+
+	// DataTransferTokenAnnotation is the token remote client must send before transferring data
+	DataTransferTokenAnnotation = "openebs.io/data-transfer-token"
+
+	// transferTokenLen defines number of random bytes in transfer token
+	transferTokenLen = 32
+)
+
+// GenerateTransferToken generates a one-time token for the next upload/download.
+// Remote client must send the token, as the first bytes on the connection,
+// before any data is transferred. Token is invalidated once a client is
+// authenticated using it, and discarded once the transfer completes.
+func (c *Conn) GenerateTransferToken() error {
+	return c.GenerateTransferTokenFor(1)
+}
+
+// GenerateTransferTokenFor generates a token for the next upload/download which
+// authenticates the given number of remote clients, like all the replicas of
+// cStor volume downloading the snapshot. Token is invalidated once the given
+// number of clients are authenticated using it.
+func (c *Conn) GenerateTransferTokenFor(clients int) error {
+	if !c.requireToken {
+		return nil
+	}
+
+	if clients < 1 {
+		return errors.Errorf("invalid number of clients{%d} for transfer token", clients)
+	}
+
+	b := make([]byte, transferTokenLen)
+	if _, err := rand.Read(b); err != nil {
+		return errors.Wrapf(err, "failed to generate transfer token")
+	}
+
+	c.transferToken = hex.EncodeToString(b)
+	atomic.StoreInt32(&c.tokenUses, int32(clients))
+	return nil
+}
+
+// resetTransferToken discards the token for the completed transfer
+func (c *Conn) resetTransferToken() {
+	c.transferToken = ""
+	atomic.StoreInt32(&c.tokenUses, 0)
+}
+
+// authenticateClient returns true if given token matches the token for current transfer,
+// and the token is not yet used by all the clients it was generated for.
+func (c *Conn) authenticateClient(token []byte) bool {
+	if subtle.ConstantTimeCompare(token, []byte(c.transferToken)) != 1 {
+		return false
+	}
+	return atomic.AddInt32(&c.tokenUses, -1) >= 0
+}
+
+// RemoteAnnotations returns annotations, for backup/restore request, having settings
+// remote client needs to connect to the data server
+func (c *Conn) RemoteAnnotations() map[string]string {
+	annotations := c.TLSAnnotations()
+
+	if c == nil || c.transferToken == "" {
+		return annotations
+	}
+
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[DataTransferTokenAnnotation] = c.transferToken
+	return annotations
+}
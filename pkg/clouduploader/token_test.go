@@ -0,0 +1,81 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clouduploader
+
+import (
+	"testing"
+)
+
+func TestAuthenticateClient(t *testing.T) {
+	tests := map[string]struct {
+		clients int
+		tokens  []string
+		valid   []bool
+	}{
+		"one-time token":      {1, []string{"token", "token"}, []bool{true, false}},
+		"invalid token":       {1, []string{"invalid", "token", "token"}, []bool{false, true, false}},
+		"token for replicas":  {3, []string{"token", "token", "token", "token"}, []bool{true, true, true, false}},
+		"invalid for replica": {2, []string{"token", "invalid", "token", "token"}, []bool{true, false, true, false}},
+	}
+
+	for name, test := range tests {
+		c := &Conn{requireToken: true}
+		if err := c.GenerateTransferTokenFor(test.clients); err != nil {
+			t.Fatalf("%s: failed to generate token : %v", name, err)
+		}
+		token := c.transferToken
+
+		for i, tk := range test.tokens {
+			if tk == "token" {
+				tk = token
+			}
+			if got := c.authenticateClient([]byte(tk)); got != test.valid[i] {
+				t.Errorf("%s: client %d authenticated=%v, expected %v", name, i, got, test.valid[i])
+			}
+		}
+
+		c.resetTransferToken()
+		if c.authenticateClient([]byte(token)) {
+			t.Errorf("%s: client authenticated after the transfer completed", name)
+		}
+	}
+}
+
+func TestGenerateTransferToken(t *testing.T) {
+	c := &Conn{}
+	if err := c.GenerateTransferToken(); err != nil || c.transferToken != "" {
+		t.Errorf("token generated when not required, token=%q err=%v", c.transferToken, err)
+	}
+	if c.RemoteAnnotations() != nil {
+		t.Errorf("annotations set when token is not required")
+	}
+
+	c.requireToken = true
+	if err := c.GenerateTransferTokenFor(0); err == nil {
+		t.Errorf("token generated for 0 clients")
+	}
+
+	if err := c.GenerateTransferToken(); err != nil {
+		t.Fatalf("failed to generate token : %v", err)
+	}
+	if len(c.transferToken) != 2*transferTokenLen {
+		t.Errorf("invalid token length %d", len(c.transferToken))
+	}
+	if c.RemoteAnnotations()[DataTransferTokenAnnotation] != c.transferToken {
+		t.Errorf("token is not set in annotations")
+	}
+}
@@ -0,0 +1,345 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	cloud "github.com/openebs/velero-plugin/pkg/clouduploader"
+	"github.com/openebs/velero-plugin/pkg/mover"
+	"github.com/openebs/velero-plugin/pkg/zfs/utils"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	VeleroBkpKey  = "velero.io/backup"
+	VeleroSchdKey = "velero.io/schedule-name"
+	VeleroVolKey  = "velero.io/volname"
+)
+
+func (p *Plugin) getPV(volumeID string) (*v1.PersistentVolume, error) {
+	return p.K8sClient.
+		CoreV1().
+		PersistentVolumes().
+		Get(context.TODO(), volumeID, metav1.GetOptions{})
+}
+
+func (p *Plugin) getPVC(ns, name string) (*v1.PersistentVolumeClaim, error) {
+	return p.K8sClient.
+		CoreV1().
+		PersistentVolumeClaims(ns).
+		Get(context.TODO(), name, metav1.GetOptions{})
+}
+
+func (p *Plugin) deletePVC(ns, name string) {
+	err := p.K8sClient.CoreV1().PersistentVolumeClaims(ns).Delete(context.TODO(), name, metav1.DeleteOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		p.Log.Warnf("csi: Failed to delete the pvc %s/%s : %s", ns, name, err.Error())
+	}
+}
+
+// createSnapshot creates the VolumeSnapshot of the given PVC and waits for it to be ready to use.
+// It returns the restore size of the snapshot.
+func (p *Plugin) createSnapshot(pvc *v1.PersistentVolumeClaim, name string) (*resource.Quantity, error) {
+	spec := map[string]interface{}{
+		"source": map[string]interface{}{
+			"persistentVolumeClaimName": pvc.Name,
+		},
+	}
+	if p.snapshotClass != "" {
+		spec["volumeSnapshotClassName"] = p.snapshotClass
+	}
+
+	snap := &unstructured.Unstructured{}
+	snap.SetAPIVersion(volumeSnapshotResource.GroupVersion().String())
+	snap.SetKind("VolumeSnapshot")
+	snap.SetName(name)
+	snap.SetNamespace(pvc.Namespace)
+	snap.Object["spec"] = spec
+
+	p.Log.Debugf("csi: creating VolumeSnapshot pvc = %s/%s snap = %s", pvc.Namespace, pvc.Name, name)
+
+	_, err := p.dynClient.Resource(volumeSnapshotResource).Namespace(pvc.Namespace).
+		Create(context.TODO(), snap, metav1.CreateOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "csi: failed to create snapshot %s", name)
+	}
+
+	return p.checkSnapCreation(pvc.Namespace, name)
+}
+
+// checkSnapCreation waits for the VolumeSnapshot to be ready to use, upto csiStatusTimeout.
+// It returns the restore size of the snapshot.
+func (p *Plugin) checkSnapCreation(ns, name string) (*resource.Quantity, error) {
+	var size *resource.Quantity
+
+	err := wait.PollImmediate(statusInterval, csiStatusTimeout, func() (bool, error) {
+		snap, err := p.dynClient.Resource(volumeSnapshotResource).Namespace(ns).
+			Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			p.Log.Errorf("csi: Failed to fetch snapshot {%s/%s}", ns, name)
+			return false, err
+		}
+
+		if msg, ok, _ := unstructured.NestedString(snap.Object, "status", "error", "message"); ok {
+			return false, errors.Errorf("csi: error in creating snapshot %s/%s : %s", ns, name, msg)
+		}
+
+		if ready, _, _ := unstructured.NestedBool(snap.Object, "status", "readyToUse"); !ready {
+			return false, nil
+		}
+
+		if restoreSize, ok, _ := unstructured.NestedString(snap.Object, "status", "restoreSize"); ok {
+			q, err := resource.ParseQuantity(restoreSize)
+			if err != nil {
+				return false, errors.Wrapf(err, "csi: invalid restore size %s of snapshot %s/%s", restoreSize, ns, name)
+			}
+			size = &q
+		}
+		return true, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return nil, errors.Errorf("csi: snapshot %s/%s is not ready in %s", ns, name, csiStatusTimeout)
+	}
+	return size, err
+}
+
+// deleteSnapshot deletes the VolumeSnapshot created for the upload
+func (p *Plugin) deleteSnapshot(ns, name string) {
+	err := p.dynClient.Resource(volumeSnapshotResource).Namespace(ns).
+		Delete(context.TODO(), name, metav1.DeleteOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		p.Log.Warnf("csi: Failed to delete the snapshot %s/%s : %s", ns, name, err.Error())
+	}
+}
+
+// allowVolumeModeChange annotates the VolumeSnapshotContent of given snapshot, so that
+// block mode volume can be created from the snapshot of filesystem mode volume
+func (p *Plugin) allowVolumeModeChange(ns, snapname string) error {
+	snap, err := p.dynClient.Resource(volumeSnapshotResource).Namespace(ns).
+		Get(context.TODO(), snapname, metav1.GetOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "csi: failed to fetch snapshot %s/%s", ns, snapname)
+	}
+
+	content, ok, _ := unstructured.NestedString(snap.Object, "status", "boundVolumeSnapshotContentName")
+	if !ok || content == "" {
+		return errors.Errorf("csi: snapshot %s/%s is not bound to VolumeSnapshotContent", ns, snapname)
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{allowVolumeModeChangeAnnotation: "true"},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = p.dynClient.Resource(volumeSnapshotContentResource).
+		Patch(context.TODO(), content, types.MergePatchType, data, metav1.PatchOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "csi: failed to set %s on VolumeSnapshotContent %s", allowVolumeModeChangeAnnotation, content)
+	}
+	return nil
+}
+
+// createClone creates the block mode PVC, in the namespace of given PVC, from the given snapshot
+func (p *Plugin) createClone(pvc *v1.PersistentVolumeClaim, snapname string, size resource.Quantity) (*v1.PersistentVolumeClaim, error) {
+	if pvc.Spec.VolumeMode == nil || *pvc.Spec.VolumeMode != v1.PersistentVolumeBlock {
+		if err := p.allowVolumeModeChange(pvc.Namespace, snapname); err != nil {
+			return nil, err
+		}
+	}
+
+	apiGroup := volumeSnapshotResource.Group
+	blockMode := v1.PersistentVolumeBlock
+
+	clone := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      snapname,
+			Namespace: pvc.Namespace,
+			Labels:    map[string]string{mover.HelperPodLabel: "true"},
+		},
+		Spec: v1.PersistentVolumeClaimSpec{
+			AccessModes:      pvc.Spec.AccessModes,
+			StorageClassName: pvc.Spec.StorageClassName,
+			VolumeMode:       &blockMode,
+			DataSource: &v1.TypedLocalObjectReference{
+				APIGroup: &apiGroup,
+				Kind:     "VolumeSnapshot",
+				Name:     snapname,
+			},
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{v1.ResourceStorage: size},
+			},
+		},
+	}
+
+	return p.K8sClient.CoreV1().PersistentVolumeClaims(pvc.Namespace).Create(context.TODO(), clone, metav1.CreateOptions{})
+}
+
+// checkClone returns error if the provisioner keeps failing to create the volume of clone PVC,
+// like when the driver doesn't support block mode volume from the snapshot
+func (p *Plugin) checkClone(ns, name string) error {
+	clone, err := p.getPVC(ns, name)
+	if err != nil {
+		return errors.Wrapf(err, "csi: failed to fetch clone pvc %s/%s", ns, name)
+	}
+
+	if clone.Status.Phase == v1.ClaimBound {
+		return nil
+	}
+
+	events, err := p.K8sClient.CoreV1().Events(ns).List(context.TODO(), metav1.ListOptions{
+		FieldSelector: fields.Set{
+			"involvedObject.kind": "PersistentVolumeClaim",
+			"involvedObject.name": name,
+			"involvedObject.uid":  string(clone.UID),
+			"reason":              provisioningFailedReason,
+		}.String(),
+	})
+	if err != nil {
+		p.Log.Warnf("csi: failed to list events of clone pvc %s/%s : %s", ns, name, err.Error())
+		return nil
+	}
+
+	return cloneError(ns, name, events.Items)
+}
+
+// cloneError returns error with the message of the last provisioning failure
+// if provisioning of the clone PVC has failed cloneFailureCount times
+func cloneError(ns, name string, events []v1.Event) error {
+	var last *v1.Event
+	count := int32(0)
+
+	for i, e := range events {
+		if e.Reason != provisioningFailedReason {
+			continue
+		}
+
+		// count is not set for the events created by events/v1 API
+		if e.Count > 0 {
+			count += e.Count
+		} else {
+			count++
+		}
+
+		if last == nil || last.LastTimestamp.Before(&e.LastTimestamp) {
+			last = &events[i]
+		}
+	}
+
+	if count < cloneFailureCount {
+		return nil
+	}
+	return errors.Errorf("csi: clone pvc %s/%s is rejected by the provisioner : %s", ns, name, last.Message)
+}
+
+func (p *Plugin) doBackup(volumeID string, snapname string, schdname string, port int) (string, error) {
+	pv, err := p.getPV(volumeID)
+	if err != nil {
+		p.Log.Errorf("csi: Failed to get pv %s snap %s schd %s err %v", volumeID, snapname, schdname, err)
+		return "", err
+	}
+
+	if pv.Spec.ClaimRef == nil {
+		return "", errors.Errorf("csi: err pv %s is not claimed", volumeID)
+	}
+
+	pvc, err := p.getPVC(pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name)
+	if err != nil {
+		return "", errors.Wrapf(err, "csi: failed to get pvc of pv %s", volumeID)
+	}
+
+	filename := p.cl.GenerateRemoteFileWithSchd(volumeID, schdname, snapname)
+	if filename == "" {
+		return "", errors.Errorf("csi: error creating remote file name for backup")
+	}
+
+	name := utils.GenerateResourceName(pvc.Name, snapname)
+
+	thaw, err := p.freezer.Freeze(pvc.Namespace, pvc.Name)
+	if err != nil {
+		return "", errors.Wrapf(err, "csi: failed to freeze application")
+	}
+
+	restoreSize, err := p.createSnapshot(pvc, name)
+	thawErr := thaw()
+
+	defer p.deleteSnapshot(pvc.Namespace, name)
+
+	if err != nil {
+		p.Log.Errorf("csi: snapshot failed vol %s snap %s err: %v", volumeID, name, err)
+		return "", err
+	}
+	if thawErr != nil {
+		return "", errors.Wrapf(thawErr, "csi: snapshot %s is not app-consistent", name)
+	}
+
+	// time of the snapshot, used for point-in-time restore
+	snapTime := time.Now().UTC()
+
+	size := pvc.Status.Capacity[v1.ResourceStorage]
+	if restoreSize != nil && restoreSize.Cmp(size) > 0 {
+		size = *restoreSize
+	}
+
+	clone, err := p.createClone(pvc, name, size)
+	if err != nil {
+		return "", errors.Wrapf(err, "csi: failed to clone snapshot %s/%s", pvc.Namespace, name)
+	}
+	defer p.deletePVC(clone.Namespace, clone.Name)
+
+	p.Log.Debugf("csi: uploading Snapshot %s file %s", snapname, filename)
+
+	err = p.mover.Upload(p.cl, &mover.Transfer{
+		Name:      "csi-backup",
+		Namespace: clone.Namespace,
+		Volume: &v1.Volume{
+			VolumeSource: v1.VolumeSource{
+				PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: clone.Name},
+			},
+		},
+		Op: mover.OpUpload,
+		Check: func() error {
+			return p.checkClone(clone.Namespace, clone.Name)
+		},
+	}, filename, size.Value(), port, &cloud.SnapshotManifest{
+		Backup:    snapname,
+		Timestamp: snapTime,
+	})
+	if err != nil {
+		p.Log.Errorf("csi: backup failed vol %s snap %s err: %v", volumeID, name, err)
+		return "", errors.Wrapf(err, "csi: failed to upload snapshot %s", name)
+	}
+
+	snapID := utils.GenerateSnapshotID(volumeID, schdname, snapname)
+
+	p.Log.Debugf("csi: backup done vol %s snap %s snapID %s", volumeID, name, snapID)
+	return snapID, nil
+}
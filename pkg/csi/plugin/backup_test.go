@@ -0,0 +1,196 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCloneError(t *testing.T) {
+	now := time.Now()
+	event := func(reason, msg string, count int32, age time.Duration) v1.Event {
+		return v1.Event{
+			Reason:        reason,
+			Message:       msg,
+			Count:         count,
+			LastTimestamp: metav1.NewTime(now.Add(-age)),
+		}
+	}
+
+	tests := map[string]struct {
+		events []v1.Event
+		msg    string
+	}{
+		"no events":         {nil, ""},
+		"transient failure": {[]v1.Event{event(provisioningFailedReason, "snapshot not ready", 1, 0)}, ""},
+		"other events":      {[]v1.Event{event("Provisioning", "provisioning", 5, 0)}, ""},
+		"repeated failure":  {[]v1.Event{event(provisioningFailedReason, "volume mode change not allowed", 3, 0)}, "volume mode change not allowed"},
+		"events without count": {[]v1.Event{
+			event(provisioningFailedReason, "old failure", 0, time.Minute),
+			event(provisioningFailedReason, "block mode not supported", 0, 0),
+			event(provisioningFailedReason, "old failure", 0, 2*time.Minute),
+		}, "block mode not supported"},
+	}
+
+	for name, test := range tests {
+		err := cloneError("app", "clone", test.events)
+		if test.msg == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", name, err)
+			}
+			continue
+		}
+
+		if err == nil || !strings.Contains(err.Error(), test.msg) {
+			t.Errorf("%s: expected error with message %q, got %v", name, test.msg, err)
+		}
+	}
+}
+
+func newTestSnapshot(ns, name, content string) *unstructured.Unstructured {
+	snap := &unstructured.Unstructured{}
+	snap.SetAPIVersion(volumeSnapshotResource.GroupVersion().String())
+	snap.SetKind("VolumeSnapshot")
+	snap.SetNamespace(ns)
+	snap.SetName(name)
+	if content != "" {
+		snap.Object["status"] = map[string]interface{}{"boundVolumeSnapshotContentName": content}
+	}
+	return snap
+}
+
+func newTestSnapshotContent(name string) *unstructured.Unstructured {
+	content := &unstructured.Unstructured{}
+	content.SetAPIVersion(volumeSnapshotContentResource.GroupVersion().String())
+	content.SetKind("VolumeSnapshotContent")
+	content.SetName(name)
+	return content
+}
+
+func TestCreateClone(t *testing.T) {
+	blockMode := v1.PersistentVolumeBlock
+	fsMode := v1.PersistentVolumeFilesystem
+
+	tests := map[string]struct {
+		mode        *v1.PersistentVolumeMode
+		content     string
+		modeChanged bool
+		hasError    bool
+	}{
+		"filesystem mode":         {mode: &fsMode, content: "content-1", modeChanged: true},
+		"default mode":            {mode: nil, content: "content-1", modeChanged: true},
+		"block mode":              {mode: &blockMode, content: "content-1", modeChanged: false},
+		"unbound snapshot":        {mode: &fsMode, content: "", hasError: true},
+		"block mode unbound snap": {mode: &blockMode, content: "", modeChanged: false},
+	}
+
+	for name, test := range tests {
+		p := &Plugin{
+			Log:       logrus.New(),
+			K8sClient: fake.NewSimpleClientset(),
+			dynClient: dynfake.NewSimpleDynamicClient(runtime.NewScheme(),
+				newTestSnapshot("app", "snap-1", test.content),
+				newTestSnapshotContent("content-1"),
+			),
+		}
+
+		pvc := &v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "app", Name: "data"},
+			Spec:       v1.PersistentVolumeClaimSpec{VolumeMode: test.mode},
+		}
+
+		clone, err := p.createClone(pvc, "snap-1", resource.MustParse("1Gi"))
+		if (err != nil) != test.hasError {
+			t.Errorf("%s: unexpected error %v", name, err)
+			continue
+		}
+		if test.hasError {
+			continue
+		}
+
+		if clone.Spec.VolumeMode == nil || *clone.Spec.VolumeMode != v1.PersistentVolumeBlock {
+			t.Errorf("%s: clone pvc is not in block mode", name)
+		}
+		if clone.Spec.DataSource == nil || clone.Spec.DataSource.Name != "snap-1" {
+			t.Errorf("%s: clone pvc is not created from the snapshot", name)
+		}
+
+		content, err := p.dynClient.Resource(volumeSnapshotContentResource).
+			Get(context.TODO(), "content-1", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("%s: failed to get VolumeSnapshotContent : %v", name, err)
+		}
+		if modeChanged := content.GetAnnotations()[allowVolumeModeChangeAnnotation] == "true"; modeChanged != test.modeChanged {
+			t.Errorf("%s: got %s=%v, expected %v", name, allowVolumeModeChangeAnnotation, modeChanged, test.modeChanged)
+		}
+	}
+}
+
+func TestCheckClone(t *testing.T) {
+	clone := func(phase v1.PersistentVolumeClaimPhase) *v1.PersistentVolumeClaim {
+		return &v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "app", Name: "clone", UID: "uid-1"},
+			Status:     v1.PersistentVolumeClaimStatus{Phase: phase},
+		}
+	}
+	event := func(count int32) *v1.Event {
+		return &v1.Event{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "app", Name: "clone.1"},
+			InvolvedObject: v1.ObjectReference{
+				Kind: "PersistentVolumeClaim", Namespace: "app", Name: "clone", UID: "uid-1",
+			},
+			Reason:  provisioningFailedReason,
+			Message: "volume mode change not allowed",
+			Count:   count,
+		}
+	}
+
+	tests := map[string]struct {
+		objects  []runtime.Object
+		rejected bool
+	}{
+		"bound clone":          {objects: []runtime.Object{clone(v1.ClaimBound), event(cloneFailureCount)}},
+		"pending clone":        {objects: []runtime.Object{clone(v1.ClaimPending)}},
+		"transient failure":    {objects: []runtime.Object{clone(v1.ClaimPending), event(1)}},
+		"rejected clone":       {objects: []runtime.Object{clone(v1.ClaimPending), event(cloneFailureCount)}, rejected: true},
+		"clone does not exist": {rejected: true},
+	}
+
+	for name, test := range tests {
+		p := &Plugin{
+			Log:       logrus.New(),
+			K8sClient: fake.NewSimpleClientset(test.objects...),
+		}
+
+		err := p.checkClone("app", "clone")
+		if (err != nil) != test.rejected {
+			t.Errorf("%s: unexpected error %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	cloud "github.com/openebs/velero-plugin/pkg/clouduploader"
+	"github.com/openebs/velero-plugin/pkg/freeze"
+	"github.com/openebs/velero-plugin/pkg/mover"
+	"github.com/openebs/velero-plugin/pkg/velero"
+	"github.com/openebs/velero-plugin/pkg/zfs/utils"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// CSISnapshotClass config key for the VolumeSnapshotClass used for the snapshot.
+	// If not set, default VolumeSnapshotClass of the driver is used.
+	CSISnapshotClass = "volumeSnapshotClass"
+
+	// CSIDrivers config key for comma separated list of CSI drivers to back up.
+	// If not set, volumes of all the CSI drivers, except cStor, ZFS-LocalPV and
+	// LVM-LocalPV, are backed up.
+	CSIDrivers = "drivers"
+
+	// CSIRestorePort is the port to connect for restoring the data
+	CSIRestorePort = 9014
+
+	// CSIBackupPort is the port to connect for backup
+	CSIBackupPort = 9015
+
+	// statusInterval is the interval to check the status of snapshot and volume
+	statusInterval = 5 * time.Second
+
+	// csiStatusTimeout is the maximum duration to wait for the snapshot to be ready, or the PV to be removed
+	csiStatusTimeout = 10 * time.Minute
+
+	// allowVolumeModeChangeAnnotation allows creating the block mode volume from the snapshot
+	// of filesystem mode volume, required by external-snapshotter >= v6
+	allowVolumeModeChangeAnnotation = "snapshot.storage.kubernetes.io/allow-volume-mode-change"
+
+	// provisioningFailedReason is the reason of event generated when the volume of PVC can't be provisioned
+	provisioningFailedReason = "ProvisioningFailed"
+
+	// cloneFailureCount is the number of provisioning failures after which the clone is considered rejected
+	cloneFailureCount = 3
+)
+
+var (
+	// volumeSnapshotResource is the CSI VolumeSnapshot resource
+	volumeSnapshotResource = schema.GroupVersionResource{
+		Group:    "snapshot.storage.k8s.io",
+		Version:  "v1beta1",
+		Resource: "volumesnapshots",
+	}
+
+	// volumeSnapshotContentResource is the CSI VolumeSnapshotContent resource
+	volumeSnapshotContentResource = schema.GroupVersionResource{
+		Group:    "snapshot.storage.k8s.io",
+		Version:  "v1beta1",
+		Resource: "volumesnapshotcontents",
+	}
+
+	// excludedDrivers have their own volume snapshotter
+	excludedDrivers = []string{
+		"cstor.csi.openebs.io",
+		"zfs.csi.openebs.io",
+		"local.csi.openebs.io",
+	}
+)
+
+// Plugin is a plugin for containing state for the generic CSI blockstore
+type Plugin struct {
+	Log logrus.FieldLogger
+
+	// K8sClient is used for kubernetes operation
+	K8sClient kubernetes.Interface
+
+	// dynClient is used for VolumeSnapshot resources
+	dynClient dynamic.Interface
+
+	// on this address cloud server will perform data operation(backup/restore)
+	remoteAddr string
+
+	// snapshotClass is the VolumeSnapshotClass for the snapshot
+	snapshotClass string
+
+	// drivers is the list of CSI drivers to back up
+	drivers []string
+
+	// strictVolumeCheck fails the backup of OpenEBS PV which can't be snapshotted
+	strictVolumeCheck bool
+
+	// cl stores cloud connection information
+	cl *cloud.Conn
+
+	// freezer freezes the application, for app-consistent snapshot
+	freezer *freeze.Freezer
+
+	// mover transfers the volume data using helper pod
+	mover *mover.Mover
+}
+
+// Init prepares the VolumeSnapshotter for usage using the provided map of
+// configuration key-value pairs.
+func (p *Plugin) Init(config map[string]string) error {
+	p.Log.Debugf("csi: Init called %v", config)
+
+	p.remoteAddr, _ = utils.GetServerAddress()
+	if p.remoteAddr == "" {
+		return errors.New("csi: error fetching Server address")
+	}
+
+	p.snapshotClass = config[CSISnapshotClass]
+
+	if drivers := config[CSIDrivers]; drivers != "" {
+		for _, d := range strings.Split(drivers, ",") {
+			if d = strings.TrimSpace(d); d != "" {
+				p.drivers = append(p.drivers, d)
+			}
+		}
+	}
+
+	// data is transferred by helper pod, which doesn't support TLS
+	if secretName, ok := config[cloud.DataTLSSecret]; ok && secretName != "" {
+		return errors.New("csi: TLS for data server is not supported for CSI volumes")
+	}
+
+	conf, err := rest.InClusterConfig()
+	if err != nil {
+		p.Log.Errorf("Failed to get cluster config : %s", err.Error())
+		return errors.New("error fetching cluster config")
+	}
+
+	clientset, err := kubernetes.NewForConfig(conf)
+	if err != nil {
+		p.Log.Errorf("Error creating clientset : %s", err.Error())
+		return errors.New("error creating k8s client")
+	}
+	p.K8sClient = clientset
+
+	p.dynClient, err = dynamic.NewForConfig(conf)
+	if err != nil {
+		return errors.Wrapf(err, "csi: error creating dynamic client")
+	}
+
+	if err := velero.InitializeClientSet(conf); err != nil {
+		return errors.Wrapf(err, "failed to initialize velero clientSet")
+	}
+
+	p.freezer, err = freeze.NewFreezer(p.Log, conf, p.K8sClient, config)
+	if err != nil {
+		return errors.Wrapf(err, "csi: failed to initialize freezer")
+	}
+
+	if strict, ok := config[velero.StrictVolumeCheck]; ok {
+		p.strictVolumeCheck, err = strconv.ParseBool(strict)
+		if err != nil {
+			return errors.Wrapf(err, "csi: invalid %s value=%s", velero.StrictVolumeCheck, strict)
+		}
+	}
+
+	p.mover, err = mover.NewMover(p.Log, p.K8sClient, p.remoteAddr, config)
+	if err != nil {
+		return errors.Wrapf(err, "csi: failed to initialize helper pod config")
+	}
+
+	p.cl = &cloud.Conn{Log: p.Log}
+	return p.cl.Init(config)
+}
+
+// CreateVolumeFromSnapshot creates a new volume from the specified snapshot
+func (p *Plugin) CreateVolumeFromSnapshot(snapshotID, volumeType, volumeAZ string, iops *int64) (string, error) {
+	p.Log.Debugf("csi: CreateVolumeFromSnapshot called snap %s", snapshotID)
+
+	volumeID, err := p.doRestore(snapshotID, CSIRestorePort)
+	if err != nil {
+		p.Log.Errorf("csi: error CreateVolumeFromSnapshot returning snap %s err %v", snapshotID, err)
+		return "", err
+	}
+
+	p.Log.Infof("csi: CreateVolumeFromSnapshot returning snap %s vol %s", snapshotID, volumeID)
+	return volumeID, nil
+}
+
+// GetVolumeInfo returns the type and IOPS (if using provisioned IOPS) for
+// the specified volume in the given availability zone.
+func (p *Plugin) GetVolumeInfo(volumeID, volumeAZ string) (string, *int64, error) {
+	return "csi", nil, nil
+}
+
+// IsVolumeReady Check if the volume is ready.
+func (p *Plugin) IsVolumeReady(volumeID, volumeAZ string) (ready bool, err error) {
+	return true, nil
+}
+
+// CreateSnapshot creates a snapshot of the specified volume, and uploads it to cloud storage
+func (p *Plugin) CreateSnapshot(volumeID, volumeAZ string, tags map[string]string) (string, error) {
+	p.Log.Debugf("csi: CreateSnapshot called", volumeID, volumeAZ, tags)
+
+	bkpname, ok := tags[VeleroBkpKey]
+	if !ok {
+		return "", errors.New("csi: error get backup name")
+	}
+
+	// backups are full backups, schedule is used only for the remote file path
+	schdname := tags[VeleroSchdKey]
+
+	snapshotID, err := p.doBackup(volumeID, bkpname, schdname, CSIBackupPort)
+	if err != nil {
+		p.Log.Errorf("csi: error createBackup %s@%s failed %v", volumeID, bkpname, err)
+		return "", err
+	}
+
+	p.Log.Infof("csi: CreateSnapshot returning %s", snapshotID)
+	return snapshotID, nil
+}
+
+// DeleteSnapshot deletes the specified volume snapshot from cloud storage
+func (p *Plugin) DeleteSnapshot(snapshotID string) error {
+	p.Log.Debugf("csi: DeleteSnapshot called %s", snapshotID)
+	if snapshotID == "" {
+		p.Log.Warning("csi: Empty snapshotID")
+		return nil
+	}
+
+	return mover.DeleteBackup(p.cl, snapshotID)
+}
+
+// GetVolumeID returns the specific identifier for the PersistentVolume.
+func (p *Plugin) GetVolumeID(unstructuredPV runtime.Unstructured) (string, error) {
+	pv := new(v1.PersistentVolume)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(unstructuredPV.UnstructuredContent(), pv); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	// If PV doesn't have sufficient info to consider as CSI Volume
+	// then we will return empty volumeId and error as nil, unless strict check is enabled.
+	if reason := velero.MissingPVInfo(pv); reason != "" {
+		return "", velero.SkipVolume(p.Log, pv, reason, p.strictVolumeCheck)
+	}
+
+	// PVC is needed to create the snapshot
+	if pv.Spec.ClaimRef == nil {
+		return "", velero.SkipVolume(p.Log, pv, velero.SkipNotClaimed, p.strictVolumeCheck)
+	}
+
+	if pv.Spec.CSI == nil || !p.isSupportedDriver(pv.Spec.CSI.Driver) {
+		return "", velero.SkipVolume(p.Log, pv, velero.SkipOtherEngine, p.strictVolumeCheck)
+	}
+
+	if pv.Status.Phase == v1.VolumeReleased ||
+		pv.Status.Phase == v1.VolumeFailed {
+		return "", errors.New("pv is in released state")
+	}
+
+	return pv.Name, nil
+}
+
+// SetVolumeID sets the specific identifier for the PersistentVolume.
+// CSI source, node affinity and capacity of the PV are taken from the restored volume.
+func (p *Plugin) SetVolumeID(unstructuredPV runtime.Unstructured, volumeID string) (runtime.Unstructured, error) {
+	pv := new(v1.PersistentVolume)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(unstructuredPV.UnstructuredContent(), pv); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	rpv, err := p.releaseRestoredPV(volumeID)
+	if err != nil {
+		return nil, err
+	}
+
+	pv.Name = volumeID
+	pv.Spec.CSI.VolumeHandle = rpv.Spec.CSI.VolumeHandle
+	pv.Spec.CSI.VolumeAttributes = rpv.Spec.CSI.VolumeAttributes
+	pv.Spec.NodeAffinity = rpv.Spec.NodeAffinity
+
+	// volume might be restored with larger size
+	if size, ok := rpv.Spec.Capacity[v1.ResourceStorage]; ok {
+		if pv.Spec.Capacity == nil {
+			pv.Spec.Capacity = v1.ResourceList{}
+		}
+		pv.Spec.Capacity[v1.ResourceStorage] = size
+	}
+
+	res, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pv)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &unstructured.Unstructured{Object: res}, nil
+}
+
+// isSupportedDriver checks if the volumes of given CSI driver are backed up by the plugin
+func (p *Plugin) isSupportedDriver(driver string) bool {
+	if len(p.drivers) != 0 {
+		return contains(p.drivers, driver)
+	}
+	return !contains(excludedDrivers, driver)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,248 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+
+	"github.com/openebs/velero-plugin/pkg/mover"
+	"github.com/openebs/velero-plugin/pkg/velero"
+	"github.com/openebs/velero-plugin/pkg/zfs/utils"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// getBackupPVC return the PVC of the given volume from velero backup content.
+// Requested size is set to the capacity of volume, as it may be more than the requested size.
+func (p *Plugin) getBackupPVC(pvname, bkpname string) (*v1.PersistentVolumeClaim, error) {
+	pv, err := velero.GetBackupPV(bkpname, pvname)
+	if err != nil {
+		return nil, errors.Wrapf(err, "csi: failed to get pv %s from backup %s", pvname, bkpname)
+	}
+
+	pvc, err := velero.GetBackupPVC(bkpname, pvname)
+	if err != nil {
+		return nil, errors.Wrapf(err, "csi: failed to get pvc of pv %s from backup %s", pvname, bkpname)
+	}
+
+	if size, ok := pv.Spec.Capacity[v1.ResourceStorage]; ok {
+		pvc.Spec.Resources.Requests = v1.ResourceList{v1.ResourceStorage: size}
+	}
+	return pvc, nil
+}
+
+// ensureNamespace creates the given namespace if it doesn't exist
+func (p *Plugin) ensureNamespace(ns string) error {
+	_, err := p.K8sClient.CoreV1().Namespaces().Get(context.TODO(), ns, metav1.GetOptions{})
+	if err == nil || !k8serrors.IsNotFound(err) {
+		return err
+	}
+
+	_, err = p.K8sClient.CoreV1().Namespaces().Create(context.TODO(),
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: ns}}, metav1.CreateOptions{})
+	if err != nil && !k8serrors.IsAlreadyExists(err) {
+		return errors.Wrapf(err, "csi: failed to create namespace %s", ns)
+	}
+	return nil
+}
+
+// checkRestoreSize returns error if the volume of given backup PVC can't be restored with the given size.
+// Filesystem isn't grown by the restore, so it fails for filesystem mode volume if the given size is larger.
+func checkRestoreSize(pvname string, bkpPVC *v1.PersistentVolumeClaim, rsize resource.Quantity) error {
+	size := bkpPVC.Spec.Resources.Requests[v1.ResourceStorage]
+
+	switch {
+	case rsize.Cmp(size) < 0:
+		return errors.Errorf("csi: restore size %s is less than volume size %s", rsize.String(), size.String())
+	case rsize.Cmp(size) > 0 && (bkpPVC.Spec.VolumeMode == nil || *bkpPVC.Spec.VolumeMode != v1.PersistentVolumeBlock):
+		return errors.Errorf("csi: restore size is supported only for block mode volume, expand the PVC of %s after restore", pvname)
+	}
+	return nil
+}
+
+// buildRestorePVC return the block mode PVC to create the volume for the given backup PVC
+func (p *Plugin) buildRestorePVC(pvname, bkpname string, bkpPVC *v1.PersistentVolumeClaim) (*v1.PersistentVolumeClaim, error) {
+	// get the target namespace
+	ns, err := velero.GetRestoreNamespace(bkpPVC.Namespace, bkpname, p.Log)
+	if err != nil {
+		p.Log.Errorf("csi: failed to get target ns for pv=%s, bkpname=%s err: %v", pvname, bkpname, err)
+		return nil, err
+	}
+
+	size := bkpPVC.Spec.Resources.Requests[v1.ResourceStorage]
+
+	rsize, err := velero.GetRestoreSize(pvname, bkpname)
+	if err != nil {
+		return nil, err
+	}
+
+	if rsize != nil {
+		if err := checkRestoreSize(pvname, bkpPVC, *rsize); err != nil {
+			return nil, err
+		}
+
+		p.Log.Debugf("csi: restore size %s=>%s", size.String(), rsize.String())
+		size = *rsize
+	}
+
+	blockMode := v1.PersistentVolumeBlock
+
+	return &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "velero-restore-",
+			Namespace:    ns,
+			Labels:       map[string]string{mover.HelperPodLabel: "true", VeleroVolKey: pvname},
+			Annotations:  map[string]string{VeleroBkpKey: bkpname},
+		},
+		Spec: v1.PersistentVolumeClaimSpec{
+			AccessModes:      bkpPVC.Spec.AccessModes,
+			StorageClassName: bkpPVC.Spec.StorageClassName,
+			VolumeMode:       &blockMode,
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{v1.ResourceStorage: size},
+			},
+		},
+	}, nil
+}
+
+// dataRestore downloads the uploaded snapshot to the given PVC
+func (p *Plugin) dataRestore(pvc *v1.PersistentVolumeClaim, filename string, port int) error {
+	// volume is provisioned when the helper pod is scheduled
+	return p.mover.Download(p.cl, &mover.Transfer{
+		Name:      "csi-restore",
+		Namespace: pvc.Namespace,
+		Volume: &v1.Volume{
+			VolumeSource: v1.VolumeSource{
+				PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: pvc.Name},
+			},
+		},
+		Op: mover.OpDownload,
+	}, filename, port)
+}
+
+// retainVolume sets the reclaim policy of the PV bound to given PVC to Retain
+// and deletes the PVC, so that PV can be restored by velero for the application PVC.
+// It returns the name of the PV.
+func (p *Plugin) retainVolume(pvc *v1.PersistentVolumeClaim) (string, error) {
+	pvc, err := p.getPVC(pvc.Namespace, pvc.Name)
+	if err != nil {
+		return "", err
+	}
+
+	if pvc.Spec.VolumeName == "" {
+		return "", errors.Errorf("csi: pvc %s/%s is not bound", pvc.Namespace, pvc.Name)
+	}
+
+	patch := []byte(`{"spec":{"persistentVolumeReclaimPolicy":"` + string(v1.PersistentVolumeReclaimRetain) + `"}}`)
+	_, err = p.K8sClient.CoreV1().PersistentVolumes().
+		Patch(context.TODO(), pvc.Spec.VolumeName, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return "", errors.Wrapf(err, "csi: failed to retain pv %s", pvc.Spec.VolumeName)
+	}
+
+	p.deletePVC(pvc.Namespace, pvc.Name)
+	return pvc.Spec.VolumeName, nil
+}
+
+// releaseRestoredPV deletes the PV of restored volume and returns it, once the PV is removed.
+// Volume is retained, so it can be used by the PV restored by velero with the same name.
+func (p *Plugin) releaseRestoredPV(volumeID string) (*v1.PersistentVolume, error) {
+	pv, err := p.getPV(volumeID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "csi: failed to get restored pv %s", volumeID)
+	}
+
+	if pv.Spec.CSI == nil {
+		return nil, errors.Errorf("csi: restored pv %s is not a CSI pv", volumeID)
+	}
+
+	if pv.Spec.PersistentVolumeReclaimPolicy != v1.PersistentVolumeReclaimRetain {
+		return nil, errors.Errorf("csi: restored pv %s is not retained", volumeID)
+	}
+
+	err = p.K8sClient.CoreV1().PersistentVolumes().Delete(context.TODO(), volumeID, metav1.DeleteOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return nil, errors.Wrapf(err, "csi: failed to delete restored pv %s", volumeID)
+	}
+
+	// wait for the pv to be removed, so that velero can create it
+	err = wait.PollImmediate(statusInterval, csiStatusTimeout, func() (bool, error) {
+		_, err := p.getPV(volumeID)
+		if k8serrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	})
+	if err == wait.ErrWaitTimeout {
+		return nil, errors.Errorf("csi: restored pv %s is not removed in %s", volumeID, csiStatusTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pv, nil
+}
+
+func (p *Plugin) doRestore(snapshotID string, port int) (string, error) {
+	pvname, schdname, bkpname, err := utils.GetInfoFromSnapshotID(snapshotID)
+	if err != nil {
+		return "", err
+	}
+
+	filename := p.cl.GenerateRemoteFileWithSchd(pvname, schdname, bkpname)
+	if filename == "" {
+		return "", errors.Errorf("csi: Error creating remote file name for restore")
+	}
+
+	bkpPVC, err := p.getBackupPVC(pvname, bkpname)
+	if err != nil {
+		return "", err
+	}
+
+	rPVC, err := p.buildRestorePVC(pvname, bkpname, bkpPVC)
+	if err != nil {
+		return "", err
+	}
+
+	if err := p.ensureNamespace(rPVC.Namespace); err != nil {
+		return "", err
+	}
+
+	rPVC, err = p.K8sClient.CoreV1().PersistentVolumeClaims(rPVC.Namespace).Create(context.TODO(), rPVC, metav1.CreateOptions{})
+	if err != nil {
+		return "", errors.Wrapf(err, "csi: failed to create pvc for volume %s", pvname)
+	}
+
+	if err := p.dataRestore(rPVC, filename, port); err != nil {
+		p.deletePVC(rPVC.Namespace, rPVC.Name)
+		p.Log.Errorf("csi: restore failed vol %s snap %s err: %v", pvname, bkpname, err)
+		return "", err
+	}
+
+	volumeID, err := p.retainVolume(rPVC)
+	if err != nil {
+		p.deletePVC(rPVC.Namespace, rPVC.Name)
+		return "", err
+	}
+
+	p.Log.Debugf("csi: restore done vol %s => %s bkp %s", pvname, volumeID, bkpname)
+	return volumeID, nil
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCheckRestoreSize(t *testing.T) {
+	blockMode := v1.PersistentVolumeBlock
+	fsMode := v1.PersistentVolumeFilesystem
+
+	tests := map[string]struct {
+		mode     *v1.PersistentVolumeMode
+		size     string
+		hasError bool
+	}{
+		"same size":              {mode: &fsMode, size: "1Gi"},
+		"block larger size":      {mode: &blockMode, size: "2Gi"},
+		"filesystem larger size": {mode: &fsMode, size: "2Gi", hasError: true},
+		"default mode larger":    {mode: nil, size: "2Gi", hasError: true},
+		"smaller size":           {mode: &blockMode, size: "512Mi", hasError: true},
+	}
+
+	for name, test := range tests {
+		pvc := &v1.PersistentVolumeClaim{
+			Spec: v1.PersistentVolumeClaimSpec{
+				VolumeMode: test.mode,
+				Resources: v1.ResourceRequirements{
+					Requests: v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Gi")},
+				},
+			},
+		}
+
+		err := checkRestoreSize("pv-1", pvc, resource.MustParse(test.size))
+		if (err != nil) != test.hasError {
+			t.Errorf("%s: unexpected error %v", name, err)
+		}
+	}
+}
+
+func TestSetVolumeID(t *testing.T) {
+	restored := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pvc-restored"},
+		Spec: v1.PersistentVolumeSpec{
+			Capacity:                      v1.ResourceList{v1.ResourceStorage: resource.MustParse("2Gi")},
+			PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimRetain,
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: "jiva.csi.openebs.io", VolumeHandle: "handle-2"},
+			},
+		},
+	}
+
+	p := &Plugin{
+		Log:       logrus.New(),
+		K8sClient: fake.NewSimpleClientset(restored),
+	}
+
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+		Spec: v1.PersistentVolumeSpec{
+			Capacity: v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Gi")},
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: "jiva.csi.openebs.io", VolumeHandle: "handle-1"},
+			},
+		},
+	}
+
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pv)
+	if err != nil {
+		t.Fatalf("failed to convert pv : %v", err)
+	}
+
+	res, err := p.SetVolumeID(&unstructured.Unstructured{Object: obj}, "pvc-restored")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	rpv := new(v1.PersistentVolume)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(res.UnstructuredContent(), rpv); err != nil {
+		t.Fatalf("failed to convert pv : %v", err)
+	}
+
+	if rpv.Name != "pvc-restored" || rpv.Spec.CSI.VolumeHandle != "handle-2" {
+		t.Errorf("got volume %s/%s, expected pvc-restored/handle-2", rpv.Name, rpv.Spec.CSI.VolumeHandle)
+	}
+
+	size := rpv.Spec.Capacity[v1.ResourceStorage]
+	if expected := resource.MustParse("2Gi"); size.Cmp(expected) != 0 {
+		t.Errorf("got capacity %s, expected %s", size.String(), expected.String())
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"strconv"
 
 	v1alpha1 "github.com/openebs/maya/pkg/apis/openebs.io/v1alpha1"
+	cloud "github.com/openebs/velero-plugin/pkg/clouduploader"
 	"github.com/pkg/errors"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -174,12 +175,12 @@ func (p *Plugin) getCVCAddr() (string, error) {
 	return "", nil
 }
 
-func (p *Plugin) sendBackupRequest(vol *Volume) (*v1alpha1.CStorBackup, error) {
+func (p *Plugin) sendBackupRequest(vol *Volume, cl *cloud.Conn, port int) (*v1alpha1.CStorBackup, error) {
 	var url string
 
 	scheduleName := p.getScheduleName(vol.backupName) // This will be backup/schedule name
 
-	serverAddr := p.cstorServerAddr + ":" + strconv.Itoa(CstorBackupPort)
+	serverAddr := p.cstorServerAddr + ":" + strconv.Itoa(port)
 
 	bkpSpec := &v1alpha1.CStorBackupSpec{
 		BackupName: scheduleName,
@@ -191,7 +192,8 @@ func (p *Plugin) sendBackupRequest(vol *Volume) (*v1alpha1.CStorBackup, error) {
 
 	bkp := &v1alpha1.CStorBackup{
 		ObjectMeta: metav1.ObjectMeta{
-			Namespace: vol.namespace,
+			Namespace:   vol.namespace,
+			Annotations: cl.RemoteAnnotations(),
 		},
 		Spec: *bkpSpec,
 	}
@@ -202,6 +204,10 @@ func (p *Plugin) sendBackupRequest(vol *Volume) (*v1alpha1.CStorBackup, error) {
 		url = p.mayaAddr + backupEndpoint
 	}
 
+	if vol.selectReplica && !p.local {
+		return p.sendReplicaBackupRequest(vol, bkp, url)
+	}
+
 	bkpData, err := json.Marshal(bkp)
 	if err != nil {
 		return nil, errors.Wrapf(err, "Error parsing json")
@@ -215,7 +221,60 @@ func (p *Plugin) sendBackupRequest(vol *Volume) (*v1alpha1.CStorBackup, error) {
 	return bkp, nil
 }
 
-func (p *Plugin) sendRestoreRequest(vol *Volume) (*v1alpha1.CStorRestore, error) {
+// sendReplicaBackupRequest sends the request to create the snapshot for the given backup, and
+// creates the backup resource to upload the snapshot from the healthiest replica. Server creates
+// the backup resource for the first healthy replica, so only the snapshot is requested from it.
+func (p *Plugin) sendReplicaBackupRequest(vol *Volume, bkp *v1alpha1.CStorBackup, url string) (*v1alpha1.CStorBackup, error) {
+	snapReq := bkp.DeepCopy()
+	snapReq.Spec.LocalSnap = true
+
+	snapData, err := json.Marshal(snapReq)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error parsing json")
+	}
+
+	if _, err = p.httpRestCall(url, "POST", snapData); err != nil {
+		return nil, errors.Wrapf(err, "Error calling REST api")
+	}
+
+	engine := p.getVolumeEngine(vol)
+
+	replicas, err := engine.listReplicas()
+	if err != nil {
+		return nil, err
+	}
+
+	prevSnap, err := engine.lastBackupSnap(bkp)
+	if err != nil {
+		return nil, err
+	}
+
+	src := selectHealthiestReplica(replicas, prevSnap)
+	if src == nil {
+		return nil, errors.Errorf("no healthy replica to backup volume=%s", vol.volname)
+	}
+
+	if prevSnap != "" && !contains(src.snapshots, prevSnap) {
+		p.Log.Warnf("Replica=%s doesn't have previous snapshot=%s, full backup of volume=%s will be taken",
+			src.name, prevSnap, vol.volname)
+		prevSnap = ""
+	}
+
+	bkp.Name = bkp.Spec.SnapName + "-" + bkp.Spec.VolumeName
+	bkp.Spec.PrevSnapName = prevSnap
+	bkp.Status = v1alpha1.BKPCStorStatusPending
+
+	if err := engine.createBackup(bkp, *src); err != nil {
+		return nil, err
+	}
+
+	p.Log.Infof("Backup of volume=%s will be taken from replica=%s", vol.volname, src.name)
+	return bkp, nil
+}
+
+// sendRestoreRequest sends the restore request for the given volume. Data server of the given
+// connection is used as restore source, connection is nil in case of local restore.
+func (p *Plugin) sendRestoreRequest(vol *Volume, cl *cloud.Conn) (*v1alpha1.CStorRestore, error) {
 	var url string
 
 	restoreSrc := p.cstorServerAddr + ":" + strconv.Itoa(CstorRestorePort)
@@ -226,7 +285,8 @@ func (p *Plugin) sendRestoreRequest(vol *Volume) (*v1alpha1.CStorRestore, error)
 
 	restore := &v1alpha1.CStorRestore{
 		ObjectMeta: metav1.ObjectMeta{
-			Namespace: p.namespace,
+			Namespace:   p.namespace,
+			Annotations: cl.RemoteAnnotations(),
 		},
 		Spec: v1alpha1.CStorRestoreSpec{
 			RestoreName:  vol.backupName,
@@ -257,7 +317,7 @@ func (p *Plugin) sendRestoreRequest(vol *Volume) (*v1alpha1.CStorRestore, error)
 	// if apiserver is having version <=1.8 then it will return empty response
 	ok, err := isEmptyRestResponse(data)
 	if !ok && err == nil {
-		err = p.updateVolCASInfo(data, vol.volname)
+		err = p.updateVolCASInfo(data, vol)
 		if err != nil {
 			err = errors.Wrapf(err, "Error parsing restore API response")
 		}
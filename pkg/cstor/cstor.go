@@ -21,9 +21,11 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	cloud "github.com/openebs/velero-plugin/pkg/clouduploader"
+	"github.com/openebs/velero-plugin/pkg/freeze"
 	"github.com/pkg/errors"
 
 	/* Due to dependency conflict, please ensure openebs
@@ -81,6 +83,19 @@ const (
 
 	// RestTimeOut config key for REST API timeout value
 	RestTimeOut = "restApiTimeout"
+
+	// ReplicaHealthPolicy config key for the action to take if replicas of volume are not healthy at backup
+	ReplicaHealthPolicy = "replicaHealthPolicy"
+
+	// ReplicaHealthPolicyWarn logs a warning and continue the backup, if replicas are not healthy
+	ReplicaHealthPolicyWarn = "warn"
+
+	// ReplicaHealthPolicyFail fails the backup, if replicas are not healthy
+	ReplicaHealthPolicyFail = "fail"
+
+	// ReplicaHealthPolicyHealthiest uploads the backup from the healthy replica having the previous
+	// backup snapshot and the most snapshots, backup fails only if none of the replica is healthy
+	ReplicaHealthPolicyHealthiest = "healthiest"
 )
 
 // Plugin defines snapshot plugin for CStor volume
@@ -141,6 +156,30 @@ type Plugin struct {
 
 	// restTimeout defines timeout for REST API calls
 	restTimeout time.Duration
+
+	// replicaHealthPolicy defines the action to take if replicas are not healthy at backup
+	replicaHealthPolicy string
+
+	// strictVolumeCheck fails the backup of OpenEBS PV which can't be snapshotted
+	strictVolumeCheck bool
+
+	// freezer freezes the application, for app-consistent snapshot
+	freezer *freeze.Freezer
+
+	// groups is the list of in-progress backup of consistency groups
+	groups map[string]*groupBackup
+
+	// groupLock protects groups and their members
+	groupLock sync.Mutex
+
+	// volumeLock protects volumes and snapshots
+	volumeLock sync.Mutex
+
+	// ports is the list of locks of data server ports
+	ports map[int]*sync.Mutex
+
+	// portLock protects ports
+	portLock sync.Mutex
 }
 
 // Snapshot describes snapshot object information
@@ -169,18 +208,39 @@ type Volume struct {
 	// namespace is volume claim's namespace
 	namespace string
 
+	// pvcName is volume claim's name
+	pvcName string
+
 	// backupName is snapshot name for given volume
 	backupName string
 
 	// backupStatus is backup progress status for given volume
 	backupStatus v1alpha1.CStorBackupStatus
 
+	// prevBackupName is the backup, current backup is incremental to
+	prevBackupName string
+
+	// sourceSnapshot is the existing local snapshot uploaded by the backup
+	sourceSnapshot string
+
+	// backupReplica is the replica used for backup
+	backupReplica string
+
+	// backupPoolUID is the uid of pool, having the replica used for backup
+	backupPoolUID string
+
+	// selectReplica is true if the backup is to be taken from the replica selected by the plugin
+	selectReplica bool
+
 	// restoreStatus is restore progress status for given volume
 	restoreStatus v1alpha1.CStorRestoreStatus
 
 	// size is volume size in string
 	size resource.Quantity
 
+	// restoreSize is the size requested for restore, volume is expanded to it once restore completes
+	restoreSize *resource.Quantity
+
 	// snapshotTag is cloud snapshot file identifier.. It will be same as volume name from backup
 	snapshotTag string
 
@@ -271,6 +331,12 @@ func (p *Plugin) Init(config map[string]string) error {
 	if p.snapshots == nil {
 		p.snapshots = make(map[string]*Snapshot)
 	}
+	if p.groups == nil {
+		p.groups = make(map[string]*groupBackup)
+	}
+	if p.ports == nil {
+		p.ports = make(map[int]*sync.Mutex)
+	}
 
 	// check for user-provided timeout values
 	if timeoutStr, ok := config[RestTimeOut]; ok {
@@ -285,6 +351,26 @@ func (p *Plugin) Init(config map[string]string) error {
 
 	p.Log.Infof("Setting restApiTimeout to %v", p.restTimeout)
 
+	p.freezer, err = freeze.NewFreezer(p.Log, conf, p.K8sClient, config)
+	if err != nil {
+		return err
+	}
+
+	p.replicaHealthPolicy = ReplicaHealthPolicyWarn
+	if policy, ok := config[ReplicaHealthPolicy]; ok {
+		switch policy {
+		case ReplicaHealthPolicyWarn, ReplicaHealthPolicyFail, ReplicaHealthPolicyHealthiest:
+			p.replicaHealthPolicy = policy
+		default:
+			return errors.Errorf("invalid replicaHealthPolicy=%s, valid values are %s, %s or %s", policy,
+				ReplicaHealthPolicyWarn, ReplicaHealthPolicyFail, ReplicaHealthPolicyHealthiest)
+		}
+	}
+
+	if strict, ok := config[velero.StrictVolumeCheck]; ok {
+		p.strictVolumeCheck = isTrue(strict)
+	}
+
 	if local, ok := config[LocalSnapshot]; ok && isTrue(local) {
 		p.local = true
 		return nil
@@ -303,8 +389,28 @@ func (p *Plugin) Init(config map[string]string) error {
 		p.autoSetTargetIP = isTrue(autoSetTargetIP)
 	}
 
-	p.cl = &cloud.Conn{Log: p.Log}
-	return p.cl.Init(config)
+	p.cl, err = p.newConn()
+	return err
+}
+
+// newConn return the cloud connection initialized using the plugin config
+func (p *Plugin) newConn() (*cloud.Conn, error) {
+	cl := &cloud.Conn{Log: p.Log}
+	if err := cl.Init(p.config); err != nil {
+		return nil, err
+	}
+
+	if secretName, ok := p.config[cloud.DataTLSSecret]; ok && secretName != "" {
+		secret, err := velero.GetSecret(p.K8sClient, secretName)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := cl.InitTLS(secret, p.config); err != nil {
+			return nil, errors.Wrapf(err, "failed to initialize TLS for data server")
+		}
+	}
+	return cl, nil
 }
 
 // SetOpenEBSAPIClient sets openebs client from openebs/apis
@@ -321,7 +427,6 @@ func (p *Plugin) SetOpenEBSAPIClient(c *rest.Config) error {
 
 // GetVolumeID return volume name for given PV
 func (p *Plugin) GetVolumeID(unstructuredPV runtime.Unstructured) (string, error) {
-	var isCSIVolume bool
 	pv := new(v1.PersistentVolume)
 
 	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(unstructuredPV.UnstructuredContent(), pv); err != nil {
@@ -329,22 +434,20 @@ func (p *Plugin) GetVolumeID(unstructuredPV runtime.Unstructured) (string, error
 	}
 
 	// If PV doesn't have sufficient info to consider as CStor Volume
-	// then we will return empty volumeId and error as nil.
-	if pv.Name == "" ||
-		pv.Spec.StorageClassName == "" ||
-		(pv.Spec.ClaimRef != nil && pv.Spec.ClaimRef.Namespace == "") {
-		return "", nil
+	// then we will return empty volumeId and error as nil, unless strict check is enabled.
+	if reason := velero.MissingPVInfo(pv); reason != "" {
+		return "", velero.SkipVolume(p.Log, pv, reason, p.strictVolumeCheck)
 	}
 
 	volType, ok := pv.Labels[openebsVolumeLabel]
 	if ok {
 		if volType != casTypeCStor {
-			return "", nil
+			return "", velero.SkipVolume(p.Log, pv, velero.SkipOtherEngine, p.strictVolumeCheck)
 		}
 	} else {
 		// check if PV is created by CSI driver
-		if isCSIVolume = isCSIPv(*pv); !isCSIVolume {
-			return "", nil
+		if !isCSIPv(*pv) {
+			return "", velero.SkipVolume(p.Log, pv, velero.SkipOtherEngine, p.strictVolumeCheck)
 		}
 	}
 
@@ -353,23 +456,17 @@ func (p *Plugin) GetVolumeID(unstructuredPV runtime.Unstructured) (string, error
 		return "", errors.New("pv is in released state")
 	}
 
+	p.volumeLock.Lock()
 	if _, exists := p.volumes[pv.Name]; !exists {
-		p.volumes[pv.Name] = &Volume{
-			volname:      pv.Name,
-			snapshotTag:  pv.Name,
-			storageClass: pv.Spec.StorageClassName,
-			namespace:    pv.Spec.ClaimRef.Namespace,
-			size:         pv.Spec.Capacity[v1.ResourceStorage],
-			isCSIVolume:  isCSIVolume,
-		}
+		p.volumes[pv.Name] = newVolume(pv)
 	}
+	p.volumeLock.Unlock()
 
 	return pv.Name, nil
 }
 
 // DeleteSnapshot delete CStor volume snapshot
 func (p *Plugin) DeleteSnapshot(snapshotID string) error {
-	var snapInfo *Snapshot
 	var err error
 
 	if snapshotID == "" {
@@ -378,14 +475,20 @@ func (p *Plugin) DeleteSnapshot(snapshotID string) error {
 	}
 
 	p.Log.Infof("Deleting snapshot %v", snapshotID)
-	if _, exists := p.snapshots[snapshotID]; !exists {
+
+	p.volumeLock.Lock()
+	snapInfo, exists := p.snapshots[snapshotID]
+	p.volumeLock.Unlock()
+
+	if !exists {
 		snapInfo, err = p.getSnapInfo(snapshotID)
 		if err != nil {
 			return err
 		}
+
+		p.volumeLock.Lock()
 		p.snapshots[snapshotID] = snapInfo
-	} else {
-		snapInfo = p.snapshots[snapshotID]
+		p.volumeLock.Unlock()
 	}
 
 	scheduleName := p.getScheduleName(snapInfo.backupName)
@@ -398,12 +501,25 @@ func (p *Plugin) DeleteSnapshot(snapshotID string) error {
 			scheduleName)
 	}
 
-	err = p.sendDeleteRequest(snapInfo.backupName,
-		snapInfo.volID,
-		snapInfo.namespace,
-		scheduleName, snapInfo.isCSIVolume)
-	if err != nil {
-		return errors.Wrapf(err, "failed to execute maya-apiserver DELETE API")
+	var filename string
+	if !p.local {
+		filename = p.cl.GenerateRemoteFilename(snapInfo.volID, snapInfo.backupName)
+		if filename == "" {
+			return errors.Errorf("Error creating remote file name for backup")
+		}
+	}
+
+	if p.isOffloadedSnapshot(filename) {
+		// local snapshot belongs to the source backup, it is deleted with the source backup
+		p.Log.Infof("Snapshot %v is uploaded from local snapshot, skipping delete of local snapshot", snapshotID)
+	} else {
+		err = p.sendDeleteRequest(snapInfo.backupName,
+			snapInfo.volID,
+			snapInfo.namespace,
+			scheduleName, snapInfo.isCSIVolume)
+		if err != nil {
+			return errors.Wrapf(err, "failed to execute maya-apiserver DELETE API")
+		}
 	}
 
 	if p.local {
@@ -411,54 +527,83 @@ func (p *Plugin) DeleteSnapshot(snapshotID string) error {
 		return nil
 	}
 
-	filename := p.cl.GenerateRemoteFilename(snapInfo.volID, snapInfo.backupName)
-	if filename == "" {
-		return errors.Errorf("Error creating remote file name for backup")
-	}
-
 	ret := p.cl.Delete(filename)
 	if !ret {
 		return errors.New("failed to remove snapshot")
 	}
 
+	if err := p.cl.DeleteManifest(filename); err != nil {
+		p.Log.Warnf("Failed to remove manifest of snapshot=%s : %s", filename, err.Error())
+	}
+
 	return nil
 }
 
 // CreateSnapshot creates snapshot for CStor volume and upload it to cloud storage
 func (p *Plugin) CreateSnapshot(volumeID, volumeAZ string, tags map[string]string) (string, error) {
-	if !p.local {
-		p.cl.ExitServer = false
-	}
-
 	bkpname, ok := tags["velero.io/backup"]
 	if !ok {
 		return "", errors.New("failed to get backup name")
 	}
 
-	vol, ok := p.volumes[volumeID]
-	if !ok {
-		return "", errors.New("volume not found")
+	vol, err := p.getVolume(volumeID)
+	if err != nil {
+		return "", err
 	}
 	vol.backupName = bkpname
-	size, ok := vol.size.AsInt64()
-	if !ok {
-		return "", errors.Errorf("Failed to parse volume size %v", vol.size)
+
+	if !p.local {
+		if source := p.getOffloadSource(bkpname); source != "" {
+			return p.offloadSnapshot(vol, source)
+		}
+	}
+
+	group, err := p.getConsistencyGroup(vol)
+	if err != nil {
+		return "", err
+	}
+
+	if group != "" {
+		return p.createGroupSnapshot(vol, group)
+	}
+
+	if err := p.checkReplicaHealth(vol); err != nil {
+		return "", err
 	}
 
+	var cl *cloud.Conn
 	if !p.local {
-		// If cloud snapshot is configured then we need to backup PVC also
-		err := p.backupPVC(volumeID)
-		if err != nil {
-			return "", errors.Wrapf(err, "failed to create backup for PVC")
+		// each upload uses its own connection, as velero may back up the volumes in parallel
+		if cl, err = p.newConn(); err != nil {
+			return "", err
 		}
+
+		if err := cl.GenerateTransferToken(); err != nil {
+			return "", err
+		}
+
+		// data server port is used till the upload completes
+		unlock := p.lockPort(CstorBackupPort)
+		defer unlock()
 	}
 
 	p.Log.Infof("creating snapshot{%s}", bkpname)
 
-	bkp, err := p.sendBackupRequest(vol)
+	thaw, err := p.freezer.Freeze(vol.namespace, vol.pvcName)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to freeze application")
+	}
+
+	// snapshot is created by the backup request, application can be thawed after it
+	bkp, err := p.sendBackupRequest(vol, cl, CstorBackupPort)
+	thawErr := thaw()
 	if err != nil {
 		return "", errors.Wrapf(err, "Failed to send backup request")
 	}
+	if thawErr != nil {
+		p.discardSnapshot(vol)
+		return "", thawErr
+	}
 
 	p.Log.Infof("Snapshot Successfully Created")
 
@@ -467,20 +612,58 @@ func (p *Plugin) CreateSnapshot(volumeID, volumeAZ string, tags map[string]strin
 		return generateSnapshotID(volumeID, bkpname), nil
 	}
 
-	filename := p.cl.GenerateRemoteFilename(vol.snapshotTag, vol.backupName)
+	return p.uploadSnapshot(vol, bkp, cl, CstorBackupPort, time.Now().UTC(), "")
+}
+
+// discardSnapshot deletes the snapshot, created by the backup, which can't be used as it is not app-consistent
+func (p *Plugin) discardSnapshot(vol *Volume) {
+	err := p.sendDeleteRequest(vol.backupName, vol.volname, vol.namespace, p.getScheduleName(vol.backupName), vol.isCSIVolume)
+	if err != nil {
+		p.Log.Warnf("Failed to delete snapshot=%s of volume=%s : %s", vol.backupName, vol.volname, err.Error())
+	}
+}
+
+// uploadSnapshot uploads the snapshot, created by the given backup request, to cloud storage
+// using the given connection and port. snapTime and group are recorded in the snapshot manifest.
+func (p *Plugin) uploadSnapshot(vol *Volume, bkp *v1alpha1.CStorBackup, cl *cloud.Conn, port int, snapTime time.Time, group string) (string, error) {
+	size, ok := vol.size.AsInt64()
+	if !ok {
+		return "", errors.Errorf("Failed to parse volume size %v", vol.size)
+	}
+
+	filename := cl.GenerateRemoteFilename(vol.snapshotTag, vol.backupName)
 	if filename == "" {
 		return "", errors.Errorf("Error creating remote file name for backup")
 	}
 
-	go p.checkBackupStatus(bkp, vol.isCSIVolume)
+	// status of volume is updated by checkBackupStatus, till done is closed
+	done := make(chan struct{})
+	go p.checkBackupStatus(bkp, vol, cl, done)
 
-	ok = p.cl.Upload(filename, size, CstorBackupPort)
+	ok = cl.Upload(filename, size, port)
 	if !ok {
 		return "", errors.New("failed to upload snapshot")
 	}
 
+	<-done
+
 	if vol.backupStatus == v1alpha1.BKPCStorStatusDone {
-		return generateSnapshotID(volumeID, bkpname), nil
+		vol.backupReplica = p.getBackupReplica(vol)
+		p.Log.Infof("Snapshot=%s of volume=%s uploaded from replica=%s", vol.backupName, vol.volname, vol.backupReplica)
+
+		// record the parent backup to build the restore chain
+		if err := cl.WriteManifest(filename, &cloud.SnapshotManifest{
+			Backup:    vol.backupName,
+			Parent:    vol.prevBackupName,
+			Timestamp: snapTime,
+			Replica:   vol.backupReplica,
+			Group:     group,
+			Source:    vol.sourceSnapshot,
+			Chain:     p.getScheduleName(vol.backupName),
+		}); err != nil {
+			return "", err
+		}
+		return generateSnapshotID(vol.volname, vol.backupName), nil
 	}
 
 	return "", errors.Errorf("Failed to upload snapshot, status:{%v}", vol.backupStatus)
@@ -559,6 +742,9 @@ func (p *Plugin) CreateVolumeFromSnapshot(snapshotID, volumeType, volumeAZ strin
 	}
 
 	if newVol.restoreStatus == v1alpha1.RSTCStorStatusDone {
+		// restored volume is used by SetVolumeID
+		p.storeVolume(newVol)
+
 		if p.autoSetTargetIP {
 			if err := p.markCVRsAsRestoreCompleted(newVol); err != nil {
 				readmeUrl := "https://github.com/openebs/velero-plugin#setting-targetip-in-replica"
@@ -570,6 +756,17 @@ func (p *Plugin) CreateVolumeFromSnapshot(snapshotID, volumeType, volumeAZ strin
 			}
 		}
 
+		// remote restore without autoSetTargetIP becomes ready once target IP is set manually
+		if p.local || p.autoSetTargetIP {
+			if err := p.waitForVolumeReady(newVol); err != nil {
+				return newVol.volname, err
+			}
+		}
+
+		if err := p.expandPVC(newVol); err != nil {
+			return newVol.volname, err
+		}
+
 		p.Log.Infof("Restore completed for CStor volume:%s snapshot:%s", volumeID, snapName)
 		return newVol.volname, nil
 	}
@@ -590,7 +787,10 @@ func (p *Plugin) SetVolumeID(unstructuredPV runtime.Unstructured, volumeID strin
 		return nil, errors.WithStack(err)
 	}
 
-	vol := p.volumes[volumeID]
+	vol, err := p.getRestoredVolume(volumeID, pv)
+	if err != nil {
+		return nil, err
+	}
 
 	if p.local {
 		if !vol.isCSIVolume {
@@ -615,8 +815,26 @@ func (p *Plugin) SetVolumeID(unstructuredPV runtime.Unstructured, volumeID strin
 }
 
 // getScheduleName return the schedule name for the given backup
-// It will check if backup name have 'bkp-20060102150405' format
+// Schedule name is fetched from the velero backup. If backup chain is configured
+// for the backup, then chain name is returned. For non-scheduled backup, backup name is returned.
+// If velero backup can't be fetched then it will check if backup name have 'bkp-20060102150405' format
 func (p *Plugin) getScheduleName(backupName string) string {
+	bkp, err := velero.GetBackup(backupName)
+	if err == nil {
+		if chain := velero.BackupChain(bkp); chain != "" {
+			return chain
+		}
+
+		if schedule := velero.BackupSchedule(bkp); schedule != "" {
+			return schedule
+		}
+
+		// for non-scheduled backup, we are considering backup name as schedule name only
+		return backupName
+	}
+
+	p.Log.Warnf("Failed to get backup=%s, using backup name for schedule : %s", backupName, err.Error())
+
 	// for non-scheduled backup, we are considering backup name as schedule name only
 	scheduleOrBackupName := backupName
 
@@ -0,0 +1,471 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cstorv1 "github.com/openebs/api/v2/pkg/apis/cstor/v1"
+	"github.com/openebs/maya/pkg/apis/openebs.io/v1alpha1"
+	cloud "github.com/openebs/velero-plugin/pkg/clouduploader"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func newTestPlugin() *Plugin {
+	return &Plugin{
+		Log:         logrus.New(),
+		volumes:     make(map[string]*Volume),
+		snapshots:   make(map[string]*Snapshot),
+		groups:      make(map[string]*groupBackup),
+		ports:       make(map[int]*sync.Mutex),
+		restTimeout: 10 * time.Second,
+	}
+}
+
+func newTestPV(t *testing.T, name string) runtime.Unstructured {
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{openebsVolumeLabel: casTypeCStor},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			StorageClassName: "cstor-sc",
+			Capacity:         v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Gi")},
+			ClaimRef:         &v1.ObjectReference{Namespace: "app", Name: "pvc-" + name},
+		},
+	}
+
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pv)
+	if err != nil {
+		t.Fatalf("failed to convert pv %s : %v", name, err)
+	}
+	return &unstructured.Unstructured{Object: obj}
+}
+
+// TestVolumeStateConcurrent checks that operations on the same volume don't share the volume state
+func TestVolumeStateConcurrent(t *testing.T) {
+	p := newTestPlugin()
+
+	var pvs []runtime.Unstructured
+	for i := 0; i < 4; i++ {
+		pvs = append(pvs, newTestPV(t, fmt.Sprintf("pv-%d", i)))
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			volumeID := fmt.Sprintf("pv-%d", i%4)
+			if _, err := p.GetVolumeID(pvs[i%4]); err != nil {
+				t.Errorf("GetVolumeID failed for %s : %v", volumeID, err)
+				return
+			}
+
+			vol, ok := p.lookupVolume(volumeID)
+			if !ok {
+				t.Errorf("volume %s not found", volumeID)
+				return
+			}
+
+			// per-operation state
+			vol.backupName = fmt.Sprintf("bkp-%d", i)
+			vol.backupStatus = v1alpha1.BKPCStorStatusInProgress
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 4; i++ {
+		volumeID := fmt.Sprintf("pv-%d", i)
+		vol, ok := p.lookupVolume(volumeID)
+		if !ok {
+			t.Fatalf("volume %s not found", volumeID)
+		}
+		if vol.backupName != "" || vol.backupStatus != "" {
+			t.Errorf("state of volume %s is updated by the operation, backup=%s status=%s",
+				volumeID, vol.backupName, vol.backupStatus)
+		}
+		if vol.namespace != "app" || vol.pvcName != "pvc-"+volumeID {
+			t.Errorf("invalid claim of volume %s : %s/%s", volumeID, vol.namespace, vol.pvcName)
+		}
+	}
+}
+
+// TestOverlappingStatusCheck runs the status check of backups and restores in parallel
+func TestOverlappingStatusCheck(t *testing.T) {
+	var requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+
+		switch {
+		case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, backupEndpoint):
+			var bkp v1alpha1.CStorBackup
+
+			data, _ := ioutil.ReadAll(r.Body)
+			if err := json.Unmarshal(data, &bkp); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			bkp.Status = v1alpha1.BKPCStorStatusDone
+			bkp.Spec.PrevSnapName = "prev-" + bkp.Spec.SnapName
+			_ = json.NewEncoder(w).Encode(bkp)
+		case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, restorePath):
+			_ = json.NewEncoder(w).Encode(v1alpha1.RSTCStorStatusDone)
+		}
+	}))
+	defer server.Close()
+
+	p := newTestPlugin()
+	p.mayaAddr = server.URL
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		volumeID := fmt.Sprintf("pv-%d", i)
+		if _, err := p.GetVolumeID(newTestPV(t, volumeID)); err != nil {
+			t.Fatalf("GetVolumeID failed for %s : %v", volumeID, err)
+		}
+
+		wg.Add(2)
+
+		// backup of the volume
+		go func(volumeID string) {
+			defer wg.Done()
+
+			vol, err := p.getVolume(volumeID)
+			if err != nil {
+				t.Errorf("failed to get volume %s : %v", volumeID, err)
+				return
+			}
+			vol.backupName = "bkp-" + volumeID
+
+			bkp := &v1alpha1.CStorBackup{
+				Spec: v1alpha1.CStorBackupSpec{
+					BackupName: vol.backupName,
+					SnapName:   vol.backupName,
+					VolumeName: vol.volname,
+				},
+			}
+
+			cl := &cloud.Conn{Log: p.Log}
+			done := make(chan struct{})
+			go p.checkBackupStatus(bkp, vol, cl, done)
+			<-done
+
+			if vol.backupStatus != v1alpha1.BKPCStorStatusDone {
+				t.Errorf("invalid backup status of volume %s : %s", volumeID, vol.backupStatus)
+			}
+			if vol.prevBackupName != "prev-"+vol.backupName {
+				t.Errorf("invalid previous backup of volume %s : %s", volumeID, vol.prevBackupName)
+			}
+		}(volumeID)
+
+		// restore of the volume, from other backup
+		go func(volumeID string) {
+			defer wg.Done()
+
+			vol := &Volume{
+				volname:    "restored-" + volumeID,
+				backupName: "bkp-" + volumeID,
+			}
+
+			cl := &cloud.Conn{Log: p.Log}
+			done := make(chan struct{})
+			go p.checkRestoreStatus(&v1alpha1.CStorRestore{}, vol, cl, done)
+			<-done
+
+			if vol.restoreStatus != v1alpha1.RSTCStorStatusDone {
+				t.Errorf("invalid restore status of volume %s : %s", vol.volname, vol.restoreStatus)
+				return
+			}
+			p.storeVolume(vol)
+		}(volumeID)
+	}
+	wg.Wait()
+
+	for i := 0; i < 8; i++ {
+		volumeID := fmt.Sprintf("pv-%d", i)
+		if vol, ok := p.lookupVolume(volumeID); !ok || vol.backupStatus != "" {
+			t.Errorf("state of volume %s is updated by the backup", volumeID)
+		}
+		if _, ok := p.lookupVolume("restored-" + volumeID); !ok {
+			t.Errorf("restored volume of %s not found", volumeID)
+		}
+	}
+
+	if atomic.LoadInt32(&requests) == 0 {
+		t.Errorf("status is not fetched from the server")
+	}
+}
+
+// TestLockPort checks that a data server port is used by one operation at a time
+func TestLockPort(t *testing.T) {
+	p := newTestPlugin()
+
+	var (
+		wg     sync.WaitGroup
+		users  [2]int32
+		shared int32
+	)
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			port := CstorBackupPort + i%2
+			unlock := p.lockPort(port)
+			defer unlock()
+
+			if n := atomic.AddInt32(&users[i%2], 1); n != 1 {
+				atomic.StoreInt32(&shared, 1)
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&users[i%2], -1)
+		}(i)
+	}
+	wg.Wait()
+
+	if atomic.LoadInt32(&shared) != 0 {
+		t.Errorf("port is used by multiple operations")
+	}
+}
+
+func TestSelectHealthiestReplica(t *testing.T) {
+	online := string(cstorv1.CVRStatusOnline)
+	degraded := string(cstorv1.CVRStatusDegraded)
+
+	tests := map[string]struct {
+		replicas []replica
+		prevSnap string
+		expected string
+	}{
+		"no replica": {
+			expected: "",
+		},
+		"no healthy replica": {
+			replicas: []replica{
+				{name: "cvr-1", phase: degraded, snapshots: []string{"s1"}},
+				{name: "cvr-2", phase: string(cstorv1.CVRStatusOffline)},
+			},
+			expected: "",
+		},
+		"healthy replica": {
+			replicas: []replica{
+				{name: "cvr-1", phase: degraded, snapshots: []string{"s1", "s2"}},
+				{name: "cvr-2", phase: online, snapshots: []string{"s1"}},
+			},
+			expected: "cvr-2",
+		},
+		"most snapshots": {
+			replicas: []replica{
+				{name: "cvr-1", phase: online, snapshots: []string{"s1"}},
+				{name: "cvr-2", phase: online, snapshots: []string{"s1", "s2"}},
+				{name: "cvr-3", phase: degraded, snapshots: []string{"s1", "s2", "s3"}},
+			},
+			expected: "cvr-2",
+		},
+		"previous snapshot": {
+			replicas: []replica{
+				{name: "cvr-1", phase: online, snapshots: []string{"s1", "s3"}},
+				{name: "cvr-2", phase: online, snapshots: []string{"s2"}},
+				{name: "cvr-3", phase: online, snapshots: []string{"s1", "s4"}},
+			},
+			prevSnap: "s2",
+			expected: "cvr-2",
+		},
+		"previous snapshot not found": {
+			replicas: []replica{
+				{name: "cvr-2", phase: online, snapshots: []string{"s1"}},
+				{name: "cvr-1", phase: online, snapshots: []string{"s3"}},
+			},
+			prevSnap: "s2",
+			expected: "cvr-1",
+		},
+	}
+
+	for name, test := range tests {
+		var got string
+		if r := selectHealthiestReplica(test.replicas, test.prevSnap); r != nil {
+			got = r.name
+		}
+		if got != test.expected {
+			t.Errorf("%s: selected replica %q, expected %q", name, got, test.expected)
+		}
+	}
+}
+
+func newTestGroupMembers(names ...string) map[string]*groupMember {
+	members := map[string]*groupMember{}
+	for _, name := range names {
+		m := &groupMember{
+			vol:        &Volume{volname: name},
+			done:       make(chan struct{}),
+			snapshotID: name + "-snap",
+		}
+		close(m.done)
+		members[name] = m
+	}
+	return members
+}
+
+// TestGroupBackupMembers checks the bookkeeping of members of consistency group backup
+func TestGroupBackupMembers(t *testing.T) {
+	p := newTestPlugin()
+
+	var starts int32
+	release := make(chan struct{})
+	start := func() (map[string]*groupMember, error) {
+		atomic.AddInt32(&starts, 1)
+		<-release
+		return newTestGroupMembers("pv-1", "pv-2", "pv-3"), nil
+	}
+
+	var (
+		wg      sync.WaitGroup
+		started int32
+	)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(volname string) {
+			defer wg.Done()
+
+			g, ok := p.getGroupBackup("bkp/app/group", start)
+			if ok {
+				atomic.AddInt32(&started, 1)
+			}
+
+			m, ok := p.claimGroupMember("bkp/app/group", g, volname)
+			if !ok || m.snapshotID != volname+"-snap" {
+				t.Errorf("member %s of group not found", volname)
+			}
+		}(fmt.Sprintf("pv-%d", i+1))
+	}
+
+	// groupLock is not held while the group is being started
+	for atomic.LoadInt32(&starts) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	other, _ := p.getGroupBackup("bkp/app/other", func() (map[string]*groupMember, error) {
+		return newTestGroupMembers("pv-4"), nil
+	})
+	close(release)
+	wg.Wait()
+
+	if starts != 1 || started != 1 {
+		t.Errorf("group started %d times, by %d requests", starts, started)
+	}
+
+	p.groupLock.Lock()
+	_, ok := p.groups["bkp/app/group"]
+	p.groupLock.Unlock()
+	if ok {
+		t.Errorf("group is not removed once all the members are claimed")
+	}
+
+	// unclaimed members are dropped when the backup finishes
+	p.releaseGroup("bkp/app/other", other)
+	if _, ok := p.claimGroupMember("bkp/app/other", other, "pv-4"); ok {
+		t.Errorf("unclaimed member is not dropped")
+	}
+	if len(p.groups) != 0 {
+		t.Errorf("groups %v are not removed", p.groups)
+	}
+
+	// failed group is started again by the next request
+	g, ok := p.getGroupBackup("bkp/app/failed", func() (map[string]*groupMember, error) {
+		return nil, errors.New("failed to create snapshot")
+	})
+	if !ok || g.err == nil {
+		t.Errorf("error of group is not returned")
+	}
+	if g, ok = p.getGroupBackup("bkp/app/failed", func() (map[string]*groupMember, error) {
+		return newTestGroupMembers("pv-5"), nil
+	}); !ok || g.err != nil {
+		t.Errorf("failed group is not started again, err=%v", g.err)
+	}
+}
+
+// fakeEngine is the volumeEngine having the given volume state
+type fakeEngine struct {
+	volumeEngine
+	volPhase string
+	replicas []replica
+}
+
+func (e *fakeEngine) replicationFactor() (int, error) { return 3, nil }
+
+func (e *fakeEngine) phase() (string, error) { return e.volPhase, nil }
+
+func (e *fakeEngine) listReplicas() ([]replica, error) { return e.replicas, nil }
+
+func TestIsVolumeReady(t *testing.T) {
+	online := string(cstorv1.CVRStatusOnline)
+	healthy := []replica{
+		{name: "cvr-1", phase: online, targetIP: "10.0.0.1"},
+		{name: "cvr-2", phase: online, targetIP: "10.0.0.1"},
+		{name: "cvr-3", phase: online, targetIP: "10.0.0.1"},
+	}
+	noTargetIP := []replica{
+		{name: "cvr-1", phase: online},
+		{name: "cvr-2", phase: online},
+		{name: "cvr-3", phase: online},
+	}
+
+	tests := map[string]struct {
+		volPhase        string
+		replicas        []replica
+		autoSetTargetIP bool
+		ready           bool
+	}{
+		"healthy":                        {cStorVolumeHealthy, healthy, true, true},
+		"volume offline":                 {"Offline", healthy, true, false},
+		"missing replica":                {cStorVolumeHealthy, healthy[:2], true, false},
+		"degraded replica":               {cStorVolumeHealthy, append(healthy[:2:2], replica{name: "cvr-3", phase: "Degraded", targetIP: "10.0.0.1"}), true, false},
+		"no target IP with autoSetIP":    {cStorVolumeHealthy, noTargetIP, true, false},
+		"no target IP without autoSetIP": {cStorVolumeHealthy, noTargetIP, false, true},
+	}
+
+	for name, test := range tests {
+		p := newTestPlugin()
+		p.autoSetTargetIP = test.autoSetTargetIP
+
+		ready, err := p.isVolumeReady(&fakeEngine{volPhase: test.volPhase, replicas: test.replicas}, &Volume{volname: "pvc-1"})
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", name, err)
+		}
+		if ready != test.ready {
+			t.Errorf("%s: isVolumeReady=%v, expected %v", name, ready, test.ready)
+		}
+	}
+}
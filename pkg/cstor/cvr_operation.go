@@ -17,19 +17,22 @@ limitations under the License.
 package cstor
 
 import (
-	"context"
 	"fmt"
 	"strings"
 	"time"
 
 	cstorv1 "github.com/openebs/api/v2/pkg/apis/cstor/v1"
 	"github.com/pkg/errors"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
 )
 
 const (
 	cVRPVLabel                 = "openebs.io/persistent-volume"
+	cStorPoolUIDLabel          = "cstorpool.openebs.io/uid"
 	restoreCompletedAnnotation = "openebs.io/restore-completed"
+
+	// cStorVolumeHealthy is the phase of CStorVolume having quorum of healthy replicas
+	cStorVolumeHealthy = "Healthy"
 )
 
 var validCvrStatuses = []string{
@@ -44,114 +47,56 @@ var CVRWaitCount = 100
 // CVRCheckInterval defines amount of delay for CVR check
 var CVRCheckInterval = 5 * time.Second
 
+// VolumeReadyTimeout defines time limit for the restored volume to be ready
+var VolumeReadyTimeout = 10 * time.Minute
+
 // waitForAllCVRs will ensure that all CVR related to
 // the given volume is created
 func (p *Plugin) waitForAllCVRs(vol *Volume) error {
-	return p.waitForAllCVRsToBeInValidStatus(vol, validCvrStatuses)
-}
+	engine := p.getVolumeEngine(vol)
 
-func (p *Plugin) waitForAllCVRsToBeInValidStatus(vol *Volume, statuses []string) error {
-	replicaCount := p.getCVRCount(vol.volname, vol.isCSIVolume)
-	if replicaCount == -1 {
+	replicaCount, err := engine.replicationFactor()
+	if err != nil {
+		p.Log.Errorf("Failed to fetch replicaCount for volume{%s} : %s", vol.volname, err)
 		return errors.Errorf("Failed to fetch replicaCount for volume{%s}", vol.volname)
 	}
 
-	if vol.isCSIVolume {
-		return p.waitForCSIBasedCVRs(vol, replicaCount, statuses)
-	}
-	return p.waitFoNonCSIBasedCVRs(vol, replicaCount, statuses)
-}
-
-// waitFoNonCSIBasedCVRs will ensure that all CVRs related to
-// given non CSI based volume is created
-func (p *Plugin) waitFoNonCSIBasedCVRs(vol *Volume, replicaCount int, statuses []string) error {
-	for cnt := 0; cnt < CVRWaitCount; cnt++ {
-		cvrList, err := p.OpenEBSClient.
-			OpenebsV1alpha1().
-			CStorVolumeReplicas(p.namespace).
-			List(context.TODO(), metav1.ListOptions{
-				LabelSelector: cVRPVLabel + "=" + vol.volname,
-			})
-		if err != nil {
-			return errors.Errorf("Failed to fetch CVR for volume=%s %s", vol.volname, err)
-		}
-		if len(cvrList.Items) != replicaCount {
-			time.Sleep(CVRCheckInterval)
-			continue
+	err = waitForVolume(time.Duration(CVRWaitCount)*CVRCheckInterval, func() (bool, error) {
+		replicas, err := engine.listReplicas()
+		if err != nil || len(replicas) != replicaCount {
+			return false, err
 		}
-		cvrCount := 0
-		for _, cvr := range cvrList.Items {
-			if contains(statuses, string(cvr.Status.Phase)) {
-				cvrCount++
+
+		for _, r := range replicas {
+			if !contains(validCvrStatuses, r.phase) {
+				return false, nil
 			}
 		}
-		if cvrCount == replicaCount {
-			return nil
-		}
-		time.Sleep(CVRCheckInterval)
+		return true, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return errors.Errorf("CVR for volume{%s} are not ready!", vol.volname)
 	}
-	return errors.Errorf("CVR for volume{%s} are not ready!", vol.volname)
+	return err
 }
 
-// waitForCSIBasedCVRs will ensure that all CVRs related to
-// the given CSI volume is created.
-func (p *Plugin) waitForCSIBasedCVRs(vol *Volume, replicaCount int, statuses []string) error {
-	for cnt := 0; cnt < CVRWaitCount; cnt++ {
-		cvrList, err := p.OpenEBSAPIsClient.
-			CstorV1().
-			CStorVolumeReplicas(p.namespace).
-			List(context.TODO(), metav1.ListOptions{
-				LabelSelector: cVRPVLabel + "=" + vol.volname,
-			})
-		if err != nil {
-			return errors.Errorf("Failed to fetch CVR for volume=%s %s", vol.volname, err)
-		}
-
-		if len(cvrList.Items) != replicaCount {
-			time.Sleep(CVRCheckInterval)
-			continue
-		}
+// waitForVolumeReady waits till the restored volume is ready for IO, upto VolumeReadyTimeout
+func (p *Plugin) waitForVolumeReady(vol *Volume) error {
+	p.Log.Infof("Waiting for volume{%s} to be ready", vol.volname)
 
-		cvrCount := 0
-		for _, cvr := range cvrList.Items {
-			if contains(statuses, string(cvr.Status.Phase)) {
-				cvrCount++
-			}
-		}
-		if cvrCount == replicaCount {
-			return nil
-		}
-		time.Sleep(CVRCheckInterval)
+	engine := p.getVolumeEngine(vol)
+	err := waitForVolume(VolumeReadyTimeout, func() (bool, error) {
+		return p.isVolumeReady(engine, vol)
+	})
+	if err == wait.ErrWaitTimeout {
+		return errors.Errorf("volume{%s} is not ready in %v", vol.volname, VolumeReadyTimeout)
 	}
-	return errors.Errorf("CVR for volume{%s} are not ready!", vol.volname)
+	return err
 }
 
-// getCVRCount returns the number of CVR for a given volume
-func (p *Plugin) getCVRCount(volname string, isCSIVolume bool) int {
-	// For CSI based volume, CVR of v1 is used.
-	if isCSIVolume {
-		// If the volume is CSI based, then CVR V1 is used.
-		obj, err := p.OpenEBSAPIsClient.
-			CstorV1().
-			CStorVolumes(p.namespace).
-			Get(context.TODO(), volname, metav1.GetOptions{})
-		if err != nil {
-			p.Log.Errorf("Failed to fetch cstorVolume.. %s", err)
-			return -1
-		}
-
-		return obj.Spec.ReplicationFactor
-	}
-	// For non CSI based volume, CVR of v1alpha1 is used.
-	obj, err := p.OpenEBSClient.
-		OpenebsV1alpha1().
-		CStorVolumes(p.namespace).
-		Get(context.TODO(), volname, metav1.GetOptions{})
-	if err != nil {
-		p.Log.Errorf("Failed to fetch cstorVolume.. %s", err)
-		return -1
-	}
-	return obj.Spec.ReplicationFactor
+// waitForVolume checks the given condition of volume, every CVRCheckInterval, till it is met or timeout
+func waitForVolume(timeout time.Duration, cond func() (bool, error)) error {
+	return wait.PollImmediate(CVRCheckInterval, timeout, cond)
 }
 
 // markCVRsAsRestoreCompleted annotate relevant CVR with restoreCompletedAnnotation
@@ -164,7 +109,7 @@ func (p *Plugin) markCVRsAsRestoreCompleted(vol *Volume) error {
 	}
 
 	p.Log.Infof("Marking restore as completed on CVRs")
-	if err := p.markRestoreAsCompleted(vol); err != nil {
+	if err := p.getVolumeEngine(vol).annotateReplicas(restoreCompletedAnnotation, trueStr); err != nil {
 		p.Log.Errorf("Failed to mark restore as completed : %s", err)
 		return err
 	}
@@ -173,78 +118,141 @@ func (p *Plugin) markCVRsAsRestoreCompleted(vol *Volume) error {
 	return nil
 }
 
-// markRestoreAsCompleted will mark CVRs that the restore was completed
-func (p *Plugin) markRestoreAsCompleted(vol *Volume) error {
-	if vol.isCSIVolume {
-		return p.markRestoreAsCompletedForCSIBasedCVRs(vol)
+// isVolumeReady checks if the given volume is ready for IO. Volume is ready if CStorVolume
+// is Healthy and all the CVRs are Healthy. Target IP, set by the plugin, is checked if
+// autoSetTargetIP is enabled.
+func (p *Plugin) isVolumeReady(engine volumeEngine, vol *Volume) (bool, error) {
+	phase, err := engine.phase()
+	if err != nil {
+		return false, err
 	}
-	return p.markRestoreAsCompletedForNonCSIBasedCVRs(vol)
-}
 
-func (p *Plugin) markRestoreAsCompletedForCSIBasedCVRs(vol *Volume) error {
-	replicas := p.OpenEBSAPIsClient.CstorV1().
-		CStorVolumeReplicas(p.namespace)
+	if phase != cStorVolumeHealthy {
+		p.Log.Infof("Volume{%s} is not ready, cstorVolume phase=%s", vol.volname, phase)
+		return false, nil
+	}
 
-	cvrList, err := replicas.
-		List(context.TODO(), metav1.ListOptions{
-			LabelSelector: cVRPVLabel + "=" + vol.volname,
-		})
+	replicaCount, err := engine.replicationFactor()
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to fetch replication factor for volume=%s", vol.volname)
+	}
 
+	replicas, err := engine.listReplicas()
 	if err != nil {
-		return errors.Errorf("Failed to fetch CVR for volume=%s %s", vol.volname, err)
+		return false, err
 	}
 
-	var errs []string
-	for i := range cvrList.Items {
-		cvr := cvrList.Items[i]
-		p.Log.Infof("Updating CVRs %s", cvr.Name)
+	if len(replicas) != replicaCount {
+		p.Log.Infof("Volume{%s} is not ready, %d replicas exist out of %d", vol.volname, len(replicas), replicaCount)
+		return false, nil
+	}
 
-		cvr.Annotations[restoreCompletedAnnotation] = trueStr
-		_, err := replicas.Update(context.TODO(), &cvr, metav1.UpdateOptions{})
+	for _, r := range replicas {
+		if r.phase != string(cstorv1.CVRStatusOnline) {
+			p.Log.Infof("Volume{%s} is not ready, replica %s phase=%s", vol.volname, r.name, r.phase)
+			return false, nil
+		}
 
-		if err != nil {
-			p.Log.Warnf("could not update CVR %s", cvr.Name)
-			errs = append(errs, err.Error())
+		if p.autoSetTargetIP && r.targetIP == "" {
+			p.Log.Infof("Volume{%s} is not ready, target IP is not set on replica %s", vol.volname, r.name)
+			return false, nil
 		}
 	}
+	return true, nil
+}
 
-	if len(errs) > 0 {
-		return fmt.Errorf(strings.Join(errs, "; "))
+// checkReplicaHealth checks the health of replicas of the given volume before backup
+// and take the action as per replicaHealthPolicy
+func (p *Plugin) checkReplicaHealth(vol *Volume) error {
+	engine := p.getVolumeEngine(vol)
+
+	replicaCount, err := engine.replicationFactor()
+	if err != nil {
+		return errors.Wrapf(err, "failed to fetch replication factor for volume=%s", vol.volname)
 	}
 
-	return nil
-}
+	replicas, err := engine.listReplicas()
+	if err != nil {
+		return err
+	}
 
-func (p *Plugin) markRestoreAsCompletedForNonCSIBasedCVRs(vol *Volume) error {
-	replicas := p.OpenEBSClient.OpenebsV1alpha1().
-		CStorVolumeReplicas(p.namespace)
+	var healthy int
+	var status []string
+	for _, r := range replicas {
+		if r.phase == string(cstorv1.CVRStatusOnline) {
+			healthy++
+		}
+		status = append(status, r.name+"="+r.phase)
+	}
+
+	if healthy == replicaCount && len(replicas) == replicaCount {
+		return nil
+	}
 
-	cvrList, err := replicas.
-		List(context.TODO(), metav1.ListOptions{
-			LabelSelector: cVRPVLabel + "=" + vol.volname,
-		})
+	msg := fmt.Sprintf("volume=%s has %d healthy replicas out of %d, replicas {%s}",
+		vol.volname, healthy, replicaCount, strings.Join(status, ", "))
 
-	if err != nil {
-		return errors.Errorf("Failed to fetch CVR for volume=%s %s", vol.volname, err)
+	switch p.replicaHealthPolicy {
+	case ReplicaHealthPolicyFail:
+		return errors.Errorf("Replicas are not healthy, %s", msg)
+	case ReplicaHealthPolicyHealthiest:
+		if healthy == 0 {
+			return errors.Errorf("No healthy replica to backup, %s", msg)
+		}
+		p.Log.Warnf("Replicas are not healthy, backup will be taken from the healthiest replica, %s", msg)
+		vol.selectReplica = true
+	default:
+		p.Log.Warnf("Replicas are not healthy, %s", msg)
 	}
+	return nil
+}
 
-	var errs []string
-	for i := range cvrList.Items {
-		cvr := cvrList.Items[i]
-		p.Log.Infof("Updating CVRs %s", cvr.Name)
+// selectHealthiestReplica return the healthy replica, having the given previous snapshot
+// and the most snapshots, to take the backup from. It returns nil if no replica is healthy.
+func selectHealthiestReplica(replicas []replica, prevSnap string) *replica {
+	var src *replica
+	for i, r := range replicas {
+		if r.phase != string(cstorv1.CVRStatusOnline) {
+			continue
+		}
+
+		if src == nil {
+			src = &replicas[i]
+			continue
+		}
 
-		cvr.Annotations[restoreCompletedAnnotation] = trueStr
-		_, err := replicas.Update(context.TODO(), &cvr, metav1.UpdateOptions{})
+		// incremental backup requires the previous snapshot on the replica
+		if prevSnap != "" && contains(r.snapshots, prevSnap) != contains(src.snapshots, prevSnap) {
+			if contains(r.snapshots, prevSnap) {
+				src = &replicas[i]
+			}
+			continue
+		}
 
-		if err != nil {
-			p.Log.Warnf("could not update CVR %s", cvr.Name)
-			errs = append(errs, err.Error())
+		if len(r.snapshots) > len(src.snapshots) ||
+			(len(r.snapshots) == len(src.snapshots) && r.name < src.name) {
+			src = &replicas[i]
 		}
 	}
+	return src
+}
 
-	if len(errs) > 0 {
-		return fmt.Errorf(strings.Join(errs, "; "))
+// getBackupReplica return the name of replica used for the backup of given volume
+func (p *Plugin) getBackupReplica(vol *Volume) string {
+	if vol.backupPoolUID == "" {
+		return ""
 	}
 
-	return nil
+	replicas, err := p.getVolumeEngine(vol).listReplicas()
+	if err != nil {
+		p.Log.Warnf("Failed to fetch replicas of volume=%s : %s", vol.volname, err)
+		return ""
+	}
+
+	for _, r := range replicas {
+		if r.poolUID == vol.backupPoolUID {
+			return r.name
+		}
+	}
+	return ""
 }
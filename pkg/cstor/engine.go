@@ -0,0 +1,471 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	cstorv1 "github.com/openebs/api/v2/pkg/apis/cstor/v1"
+	apitypes "github.com/openebs/api/v2/pkg/apis/types"
+	"github.com/openebs/maya/pkg/apis/openebs.io/v1alpha1"
+	"github.com/pkg/errors"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// replica represents the CStorVolumeReplica of the volume
+type replica struct {
+	// name of the CVR
+	name string
+
+	// pool is the name of cStor pool, or pool instance, having the replica
+	pool string
+
+	// poolUID is the uid of cStor pool, or pool instance, having the replica
+	poolUID string
+
+	// phase of the CVR
+	phase string
+
+	// targetIP is the IP of volume target set on the replica
+	targetIP string
+
+	// snapshots is the sorted list of snapshots created on the replica
+	snapshots []string
+}
+
+// volumeEngine provides access to the CStorVolume and CStorVolumeReplicas of a volume.
+// Non-CSI volumes use the v1alpha1 resources from maya and CSI volumes use
+// the v1 resources from openebs/api.
+type volumeEngine interface {
+	// replicationFactor return the replication factor of the volume
+	replicationFactor() (int, error)
+
+	// targetIP return the IP of the volume target
+	targetIP() (string, error)
+
+	// phase return the phase of the CStorVolume
+	phase() (string, error)
+
+	// listReplicas return the CVRs of the volume
+	listReplicas() ([]replica, error)
+
+	// annotateReplicas sets the given annotation on all the CVRs of the volume
+	annotateReplicas(key, value string) error
+
+	// createBackup creates the given backup resource to upload the snapshot from the given replica
+	createBackup(bkp *v1alpha1.CStorBackup, r replica) error
+
+	// deleteBackup deletes the given backup resource and its completed-backup resource
+	deleteBackup(bkp *v1alpha1.CStorBackup) error
+
+	// lastBackupSnap return the snapshot of last completed backup, of the given backup's schedule
+	lastBackupSnap(bkp *v1alpha1.CStorBackup) (string, error)
+}
+
+// getVolumeEngine return the volumeEngine for the given volume
+func (p *Plugin) getVolumeEngine(vol *Volume) volumeEngine {
+	if vol.isCSIVolume {
+		return &v1Engine{p: p, volname: vol.volname}
+	}
+	return &v1alpha1Engine{p: p, volname: vol.volname}
+}
+
+// listSnapshots return the snapshots of the volume, present on all the given replicas
+func listSnapshots(replicas []replica) []string {
+	count := map[string]int{}
+	for _, r := range replicas {
+		for _, snap := range r.snapshots {
+			count[snap]++
+		}
+	}
+
+	var snapshots []string
+	for snap, c := range count {
+		if c == len(replicas) {
+			snapshots = append(snapshots, snap)
+		}
+	}
+	sort.Strings(snapshots)
+	return snapshots
+}
+
+// v1alpha1Engine implements volumeEngine for non-CSI volumes
+type v1alpha1Engine struct {
+	p       *Plugin
+	volname string
+}
+
+func (e *v1alpha1Engine) replicationFactor() (int, error) {
+	obj, err := e.p.OpenEBSClient.
+		OpenebsV1alpha1().
+		CStorVolumes(e.p.namespace).
+		Get(context.TODO(), e.volname, metav1.GetOptions{})
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to fetch cstorVolume %s", e.volname)
+	}
+	return obj.Spec.ReplicationFactor, nil
+}
+
+func (e *v1alpha1Engine) targetIP() (string, error) {
+	obj, err := e.p.OpenEBSClient.
+		OpenebsV1alpha1().
+		CStorVolumes(e.p.namespace).
+		Get(context.TODO(), e.volname, metav1.GetOptions{})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to fetch cstorVolume %s", e.volname)
+	}
+	return obj.Spec.TargetIP, nil
+}
+
+func (e *v1alpha1Engine) phase() (string, error) {
+	obj, err := e.p.OpenEBSClient.
+		OpenebsV1alpha1().
+		CStorVolumes(e.p.namespace).
+		Get(context.TODO(), e.volname, metav1.GetOptions{})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to fetch cstorVolume %s", e.volname)
+	}
+	return string(obj.Status.Phase), nil
+}
+
+func (e *v1alpha1Engine) listReplicas() ([]replica, error) {
+	cvrList, err := e.p.OpenEBSClient.
+		OpenebsV1alpha1().
+		CStorVolumeReplicas(e.p.namespace).
+		List(context.TODO(), metav1.ListOptions{
+			LabelSelector: cVRPVLabel + "=" + e.volname,
+		})
+	if err != nil {
+		return nil, errors.Errorf("Failed to fetch CVR for volume=%s %s", e.volname, err)
+	}
+
+	var replicas []replica
+	for _, cvr := range cvrList.Items {
+		var snaps []string
+		for snap := range cvr.Status.Snapshots {
+			snaps = append(snaps, snap)
+		}
+		sort.Strings(snaps)
+
+		replicas = append(replicas, replica{
+			name:      cvr.Name,
+			pool:      cvr.Labels[string(v1alpha1.CStorPoolKey)],
+			poolUID:   cvr.Labels[cStorPoolUIDLabel],
+			phase:     string(cvr.Status.Phase),
+			targetIP:  cvr.Spec.TargetIP,
+			snapshots: snaps,
+		})
+	}
+	return replicas, nil
+}
+
+func (e *v1alpha1Engine) annotateReplicas(key, value string) error {
+	replicas := e.p.OpenEBSClient.OpenebsV1alpha1().
+		CStorVolumeReplicas(e.p.namespace)
+
+	cvrList, err := replicas.
+		List(context.TODO(), metav1.ListOptions{
+			LabelSelector: cVRPVLabel + "=" + e.volname,
+		})
+
+	if err != nil {
+		return errors.Errorf("Failed to fetch CVR for volume=%s %s", e.volname, err)
+	}
+
+	var errs []string
+	for i := range cvrList.Items {
+		cvr := cvrList.Items[i]
+		e.p.Log.Infof("Updating CVRs %s", cvr.Name)
+
+		if cvr.Annotations == nil {
+			cvr.Annotations = map[string]string{}
+		}
+		cvr.Annotations[key] = value
+		_, err := replicas.Update(context.TODO(), &cvr, metav1.UpdateOptions{})
+
+		if err != nil {
+			e.p.Log.Warnf("could not update CVR %s", cvr.Name)
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf(strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+func (e *v1alpha1Engine) createBackup(bkp *v1alpha1.CStorBackup, r replica) error {
+	bkp.Labels = map[string]string{
+		cStorPoolUIDLabel: r.poolUID,
+		cVRPVLabel:        e.volname,
+		backupLabel:       bkp.Spec.BackupName,
+	}
+
+	// completed-backup resource is updated by pool once the backup completes
+	completed := &v1alpha1.CStorCompletedBackup{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      completedBackupName(bkp),
+			Namespace: bkp.Namespace,
+			Labels:    bkp.Labels,
+		},
+		Spec: v1alpha1.CStorBackupSpec{
+			BackupName: bkp.Spec.BackupName,
+			VolumeName: bkp.Spec.VolumeName,
+		},
+	}
+
+	_, err := e.p.OpenEBSClient.OpenebsV1alpha1().
+		CStorCompletedBackups(bkp.Namespace).
+		Create(context.TODO(), completed, metav1.CreateOptions{})
+	if err != nil && !k8serrors.IsAlreadyExists(err) {
+		return errors.Wrapf(err, "failed to create completed-backup %s", completed.Name)
+	}
+
+	_, err = e.p.OpenEBSClient.OpenebsV1alpha1().
+		CStorBackups(bkp.Namespace).
+		Create(context.TODO(), bkp, metav1.CreateOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "failed to create backup %s", bkp.Name)
+	}
+	return nil
+}
+
+func (e *v1alpha1Engine) lastBackupSnap(bkp *v1alpha1.CStorBackup) (string, error) {
+	obj, err := e.p.OpenEBSClient.OpenebsV1alpha1().
+		CStorCompletedBackups(bkp.Namespace).
+		Get(context.TODO(), completedBackupName(bkp), metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get completed-backup %s", completedBackupName(bkp))
+	}
+	return obj.Spec.PrevSnapName, nil
+}
+
+func (e *v1alpha1Engine) deleteBackup(bkp *v1alpha1.CStorBackup) error {
+	err := e.p.OpenEBSClient.OpenebsV1alpha1().
+		CStorBackups(bkp.Namespace).
+		Delete(context.TODO(), bkp.Name, metav1.DeleteOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return errors.Wrapf(err, "failed to delete backup %s", bkp.Name)
+	}
+
+	err = e.p.OpenEBSClient.OpenebsV1alpha1().
+		CStorCompletedBackups(bkp.Namespace).
+		Delete(context.TODO(), completedBackupName(bkp), metav1.DeleteOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return errors.Wrapf(err, "failed to delete completed-backup %s", completedBackupName(bkp))
+	}
+	return nil
+}
+
+// v1Engine implements volumeEngine for CSI volumes
+type v1Engine struct {
+	p       *Plugin
+	volname string
+}
+
+func (e *v1Engine) replicationFactor() (int, error) {
+	obj, err := e.p.OpenEBSAPIsClient.
+		CstorV1().
+		CStorVolumes(e.p.namespace).
+		Get(context.TODO(), e.volname, metav1.GetOptions{})
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to fetch cstorVolume %s", e.volname)
+	}
+	return obj.Spec.ReplicationFactor, nil
+}
+
+func (e *v1Engine) targetIP() (string, error) {
+	obj, err := e.p.OpenEBSAPIsClient.
+		CstorV1().
+		CStorVolumes(e.p.namespace).
+		Get(context.TODO(), e.volname, metav1.GetOptions{})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to fetch cstorVolume %s", e.volname)
+	}
+	return obj.Spec.TargetIP, nil
+}
+
+func (e *v1Engine) phase() (string, error) {
+	obj, err := e.p.OpenEBSAPIsClient.
+		CstorV1().
+		CStorVolumes(e.p.namespace).
+		Get(context.TODO(), e.volname, metav1.GetOptions{})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to fetch cstorVolume %s", e.volname)
+	}
+	return string(obj.Status.Phase), nil
+}
+
+func (e *v1Engine) listReplicas() ([]replica, error) {
+	cvrList, err := e.p.OpenEBSAPIsClient.
+		CstorV1().
+		CStorVolumeReplicas(e.p.namespace).
+		List(context.TODO(), metav1.ListOptions{
+			LabelSelector: cVRPVLabel + "=" + e.volname,
+		})
+	if err != nil {
+		return nil, errors.Errorf("Failed to fetch CVR for volume=%s %s", e.volname, err)
+	}
+
+	var replicas []replica
+	for _, cvr := range cvrList.Items {
+		var snaps []string
+		for snap := range cvr.Status.Snapshots {
+			snaps = append(snaps, snap)
+		}
+		sort.Strings(snaps)
+
+		replicas = append(replicas, replica{
+			name:      cvr.Name,
+			pool:      cvr.Labels[apitypes.CStorPoolInstanceNameLabelKey],
+			poolUID:   cvr.Labels[apitypes.CStorPoolInstanceUIDLabelKey],
+			phase:     string(cvr.Status.Phase),
+			targetIP:  cvr.Spec.TargetIP,
+			snapshots: snaps,
+		})
+	}
+	return replicas, nil
+}
+
+func (e *v1Engine) annotateReplicas(key, value string) error {
+	replicas := e.p.OpenEBSAPIsClient.CstorV1().
+		CStorVolumeReplicas(e.p.namespace)
+
+	cvrList, err := replicas.
+		List(context.TODO(), metav1.ListOptions{
+			LabelSelector: cVRPVLabel + "=" + e.volname,
+		})
+
+	if err != nil {
+		return errors.Errorf("Failed to fetch CVR for volume=%s %s", e.volname, err)
+	}
+
+	var errs []string
+	for i := range cvrList.Items {
+		cvr := cvrList.Items[i]
+		e.p.Log.Infof("Updating CVRs %s", cvr.Name)
+
+		if cvr.Annotations == nil {
+			cvr.Annotations = map[string]string{}
+		}
+		cvr.Annotations[key] = value
+		_, err := replicas.Update(context.TODO(), &cvr, metav1.UpdateOptions{})
+
+		if err != nil {
+			e.p.Log.Warnf("could not update CVR %s", cvr.Name)
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf(strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+func (e *v1Engine) createBackup(bkp *v1alpha1.CStorBackup, r replica) error {
+	labels := map[string]string{
+		apitypes.CStorPoolInstanceUIDLabelKey: r.poolUID,
+		apitypes.PersistentVolumeLabelKey:     e.volname,
+		backupLabel:                           bkp.Spec.BackupName,
+	}
+
+	// completed-backup resource is updated by pool once the backup completes
+	completed := &cstorv1.CStorCompletedBackup{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      completedBackupName(bkp),
+			Namespace: bkp.Namespace,
+			Labels:    labels,
+		},
+		Spec: cstorv1.CStorCompletedBackupSpec{
+			BackupName: bkp.Spec.BackupName,
+			VolumeName: bkp.Spec.VolumeName,
+		},
+	}
+
+	_, err := e.p.OpenEBSAPIsClient.CstorV1().
+		CStorCompletedBackups(bkp.Namespace).
+		Create(context.TODO(), completed, metav1.CreateOptions{})
+	if err != nil && !k8serrors.IsAlreadyExists(err) {
+		return errors.Wrapf(err, "failed to create completed-backup %s", completed.Name)
+	}
+
+	obj := &cstorv1.CStorBackup{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        bkp.Name,
+			Namespace:   bkp.Namespace,
+			Labels:      labels,
+			Annotations: bkp.Annotations,
+		},
+		Spec: cstorv1.CStorBackupSpec{
+			BackupName:   bkp.Spec.BackupName,
+			VolumeName:   bkp.Spec.VolumeName,
+			SnapName:     bkp.Spec.SnapName,
+			PrevSnapName: bkp.Spec.PrevSnapName,
+			BackupDest:   bkp.Spec.BackupDest,
+		},
+		Status: cstorv1.CStorBackupStatus(bkp.Status),
+	}
+
+	_, err = e.p.OpenEBSAPIsClient.CstorV1().
+		CStorBackups(bkp.Namespace).
+		Create(context.TODO(), obj, metav1.CreateOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "failed to create backup %s", bkp.Name)
+	}
+	return nil
+}
+
+func (e *v1Engine) lastBackupSnap(bkp *v1alpha1.CStorBackup) (string, error) {
+	obj, err := e.p.OpenEBSAPIsClient.CstorV1().
+		CStorCompletedBackups(bkp.Namespace).
+		Get(context.TODO(), completedBackupName(bkp), metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get completed-backup %s", completedBackupName(bkp))
+	}
+	return obj.Spec.LastSnapName, nil
+}
+
+func (e *v1Engine) deleteBackup(bkp *v1alpha1.CStorBackup) error {
+	err := e.p.OpenEBSAPIsClient.CstorV1().
+		CStorBackups(bkp.Namespace).
+		Delete(context.TODO(), bkp.Name, metav1.DeleteOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return errors.Wrapf(err, "failed to delete backup %s", bkp.Name)
+	}
+
+	err = e.p.OpenEBSAPIsClient.CstorV1().
+		CStorCompletedBackups(bkp.Namespace).
+		Delete(context.TODO(), completedBackupName(bkp), metav1.DeleteOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return errors.Wrapf(err, "failed to delete completed-backup %s", completedBackupName(bkp))
+	}
+	return nil
+}
@@ -0,0 +1,365 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"context"
+	"time"
+
+	"github.com/openebs/maya/pkg/apis/openebs.io/v1alpha1"
+	cloud "github.com/openebs/velero-plugin/pkg/clouduploader"
+	"github.com/openebs/velero-plugin/pkg/velero"
+	"github.com/pkg/errors"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// ConsistencyGroupLabel is the PVC label having the name of consistency group.
+	// Snapshots of all the PVCs, in a namespace, having the same group are created together.
+	ConsistencyGroupLabel = "openebs.io/consistency-group"
+
+	// GroupBackupPortBase is the first port used to upload the snapshots of consistency group
+	// Snapshot of n'th member is uploaded using port GroupBackupPortBase+n
+	GroupBackupPortBase = 9100
+
+	// groupReleaseInterval is the interval to check the completion of backup, having consistency group
+	groupReleaseInterval = 30 * time.Second
+
+	// groupReleaseTimeout is the maximum time to wait for the completion of backup, having consistency group
+	groupReleaseTimeout = 24 * time.Hour
+)
+
+// groupMember is a volume of consistency group
+type groupMember struct {
+	vol *Volume
+
+	// done is closed once snapshot is uploaded
+	done chan struct{}
+
+	snapshotID string
+	err        error
+}
+
+// groupBackup is the backup of consistency group
+type groupBackup struct {
+	// ready is closed once snapshots of the group are created
+	ready chan struct{}
+
+	// err is the error in creating the snapshots of the group
+	err error
+
+	// members of the group, not yet claimed by the snapshot request of their volume
+	members map[string]*groupMember
+}
+
+// getConsistencyGroup return the consistency group of the given volume
+func (p *Plugin) getConsistencyGroup(vol *Volume) (string, error) {
+	if vol.pvcName == "" {
+		return "", nil
+	}
+
+	pvc, err := p.K8sClient.
+		CoreV1().
+		PersistentVolumeClaims(vol.namespace).
+		Get(context.TODO(), vol.pvcName, metav1.GetOptions{})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to fetch PVC %s/%s", vol.namespace, vol.pvcName)
+	}
+	return pvc.Labels[ConsistencyGroupLabel], nil
+}
+
+// createGroupSnapshot return the snapshot of given volume, created with all the volumes of
+// its consistency group. Snapshots of the group are created, and their upload is started,
+// when the snapshot of first member is requested.
+func (p *Plugin) createGroupSnapshot(vol *Volume, group string) (string, error) {
+	key := vol.backupName + "/" + vol.namespace + "/" + group
+
+	g, started := p.getGroupBackup(key, func() (map[string]*groupMember, error) {
+		return p.startGroupBackup(vol.backupName, vol.namespace, group)
+	})
+	if g.err != nil {
+		return "", g.err
+	}
+
+	if started {
+		go func() {
+			p.waitBackupCompletion(vol.backupName)
+			p.releaseGroup(key, g)
+		}()
+	}
+
+	m, ok := p.claimGroupMember(key, g, vol.volname)
+	if !ok {
+		return "", errors.Errorf("volume %s was not a member of consistency group %s when its snapshot was created", vol.volname, group)
+	}
+
+	<-m.done
+	return m.snapshotID, m.err
+}
+
+// getGroupBackup return the backup of consistency group for the given key. Backup is started,
+// using start, by the first request of the group, outside of groupLock, and other requests
+// wait for it. It returns true if the backup is started by this request.
+func (p *Plugin) getGroupBackup(key string, start func() (map[string]*groupMember, error)) (*groupBackup, bool) {
+	p.groupLock.Lock()
+	g, ok := p.groups[key]
+	if !ok {
+		g = &groupBackup{ready: make(chan struct{})}
+		p.groups[key] = g
+	}
+	p.groupLock.Unlock()
+
+	if ok {
+		<-g.ready
+		return g, false
+	}
+
+	members, err := start()
+
+	p.groupLock.Lock()
+	g.members, g.err = members, err
+	if err != nil {
+		// next request of the group will retry
+		delete(p.groups, key)
+	}
+	p.groupLock.Unlock()
+
+	close(g.ready)
+	return g, true
+}
+
+// claimGroupMember removes the member of given volume from the group backup, and return it.
+// Group backup is removed once all of its members are claimed.
+func (p *Plugin) claimGroupMember(key string, g *groupBackup, volname string) (*groupMember, bool) {
+	p.groupLock.Lock()
+	defer p.groupLock.Unlock()
+
+	m, ok := g.members[volname]
+	if !ok {
+		return nil, false
+	}
+
+	delete(g.members, volname)
+	if len(g.members) == 0 && p.groups[key] == g {
+		delete(p.groups, key)
+	}
+	return m, true
+}
+
+// releaseGroup removes the group backup and its members not claimed by any snapshot request,
+// volume of such member is not part of the velero backup
+func (p *Plugin) releaseGroup(key string, g *groupBackup) {
+	p.groupLock.Lock()
+	defer p.groupLock.Unlock()
+
+	for volname := range g.members {
+		p.Log.Warnf("Snapshot of volume %s, of consistency group %s, is not used by the backup", volname, key)
+		delete(g.members, volname)
+	}
+
+	if p.groups[key] == g {
+		delete(p.groups, key)
+	}
+}
+
+// waitBackupCompletion waits till the given velero backup is in progress, upto groupReleaseTimeout
+func (p *Plugin) waitBackupCompletion(bkpName string) {
+	err := wait.PollImmediate(groupReleaseInterval, groupReleaseTimeout, func() (bool, error) {
+		bkp, err := velero.GetBackup(bkpName)
+		if err != nil {
+			if k8serrors.IsNotFound(errors.Cause(err)) {
+				return true, nil
+			}
+			p.Log.Warnf("Failed to get status of backup %s : %s", bkpName, err.Error())
+			return false, nil
+		}
+		return bkp.Status.Phase != velerov1api.BackupPhaseNew && bkp.Status.Phase != velerov1api.BackupPhaseInProgress, nil
+	})
+	if err != nil {
+		p.Log.Warnf("Backup %s is not completed in %v", bkpName, groupReleaseTimeout)
+	}
+}
+
+// startGroupBackup creates the snapshots of all the volumes of given consistency group
+// and starts their upload
+func (p *Plugin) startGroupBackup(bkpname, ns, group string) (map[string]*groupMember, error) {
+	pvcList, err := p.K8sClient.
+		CoreV1().
+		PersistentVolumeClaims(ns).
+		List(context.TODO(), metav1.ListOptions{
+			LabelSelector: ConsistencyGroupLabel + "=" + group,
+		})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list PVCs of consistency group %s/%s", ns, group)
+	}
+
+	members := map[string]*groupMember{}
+
+	var vols []*Volume
+	for _, pvc := range pvcList.Items {
+		vol, err := p.getGroupVolume(pvc)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get volume of PVC %s/%s in consistency group %s", ns, pvc.Name, group)
+		}
+		vol.backupName = bkpname
+
+		if err := p.checkReplicaHealth(vol); err != nil {
+			return nil, err
+		}
+		vols = append(vols, vol)
+	}
+
+	conns := make([]*cloud.Conn, len(vols))
+	unlocks := make([]func(), len(vols))
+	if !p.local {
+		for i := range vols {
+			if conns[i], err = p.newConn(); err != nil {
+				return nil, err
+			}
+			if err := conns[i].GenerateTransferToken(); err != nil {
+				return nil, err
+			}
+		}
+
+		// data server ports are used till the upload of respective member completes
+		for i := range vols {
+			unlocks[i] = p.lockPort(GroupBackupPortBase + i)
+		}
+	}
+
+	unlockPort := func(i int) {
+		if unlocks[i] != nil {
+			unlocks[i]()
+		}
+	}
+
+	p.Log.Infof("creating snapshot{%s} of consistency group %s/%s with %d volumes", bkpname, ns, group, len(vols))
+
+	// freeze all the members, snapshots are created together
+	var thaws []func() error
+	thawAll := func() error {
+		var thawErr error
+		for i := len(thaws) - 1; i >= 0; i-- {
+			if err := thaws[i](); err != nil && thawErr == nil {
+				thawErr = err
+			}
+		}
+		return thawErr
+	}
+
+	for _, vol := range vols {
+		thaw, err := p.freezer.Freeze(vol.namespace, vol.pvcName)
+		if err != nil {
+			_ = thawAll()
+			for i := range vols {
+				unlockPort(i)
+			}
+			return nil, errors.Wrapf(err, "failed to freeze application")
+		}
+		thaws = append(thaws, thaw)
+	}
+
+	snapTime := time.Now().UTC()
+	bkps := make([]*v1alpha1.CStorBackup, len(vols))
+	errs := make([]error, len(vols))
+	for i, vol := range vols {
+		bkps[i], errs[i] = p.sendBackupRequest(vol, conns[i], GroupBackupPortBase+i)
+		if errs[i] != nil {
+			errs[i] = errors.Wrapf(errs[i], "Failed to send backup request")
+			// snapshot of remaining members will not be consistent with the created snapshots
+			for j := i + 1; j < len(vols); j++ {
+				errs[j] = errors.Errorf("failed to create snapshot of consistency group %s/%s", ns, group)
+			}
+			break
+		}
+	}
+
+	// snapshots taken after the application is thawed are not consistent
+	if err := thawAll(); err != nil {
+		for i := range errs {
+			if errs[i] == nil {
+				p.discardSnapshot(vols[i])
+				errs[i] = errors.Wrapf(err, "snapshot of consistency group %s/%s is not app-consistent", ns, group)
+			}
+		}
+	}
+
+	p.Log.Infof("Snapshot of consistency group %s/%s created at %s", ns, group, snapTime.Format(time.RFC3339))
+
+	for i, vol := range vols {
+		m := &groupMember{
+			vol:  vol,
+			done: make(chan struct{}),
+		}
+		members[vol.volname] = m
+
+		if errs[i] != nil || p.local {
+			m.err = errs[i]
+			if m.err == nil {
+				m.snapshotID = generateSnapshotID(vol.volname, vol.backupName)
+			}
+			unlockPort(i)
+			close(m.done)
+			continue
+		}
+
+		// upload the snapshots together, each member uses its own data server
+		go func(m *groupMember, bkp *v1alpha1.CStorBackup, cl *cloud.Conn, i int) {
+			defer close(m.done)
+			defer unlockPort(i)
+			m.snapshotID, m.err = p.uploadSnapshot(m.vol, bkp, cl, GroupBackupPortBase+i, snapTime, group)
+		}(m, bkps[i], conns[i], i)
+	}
+	return members, nil
+}
+
+// getGroupVolume return the volume for the given PVC of consistency group
+func (p *Plugin) getGroupVolume(pvc v1.PersistentVolumeClaim) (*Volume, error) {
+	if pvc.Spec.VolumeName == "" {
+		return nil, errors.New("PVC is not bound")
+	}
+
+	if vol, ok := p.lookupVolume(pvc.Spec.VolumeName); ok {
+		return vol, nil
+	}
+
+	pv, err := p.getPV(pvc.Spec.VolumeName)
+	if err != nil {
+		return nil, err
+	}
+
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pv)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	volumeID, err := p.GetVolumeID(&unstructured.Unstructured{Object: obj})
+	if err != nil {
+		return nil, err
+	}
+
+	if volumeID == "" {
+		return nil, errors.Errorf("volume %s is not a cStor volume", pv.Name)
+	}
+	return p.getVolume(volumeID)
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cstor
+
+import (
+	"strconv"
+	"time"
+
+	cstorv1 "github.com/openebs/api/v2/pkg/apis/cstor/v1"
+	"github.com/openebs/maya/pkg/apis/openebs.io/v1alpha1"
+	"github.com/openebs/velero-plugin/pkg/velero"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// backupLabel is the label of backup resource having the backup/schedule name
+	backupLabel = "openebs.io/backup"
+)
+
+// getOffloadSource return the local backup, whose snapshots are to be uploaded by the given backup
+func (p *Plugin) getOffloadSource(bkpname string) string {
+	bkp, err := velero.GetBackup(bkpname)
+	if err != nil {
+		p.Log.Warnf("Failed to get backup=%s, local snapshot will not be uploaded : %s", bkpname, err.Error())
+		return ""
+	}
+	return velero.OffloadBackup(bkp)
+}
+
+// offloadSnapshot uploads the existing local snapshot, created by the source backup, of the given volume
+// Backup resource is created by the plugin, as maya-apiserver creates a new snapshot for the backup request.
+// Uploaded snapshot is a full snapshot.
+func (p *Plugin) offloadSnapshot(vol *Volume, source string) (string, error) {
+	p.Log.Infof("Uploading local snapshot{%s} of volume{%s} for backup{%s}", source, vol.volname, vol.backupName)
+
+	engine := p.getVolumeEngine(vol)
+
+	replicas, err := engine.listReplicas()
+	if err != nil {
+		return "", err
+	}
+
+	var src *replica
+	for i, r := range replicas {
+		if r.phase == string(cstorv1.CVRStatusOnline) && contains(r.snapshots, source) {
+			src = &replicas[i]
+			break
+		}
+	}
+
+	if src == nil {
+		return "", errors.Errorf("local snapshot{%s} of volume{%s} not found on any healthy replica", source, vol.volname)
+	}
+
+	cl, err := p.newConn()
+	if err != nil {
+		return "", err
+	}
+
+	if err := cl.GenerateTransferToken(); err != nil {
+		return "", err
+	}
+
+	// data server port is used till the upload completes
+	unlock := p.lockPort(CstorBackupPort)
+	defer unlock()
+
+	bkp := &v1alpha1.CStorBackup{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        source + "-" + vol.volname,
+			Namespace:   vol.namespace,
+			Annotations: cl.RemoteAnnotations(),
+		},
+		Spec: v1alpha1.CStorBackupSpec{
+			BackupName: vol.backupName,
+			VolumeName: vol.volname,
+			SnapName:   source,
+			BackupDest: p.cstorServerAddr + ":" + strconv.Itoa(CstorBackupPort),
+		},
+		Status: v1alpha1.BKPCStorStatusPending,
+	}
+
+	if err := engine.createBackup(bkp, *src); err != nil {
+		return "", err
+	}
+
+	defer func() {
+		if err := engine.deleteBackup(bkp); err != nil {
+			p.Log.Warnf("Failed to cleanup backup resource of local snapshot{%s} : %s", source, err.Error())
+		}
+	}()
+
+	// snapshot is created with the source backup
+	snapTime := time.Now().UTC()
+	if srcBkp, err := velero.GetBackup(source); err == nil {
+		snapTime = srcBkp.CreationTimestamp.UTC()
+	}
+
+	vol.sourceSnapshot = source
+	return p.uploadSnapshot(vol, bkp, cl, CstorBackupPort, snapTime, "")
+}
+
+// isOffloadedSnapshot checks if the given remote snapshot file is uploaded from existing local snapshot
+func (p *Plugin) isOffloadedSnapshot(filename string) bool {
+	if filename == "" {
+		return false
+	}
+
+	m, err := p.cl.ReadManifest(filename)
+	if err != nil {
+		p.Log.Warnf("Failed to read manifest of snapshot=%s : %s", filename, err.Error())
+		return false
+	}
+	return m != nil && m.Source != ""
+}
+
+// completedBackupName return the name of completed-backup resource for the given backup
+func completedBackupName(bkp *v1alpha1.CStorBackup) string {
+	return bkp.Spec.BackupName + "-" + bkp.Spec.VolumeName
+}
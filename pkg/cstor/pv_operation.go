@@ -20,9 +20,13 @@ import (
 	"context"
 	"encoding/json"
 	"sort"
+	"sync"
+	"time"
 
 	uuid "github.com/gofrs/uuid"
 	v1alpha1 "github.com/openebs/maya/pkg/apis/openebs.io/v1alpha1"
+	cloud "github.com/openebs/velero-plugin/pkg/clouduploader"
+	"github.com/openebs/velero-plugin/pkg/velero"
 	"github.com/pkg/errors"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -33,14 +37,9 @@ const (
 	PvClonePrefix = "cstor-clone-"
 )
 
-func (p *Plugin) updateVolCASInfo(data []byte, volumeID string) error {
+func (p *Plugin) updateVolCASInfo(data []byte, vol *Volume) error {
 	var cas v1alpha1.CASVolume
 
-	vol := p.volumes[volumeID]
-	if vol == nil {
-		return errors.Errorf("Volume{%s} not found in volume list", volumeID)
-	}
-
 	if !vol.isCSIVolume {
 		err := json.Unmarshal(data, &cas)
 		if err != nil {
@@ -63,16 +62,28 @@ func (p *Plugin) updateVolCASInfo(data []byte, volumeID string) error {
 // restoreVolumeFromCloud restore remote snapshot for the given volume
 // Note: cstor snapshots are incremental in nature, so restore will be executed
 // from base snapshot to incremental snapshot 'vol.backupName' if p.restoreAllSnapshots is set
-// else restore will be performed for the given backup only.
+// or point-in-time is requested, else restore will be performed for the given backup only.
 func (p *Plugin) restoreVolumeFromCloud(vol *Volume, targetBackupName string) error {
 	var (
 		snapshotList []string
+		replayed     []string
 		err          error
 	)
 
-	if p.restoreAllSnapshots {
-		// We are restoring from base backup to targeted Backup
-		snapshotList, err = p.cl.GetSnapListFromCloud(vol.snapshotTag, p.getScheduleName(targetBackupName))
+	pointInTime, err := velero.GetRestorePointInTime(targetBackupName)
+	if err != nil {
+		return err
+	}
+
+	if pointInTime != nil {
+		targetBackupName, err = p.selectPointInTime(vol, targetBackupName, *pointInTime)
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.restoreAllSnapshots || pointInTime != nil {
+		snapshotList, err = p.getSnapshotChain(vol, targetBackupName)
 		if err != nil {
 			return err
 		}
@@ -85,8 +96,15 @@ func (p *Plugin) restoreVolumeFromCloud(vol *Volume, targetBackupName string) er
 		return errors.Errorf("Targeted backup=%s not found in snapshot list", targetBackupName)
 	}
 
-	// snapshots are created using timestamp, we need to sort it in ascending order
-	sort.Strings(snapshotList)
+	// restore uses its own connection, as velero may restore the volumes in parallel
+	cl, err := p.newConn()
+	if err != nil {
+		return err
+	}
+
+	// data server port is used till all the snapshots are restored
+	unlock := p.lockPort(CstorRestorePort)
+	defer unlock()
 
 	for _, snap := range snapshotList {
 		// Check if snapshot file exists or not.
@@ -109,41 +127,114 @@ func (p *Plugin) restoreVolumeFromCloud(vol *Volume, targetBackupName string) er
 
 		vol.backupName = snap
 
-		err = p.restoreSnapshotFromCloud(vol)
+		err = p.restoreSnapshotFromCloud(vol, cl)
 		if err != nil {
 			return errors.Wrapf(err, "failed to restor snapshot=%s", snap)
 		}
 		p.Log.Infof("Restore of snapshot=%s completed", snap)
+		replayed = append(replayed, p.cl.GenerateRemoteFilename(vol.snapshotTag, snap))
 
 		if snap == targetBackupName {
 			// we restored till the targetBackupName, no need to restore next snapshot
 			break
 		}
 	}
+
+	p.Log.Infof("Volume=%s restored from snapshots=%v", vol.volname, replayed)
 	return nil
 }
 
-// restoreSnapshotFromCloud restore snapshot 'vol.backupName` to volume 'vol.volname'
-func (p *Plugin) restoreSnapshotFromCloud(vol *Volume) error {
-	p.cl.ExitServer = false
+// getSnapshotChain return the list of backups, from base backup to the target backup, for the given volume
+// Chain is built from the parent links recorded in manifest. For backups created by older
+// plugin, all the backups of the schedule are returned.
+func (p *Plugin) getSnapshotChain(vol *Volume, targetBackupName string) ([]string, error) {
+	chain, err := p.cl.ResolveChain(targetBackupName, func(backup string) string {
+		return p.cl.GenerateRemoteFilename(vol.snapshotTag, backup)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if chain != nil {
+		p.Log.Infof("Snapshot chain for backup=%s : %v", targetBackupName, chain)
+		return chain, nil
+	}
+
+	// We are restoring from base backup to targeted Backup
+	snapshotList, err := p.cl.GetSnapListFromCloud(vol.snapshotTag, p.getScheduleName(targetBackupName))
+	if err != nil {
+		return nil, err
+	}
+
+	// snapshots are created using timestamp, we need to sort it in ascending order
+	sort.Strings(snapshotList)
+	return snapshotList, nil
+}
+
+// selectPointInTime return the latest backup, of the schedule, created at or before the given time
+func (p *Plugin) selectPointInTime(vol *Volume, backupName string, t time.Time) (string, error) {
+	var backups []string
 
-	restore, err := p.sendRestoreRequest(vol)
+	list, err := p.cl.GetChainBackups(vol.snapshotTag, p.getScheduleName(backupName), func(backup string) string {
+		return p.cl.GenerateRemoteFilename(vol.snapshotTag, backup)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// only PVC file may exist for failed backup
+	for _, bkp := range list {
+		if exists, err := p.cl.FileExists(vol.snapshotTag, bkp); err == nil && exists {
+			backups = append(backups, bkp)
+		}
+	}
+
+	selected, err := p.cl.SelectPointInTime(backups, t, func(backup string) string {
+		return p.cl.GenerateRemoteFilename(vol.snapshotTag, backup)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	p.Log.Infof("Selected backup=%s for point-in-time=%s", selected, t.Format(time.RFC3339))
+	return selected, nil
+}
+
+// restoreSnapshotFromCloud restore snapshot 'vol.backupName` to volume 'vol.volname' using the given connection
+func (p *Plugin) restoreSnapshotFromCloud(vol *Volume, cl *cloud.Conn) error {
+	cl.SetExitServer(false)
+
+	// all the replicas of the volume download the snapshot
+	replicas, err := p.getVolumeEngine(vol).replicationFactor()
+	if err != nil {
+		return errors.Wrapf(err, "failed to get replication factor of volume %s", vol.volname)
+	}
+
+	if err := cl.GenerateTransferTokenFor(replicas); err != nil {
+		return err
+	}
+
+	restore, err := p.sendRestoreRequest(vol, cl)
 	if err != nil {
 		return errors.Wrapf(err, "Restore request to apiServer failed")
 	}
 
-	filename := p.cl.GenerateRemoteFilename(vol.snapshotTag, vol.backupName)
+	filename := cl.GenerateRemoteFilename(vol.snapshotTag, vol.backupName)
 	if filename == "" {
 		return errors.Errorf("Error creating remote file name for restore")
 	}
 
-	go p.checkRestoreStatus(restore, vol)
+	// status of volume is updated by checkRestoreStatus, till done is closed
+	done := make(chan struct{})
+	go p.checkRestoreStatus(restore, vol, cl, done)
 
-	ret := p.cl.Download(filename, CstorRestorePort)
+	ret := cl.Download(filename, CstorRestorePort)
 	if !ret {
 		return errors.New("failed to restore snapshot")
 	}
 
+	<-done
+
 	if vol.restoreStatus != v1alpha1.RSTCStorStatusDone {
 		return errors.Errorf("failed to restore.. status {%s}", vol.restoreStatus)
 	}
@@ -159,7 +250,7 @@ func (p *Plugin) getPV(volumeID string) (*v1.PersistentVolume, error) {
 }
 
 func (p *Plugin) restoreVolumeFromLocal(vol *Volume) error {
-	_, err := p.sendRestoreRequest(vol)
+	_, err := p.sendRestoreRequest(vol, nil)
 	if err != nil {
 		return errors.Wrapf(err, "Restore request to apiServer failed")
 	}
@@ -192,7 +283,6 @@ func (p *Plugin) getVolumeForLocalRestore(volumeID, snapName string) (*Volume, e
 		size:         pv.Spec.Capacity[v1.ResourceStorage],
 		isCSIVolume:  isCSIVolume,
 	}
-	p.volumes[vol.volname] = vol
 	return vol, nil
 }
 
@@ -221,6 +311,127 @@ func generateClonePVName() (string, error) {
 	return PvClonePrefix + nuuid.String(), nil
 }
 
+// newVolume return the volume state for the given cStor PV
+func newVolume(pv *v1.PersistentVolume) *Volume {
+	vol := &Volume{
+		volname:      pv.Name,
+		snapshotTag:  pv.Name,
+		storageClass: pv.Spec.StorageClassName,
+		size:         pv.Spec.Capacity[v1.ResourceStorage],
+		isCSIVolume:  isCSIPv(*pv),
+	}
+
+	if pv.Spec.ClaimRef != nil {
+		vol.namespace = pv.Spec.ClaimRef.Namespace
+		vol.pvcName = pv.Spec.ClaimRef.Name
+	}
+	return vol
+}
+
+// lookupVolume return the copy of state of the given volume, known to the plugin.
+// Each operation updates its own copy, as velero may call the plugin in parallel.
+func (p *Plugin) lookupVolume(volumeID string) (*Volume, bool) {
+	p.volumeLock.Lock()
+	defer p.volumeLock.Unlock()
+
+	vol, ok := p.volumes[volumeID]
+	if !ok {
+		return nil, false
+	}
+
+	cvol := *vol
+	return &cvol, true
+}
+
+// storeVolume saves the copy of given volume state
+func (p *Plugin) storeVolume(vol *Volume) {
+	cvol := *vol
+
+	p.volumeLock.Lock()
+	p.volumes[vol.volname] = &cvol
+	p.volumeLock.Unlock()
+}
+
+// lockPort locks the given data server port and return the function to unlock it.
+// Port is locked till the data transfer completes, so that parallel operations don't use the same port.
+func (p *Plugin) lockPort(port int) func() {
+	p.portLock.Lock()
+	l, ok := p.ports[port]
+	if !ok {
+		l = &sync.Mutex{}
+		p.ports[port] = l
+	}
+	p.portLock.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+// getVolume return the state of the given volume. If the volume is not known to the plugin,
+// as GetVolumeID was served by other plugin instance or plugin was restarted, it is rebuilt from the PV.
+func (p *Plugin) getVolume(volumeID string) (*Volume, error) {
+	if vol, ok := p.lookupVolume(volumeID); ok {
+		return vol, nil
+	}
+
+	pv, err := p.getPV(volumeID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to fetch PV %s", volumeID)
+	}
+
+	if !IsCStorPV(*pv) {
+		return nil, errors.Errorf("volume %s is not a cStor volume", volumeID)
+	}
+
+	p.Log.Infof("Rebuilding state of volume %s from PV", volumeID)
+
+	vol := newVolume(pv)
+	p.storeVolume(vol)
+	return vol, nil
+}
+
+// getRestoredVolume return the state of the volume restored by the plugin, for the given PV from backup.
+// If the volume is not known to the plugin, it is rebuilt from the PV from backup and the CStorVolume.
+func (p *Plugin) getRestoredVolume(volumeID string, pv *v1.PersistentVolume) (*Volume, error) {
+	if vol, ok := p.lookupVolume(volumeID); ok {
+		return vol, nil
+	}
+
+	p.Log.Infof("Rebuilding state of restored volume %s", volumeID)
+
+	vol := &Volume{
+		volname:     volumeID,
+		isCSIVolume: isCSIPv(*pv),
+	}
+
+	// iSCSI details are needed for the local restore of non-CSI volume
+	if p.local && !vol.isCSIVolume {
+		cv, err := p.OpenEBSClient.
+			OpenebsV1alpha1().
+			CStorVolumes(p.namespace).
+			Get(context.TODO(), volumeID, metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to fetch cstorVolume %s", volumeID)
+		}
+
+		vol.iscsi = v1.ISCSIPersistentVolumeSource{
+			TargetPortal: cv.Spec.TargetPortal,
+			IQN:          cv.Spec.Iqn,
+		}
+	}
+
+	p.storeVolume(vol)
+	return vol, nil
+}
+
+// IsCStorPV returns true if given PV is a cStor volume
+func IsCStorPV(pv v1.PersistentVolume) bool {
+	if volType, ok := pv.Labels[openebsVolumeLabel]; ok {
+		return volType == casTypeCStor
+	}
+	return isCSIPv(pv)
+}
+
 // isCSIPv returns true if given PV is created by cstor CSI driver
 func isCSIPv(pv v1.PersistentVolume) bool {
 	if pv.Spec.CSI != nil &&
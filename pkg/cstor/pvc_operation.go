@@ -19,6 +19,7 @@ package cstor
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"time"
 
 	"github.com/openebs/maya/pkg/apis/openebs.io/v1alpha1"
@@ -26,7 +27,9 @@ import (
 	"github.com/pkg/errors"
 	v1 "k8s.io/api/core/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/wait"
 )
 
@@ -41,59 +44,18 @@ const (
 	PVCCheckInterval = 5 * time.Second
 )
 
-// backupPVC perform backup for given volume's PVC
-func (p *Plugin) backupPVC(volumeID string) error {
-	vol := p.volumes[volumeID]
-	var bkpPvc *v1.PersistentVolumeClaim
-
-	pvcs, err := p.K8sClient.
-		CoreV1().
-		PersistentVolumeClaims(vol.namespace).
-		List(context.TODO(), metav1.ListOptions{})
-	if err != nil {
-		p.Log.Errorf("Error fetching PVC list : %s", err.Error())
-		return errors.New("failed to fetch PVC list")
-	}
-
-	for _, pvc := range pvcs.Items {
-		if pvc.Spec.VolumeName == vol.volname {
-			fPVC := pvc
-			bkpPvc = &fPVC
-			break
-		}
-	}
-
-	if bkpPvc == nil {
-		p.Log.Errorf("Failed to find PVC for PV{%s}", vol.volname)
-		return errors.Errorf("Failed to find PVC for volume{%s}", vol.volname)
-	}
-
-	bkpPvc.ResourceVersion = ""
-	bkpPvc.SelfLink = ""
-	if bkpPvc.Spec.StorageClassName == nil || *bkpPvc.Spec.StorageClassName == "" {
-		sc := bkpPvc.Annotations[v1.BetaStorageClassAnnotation]
-		bkpPvc.Spec.StorageClassName = &sc
-	}
-
-	bkpPvc.Annotations = nil
-	bkpPvc.UID = ""
-	bkpPvc.Spec.VolumeName = ""
-
-	data, err := json.MarshalIndent(bkpPvc, "", "\t")
-	if err != nil {
-		return errors.New("error doing json parsing")
-	}
-
-	filename := p.cl.GenerateRemoteFilename(vol.volname, vol.backupName)
-	if filename == "" {
-		return errors.New("error creating remote file name for pvc backup")
-	}
-
-	if ok := p.cl.Write(data, filename+".pvc"); !ok {
-		return errors.New("failed to upload PVC")
+// CleanPVCForBackup clears the runtime information of PVC so that it can be created at restore
+func CleanPVCForBackup(pvc *v1.PersistentVolumeClaim) {
+	pvc.ResourceVersion = ""
+	pvc.SelfLink = ""
+	if pvc.Spec.StorageClassName == nil || *pvc.Spec.StorageClassName == "" {
+		sc := pvc.Annotations[v1.BetaStorageClassAnnotation]
+		pvc.Spec.StorageClassName = &sc
 	}
 
-	return nil
+	pvc.Annotations = nil
+	pvc.UID = ""
+	pvc.Spec.VolumeName = ""
 }
 
 // createPVC create PVC for given volume name
@@ -117,6 +79,27 @@ func (p *Plugin) createPVC(volumeID, snapName string) (*Volume, error) {
 
 	pvc.Namespace = targetedNs
 
+	// storageclass of the PVC is used for restore request also
+	if pvc.Spec.StorageClassName != nil {
+		targetedSc, err := velero.GetTargetStorageClass(p.K8sClient, *pvc.Spec.StorageClassName)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get storageclass mapping")
+		}
+
+		if targetedSc != *pvc.Spec.StorageClassName {
+			p.Log.Infof("Changing storageclass of PVC=%s/%s %s=>%s", pvc.Namespace, pvc.Name, *pvc.Spec.StorageClassName, targetedSc)
+			pvc.Spec.StorageClassName = &targetedSc
+		}
+	}
+
+	// size is validated before creating the PVC so that shrinking fails without any data transfer.
+	// PVC is created with the size of backup, as the received snapshot has the size of backed-up
+	// volume, and it is expanded once the restore completes.
+	size, err := p.getRestoreSize(pvc, volumeID, snapName)
+	if err != nil {
+		return nil, err
+	}
+
 	newVol, err := p.getVolumeFromPVC(*pvc)
 	if err != nil {
 		return nil, err
@@ -125,6 +108,7 @@ func (p *Plugin) createPVC(volumeID, snapName string) (*Volume, error) {
 	if newVol != nil {
 		newVol.backupName = snapName
 		newVol.snapshotTag = volumeID
+		newVol.restoreSize = size
 		return newVol, nil
 	}
 
@@ -134,6 +118,9 @@ func (p *Plugin) createPVC(volumeID, snapName string) (*Volume, error) {
 	// Add annotation PVCreatedByKey, with value 'restore' to PVC
 	// So that Maya-APIServer skip updating target IPAddress in CVR
 	pvc.Annotations[v1alpha1.PVCreatedByKey] = "restore"
+	// Add annotation PVCRestoredByPluginAnnotation so that restore action
+	// skips the PVC from velero backup
+	pvc.Annotations[velero.PVCRestoredByPluginAnnotation] = snapName
 	rpvc, err := p.K8sClient.
 		CoreV1().
 		PersistentVolumeClaims(pvc.Namespace).
@@ -162,10 +149,12 @@ func (p *Plugin) createPVC(volumeID, snapName string) (*Volume, error) {
 				volname:      pvc.Spec.VolumeName,
 				snapshotTag:  volumeID,
 				namespace:    pvc.Namespace,
+				pvcName:      pvc.Name,
 				backupName:   snapName,
 				storageClass: *pvc.Spec.StorageClassName,
+				size:         pvc.Spec.Resources.Requests[v1.ResourceStorage],
+				restoreSize:  size,
 			}
-			p.volumes[vol.volname] = vol
 			break
 		}
 		time.Sleep(PVCCheckInterval)
@@ -199,6 +188,58 @@ func (p *Plugin) createPVC(volumeID, snapName string) (*Volume, error) {
 	return vol, nil
 }
 
+// getRestoreSize return the size requested for the restore of given PVC, it returns nil
+// if size is not requested or it is same as the PVC size. Restore into a larger volume
+// requires the storageclass to allow volume expansion.
+func (p *Plugin) getRestoreSize(pvc *v1.PersistentVolumeClaim, volumeID, snapName string) (*resource.Quantity, error) {
+	size, err := velero.GetRestoreSize(volumeID, snapName)
+	if err != nil || size == nil {
+		return nil, err
+	}
+
+	srcSize := pvc.Spec.Resources.Requests[v1.ResourceStorage]
+	switch size.Cmp(srcSize) {
+	case -1:
+		return nil, errors.Errorf("restore size %s is less than volume size %s", size.String(), srcSize.String())
+	case 0:
+		return nil, nil
+	}
+
+	if pvc.Spec.StorageClassName == nil {
+		return nil, errors.Errorf("restore size requires the storageclass of PVC=%s/%s", pvc.Namespace, pvc.Name)
+	}
+
+	sc, err := p.K8sClient.StorageV1().StorageClasses().Get(context.TODO(), *pvc.Spec.StorageClassName, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get storageclass %s", *pvc.Spec.StorageClassName)
+	}
+
+	if sc.AllowVolumeExpansion == nil || !*sc.AllowVolumeExpansion {
+		return nil, errors.Errorf("restore size %s requires storageclass %s to allow volume expansion", size.String(), sc.Name)
+	}
+	return size, nil
+}
+
+// expandPVC expands the restored PVC to the requested restore size. Volume is expanded by
+// the CSI driver and the filesystem is grown when the volume is mounted.
+func (p *Plugin) expandPVC(vol *Volume) error {
+	if vol.restoreSize == nil || vol.restoreSize.Cmp(vol.size) <= 0 {
+		return nil
+	}
+
+	p.Log.Infof("Expanding PVC=%s/%s %s=>%s", vol.namespace, vol.pvcName, vol.size.String(), vol.restoreSize.String())
+
+	patch := fmt.Sprintf(`{"spec":{"resources":{"requests":{"storage":"%s"}}}}`, vol.restoreSize.String())
+	_, err := p.K8sClient.
+		CoreV1().
+		PersistentVolumeClaims(vol.namespace).
+		Patch(context.TODO(), vol.pvcName, types.MergePatchType, []byte(patch), metav1.PatchOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "failed to expand PVC=%s/%s to %s", vol.namespace, vol.pvcName, vol.restoreSize.String())
+	}
+	return nil
+}
+
 // getVolumeFromPVC returns volume info for given PVC if PVC is in bound state
 func (p *Plugin) getVolumeFromPVC(pvc v1.PersistentVolumeClaim) (*Volume, error) {
 	rpvc, err := p.K8sClient.
@@ -227,10 +268,11 @@ func (p *Plugin) getVolumeFromPVC(pvc v1.PersistentVolumeClaim) (*Volume, error)
 		volname:      rpvc.Spec.VolumeName,
 		snapshotTag:  rpvc.Spec.VolumeName,
 		namespace:    rpvc.Namespace,
+		pvcName:      rpvc.Name,
 		storageClass: *rpvc.Spec.StorageClassName,
+		size:         rpvc.Spec.Resources.Requests[v1.ResourceStorage],
 		isCSIVolume:  isCSIVolume,
 	}
-	p.volumes[vol.volname] = vol
 
 	if err = p.waitForAllCVRs(vol); err != nil {
 		return nil, errors.Wrapf(err, "cvr not ready")
@@ -249,20 +291,27 @@ func (p *Plugin) getVolumeFromPVC(pvc v1.PersistentVolumeClaim) (*Volume, error)
 	return vol, nil
 }
 
+// downloadPVC return the PVC for given volume from velero backup
+// For backups created without backup action, PVC is read from the backup content
 func (p *Plugin) downloadPVC(volumeID, snapName string) (*v1.PersistentVolumeClaim, error) {
 	pvc := &v1.PersistentVolumeClaim{}
 
-	filename := p.cl.GenerateRemoteFilename(volumeID, snapName)
-
-	data, ok := p.cl.Read(filename + ".pvc")
-	if !ok {
-		return nil, errors.Errorf("failed to download PVC file=%s", filename+".pvc")
+	data, err := velero.GetPVMetadata(snapName, volumeID, velero.PVCMetadataAnnotation)
+	if err == nil {
+		if err = json.Unmarshal(data, pvc); err != nil {
+			return nil, errors.Wrapf(err, "failed to decode pvc for volume=%s from backup=%s", volumeID, snapName)
+		}
+		return pvc, nil
 	}
 
-	if err := json.Unmarshal(data, pvc); err != nil {
-		return nil, errors.Errorf("failed to decode pvc file=%s", filename+".pvc")
+	p.Log.Infof("PVC metadata not found in backup, using PVC from backup content : %s", err.Error())
+
+	pvc, err = velero.GetBackupPVC(snapName, volumeID)
+	if err != nil {
+		return nil, err
 	}
 
+	CleanPVCForBackup(pvc)
 	return pvc, nil
 }
 
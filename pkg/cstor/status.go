@@ -20,36 +20,33 @@ import (
 	"encoding/json"
 	"time"
 
+	apitypes "github.com/openebs/api/v2/pkg/apis/types"
 	"github.com/openebs/maya/pkg/apis/openebs.io/v1alpha1"
+	cloud "github.com/openebs/velero-plugin/pkg/clouduploader"
 )
 
 // checkBackupStatus queries MayaAPI server for given backup status
-// and wait until backup completes
-func (p *Plugin) checkBackupStatus(bkp *v1alpha1.CStorBackup, isCSIVolume bool) {
+// and wait until backup completes. It stops the data server of given connection, once backup completes.
+// Backup status of the volume is updated till done is closed.
+func (p *Plugin) checkBackupStatus(bkp *v1alpha1.CStorBackup, bkpvolume *Volume, cl *cloud.Conn, done chan struct{}) {
 	var (
 		bkpDone bool
 		url     string
 	)
 
-	if isCSIVolume {
+	defer close(done)
+
+	if bkpvolume.isCSIVolume {
 		url = p.cvcAddr + backupEndpoint
 	} else {
 		url = p.mayaAddr + backupEndpoint
 	}
 
-	bkpvolume, exists := p.volumes[bkp.Spec.VolumeName]
-	if !exists {
-		p.Log.Errorf("Failed to fetch volume info for {%s}", bkp.Spec.VolumeName)
-		p.cl.ExitServer = true
-		bkpvolume.backupStatus = v1alpha1.BKPCStorStatusInvalid
-		return
-	}
-
 	bkpData, err := json.Marshal(bkp)
 	if err != nil {
 		p.Log.Errorf("JSON marshal failed : %s", err.Error())
-		p.cl.ExitServer = true
 		bkpvolume.backupStatus = v1alpha1.BKPCStorStatusInvalid
+		cl.SetExitServer(true)
 		return
 	}
 
@@ -70,12 +67,16 @@ func (p *Plugin) checkBackupStatus(bkp *v1alpha1.CStorBackup, isCSIVolume bool)
 		}
 
 		bkpvolume.backupStatus = bs.Status
+		bkpvolume.prevBackupName = bs.Spec.PrevSnapName
+		if uid := backupPoolUID(bs); uid != "" {
+			bkpvolume.backupPoolUID = uid
+		}
 
 		switch bs.Status {
 		case v1alpha1.BKPCStorStatusDone, v1alpha1.BKPCStorStatusFailed, v1alpha1.BKPCStorStatusInvalid:
 			bkpDone = true
-			p.cl.ExitServer = true
-			if err = p.cleanupCompletedBackup(bs, isCSIVolume); err != nil {
+			cl.SetExitServer(true)
+			if err = p.cleanupCompletedBackup(bs, bkpvolume.isCSIVolume); err != nil {
 				p.Log.Warningf("failed to execute clean-up request for backup=%s err=%s", bs.Name, err)
 			}
 		}
@@ -83,13 +84,16 @@ func (p *Plugin) checkBackupStatus(bkp *v1alpha1.CStorBackup, isCSIVolume bool)
 }
 
 // checkRestoreStatus queries MayaAPI server for given restore status
-// and wait until restore completes
-func (p *Plugin) checkRestoreStatus(rst *v1alpha1.CStorRestore, vol *Volume) {
+// and wait until restore completes. It stops the data server of given connection, once restore completes.
+// Restore status of the volume is updated till done is closed.
+func (p *Plugin) checkRestoreStatus(rst *v1alpha1.CStorRestore, vol *Volume, cl *cloud.Conn, done chan struct{}) {
 	var (
 		rstDone bool
 		url     string
 	)
 
+	defer close(done)
+
 	if vol.isCSIVolume {
 		url = p.cvcAddr + restorePath
 	} else {
@@ -100,7 +104,8 @@ func (p *Plugin) checkRestoreStatus(rst *v1alpha1.CStorRestore, vol *Volume) {
 	if err != nil {
 		p.Log.Errorf("JSON marshal failed : %s", err.Error())
 		vol.restoreStatus = v1alpha1.RSTCStorStatusInvalid
-		p.cl.ExitServer = true
+		cl.SetExitServer(true)
+		return
 	}
 
 	for !rstDone {
@@ -124,7 +129,7 @@ func (p *Plugin) checkRestoreStatus(rst *v1alpha1.CStorRestore, vol *Volume) {
 		switch rs.Status {
 		case v1alpha1.RSTCStorStatusDone, v1alpha1.RSTCStorStatusFailed, v1alpha1.RSTCStorStatusInvalid:
 			rstDone = true
-			p.cl.ExitServer = true
+			cl.SetExitServer(true)
 		}
 	}
 }
@@ -173,6 +178,14 @@ func isScheduledBackup(bkp v1alpha1.CStorBackup) bool {
 	return bkp.Spec.SnapName != bkp.Spec.BackupName
 }
 
+// backupPoolUID return the uid of pool, used for the given backup
+func backupPoolUID(bkp v1alpha1.CStorBackup) string {
+	if uid := bkp.Labels[cStorPoolUIDLabel]; uid != "" {
+		return uid
+	}
+	return bkp.Labels[apitypes.CStorPoolInstanceUIDLabelKey]
+}
+
 // isBackupSucceeded returns true if backup completed successfully
 func isBackupSucceeded(bkp v1alpha1.CStorBackup) bool {
 	return bkp.Status == v1alpha1.BKPCStorStatusDone
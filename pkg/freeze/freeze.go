@@ -0,0 +1,422 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package freeze
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/transport/spdy"
+)
+
+const (
+	// AppConsistentMode config key for app-consistent snapshot mode
+	AppConsistentMode = "appConsistentMode"
+
+	// ModeFsfreeze freezes the filesystem of volume, using fsfreeze, in the pod consuming the volume
+	ModeFsfreeze = "fsfreeze"
+
+	// ModeCommand runs the freeze and thaw command, given by pod annotations, in the pod consuming the volume
+	ModeCommand = "command"
+
+	// FreezeTimeout config key for timeout of freeze command
+	FreezeTimeout = "freezeTimeout"
+
+	// ThawTimeout config key for timeout of thaw command
+	ThawTimeout = "thawTimeout"
+
+	// MaxFreezeDuration config key for the maximum duration application is kept frozen.
+	// Application is thawed after it even if the snapshot is not yet created, and the backup fails.
+	MaxFreezeDuration = "maxFreezeDuration"
+
+	// FreezeCommandAnnotation is the pod annotation having the freeze command
+	FreezeCommandAnnotation = "openebs.io/freeze-command"
+
+	// ThawCommandAnnotation is the pod annotation having the thaw command
+	ThawCommandAnnotation = "openebs.io/thaw-command"
+
+	// FreezeContainerAnnotation is the pod annotation having the container to run the freeze and thaw command
+	FreezeContainerAnnotation = "openebs.io/freeze-container"
+
+	// DefaultFreezeTimeout is the default timeout of freeze command
+	DefaultFreezeTimeout = 30 * time.Second
+
+	// DefaultThawTimeout is the default timeout of thaw command
+	DefaultThawTimeout = 30 * time.Second
+
+	// DefaultMaxFreezeDuration is the default maximum duration application is kept frozen
+	DefaultMaxFreezeDuration = 5 * time.Minute
+)
+
+// Freezer freezes the application using the volume, before snapshot
+type Freezer struct {
+	Log logrus.FieldLogger
+
+	k8sClient kubernetes.Interface
+	conf      *rest.Config
+
+	// mode is the app-consistent snapshot mode, empty if disabled
+	mode string
+
+	freezeTimeout     time.Duration
+	thawTimeout       time.Duration
+	maxFreezeDuration time.Duration
+}
+
+// frozenPod is the pod frozen for snapshot
+type frozenPod struct {
+	namespace string
+	name      string
+	container string
+	thawCmd   []string
+}
+
+// NewFreezer return the Freezer configured using the given volumesnapshotlocation config
+func NewFreezer(log logrus.FieldLogger, conf *rest.Config, k8sClient kubernetes.Interface, config map[string]string) (*Freezer, error) {
+	f := &Freezer{
+		Log:               log,
+		conf:              conf,
+		k8sClient:         k8sClient,
+		freezeTimeout:     DefaultFreezeTimeout,
+		thawTimeout:       DefaultThawTimeout,
+		maxFreezeDuration: DefaultMaxFreezeDuration,
+	}
+
+	switch mode := config[AppConsistentMode]; mode {
+	case "":
+		return f, nil
+	case ModeFsfreeze, ModeCommand:
+		f.mode = mode
+	default:
+		return nil, errors.Errorf("invalid %s=%s, valid values are %s or %s", AppConsistentMode, mode, ModeFsfreeze, ModeCommand)
+	}
+
+	if timeout, ok := config[FreezeTimeout]; ok {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse %s", FreezeTimeout)
+		}
+		f.freezeTimeout = d
+	}
+
+	if timeout, ok := config[ThawTimeout]; ok {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse %s", ThawTimeout)
+		}
+		f.thawTimeout = d
+	}
+
+	if duration, ok := config[MaxFreezeDuration]; ok {
+		d, err := time.ParseDuration(duration)
+		if err != nil || d <= 0 {
+			return nil, errors.Errorf("failed to parse %s=%s (expected positive duration)", MaxFreezeDuration, duration)
+		}
+		f.maxFreezeDuration = d
+	}
+
+	return f, nil
+}
+
+// Freeze freezes the pods consuming the given PVC. It returns the function to thaw the frozen pods,
+// which should be called once the snapshot is created. Pods are thawed anyway after maxFreezeDuration,
+// and then the thaw function returns error, as the snapshot is not app-consistent.
+// If any of the pod fails to freeze then already frozen pods are thawed and error is returned.
+func (f *Freezer) Freeze(ns, pvcName string) (func() error, error) {
+	noop := func() error { return nil }
+
+	if f == nil || f.mode == "" {
+		return noop, nil
+	}
+
+	pods, err := f.k8sClient.CoreV1().Pods(ns).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return noop, errors.Wrapf(err, "failed to list pods in namespace %s", ns)
+	}
+
+	var frozen []frozenPod
+	thaw := func() {
+		// thaw in reverse order of freeze
+		for i := len(frozen) - 1; i >= 0; i-- {
+			fp := frozen[i]
+			if err := f.exec(fp.namespace, fp.name, fp.container, fp.thawCmd, f.thawTimeout); err != nil {
+				f.Log.Errorf("Failed to thaw pod %s/%s for PVC %s : %s", fp.namespace, fp.name, pvcName, err.Error())
+				continue
+			}
+			f.Log.Infof("Thawed pod %s/%s for PVC %s", fp.namespace, fp.name, pvcName)
+		}
+	}
+
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Status.Phase != v1.PodRunning {
+			continue
+		}
+
+		container, mountPath, ok := getVolumeContainer(pod, pvcName)
+		if !ok {
+			continue
+		}
+
+		freezeCmd, thawCmd, err := f.getCommands(pod, mountPath)
+		if err != nil {
+			thaw()
+			return noop, err
+		}
+
+		if freezeCmd == nil {
+			f.Log.Warnf("Skipping freeze of pod %s/%s for PVC %s, %s is not set", pod.Namespace, pod.Name, pvcName, FreezeCommandAnnotation)
+			continue
+		}
+
+		if err := f.exec(pod.Namespace, pod.Name, container, freezeCmd, f.freezeTimeout); err != nil {
+			// freeze command may have succeeded partially, thaw it also
+			frozen = append(frozen, frozenPod{pod.Namespace, pod.Name, container, thawCmd})
+			thaw()
+			return noop, errors.Wrapf(err, "failed to freeze pod %s/%s for PVC %s", pod.Namespace, pod.Name, pvcName)
+		}
+
+		f.Log.Infof("Froze pod %s/%s for PVC %s", pod.Namespace, pod.Name, pvcName)
+		frozen = append(frozen, frozenPod{pod.Namespace, pod.Name, container, thawCmd})
+	}
+
+	if len(frozen) == 0 {
+		return noop, nil
+	}
+
+	return thawAfter(f.maxFreezeDuration, thaw, func() {
+		f.Log.Warnf("PVC %s/%s is frozen for %s, thawing it before the snapshot is created", ns, pvcName, f.maxFreezeDuration)
+	}), nil
+}
+
+// thawAfter calls thaw after the given duration, if it is not called before using the returned function.
+// Returned function returns error if thaw was called due to timeout.
+func thawAfter(d time.Duration, thaw func(), expired func()) func() error {
+	var (
+		once   sync.Once
+		done   sync.Once
+		result error
+	)
+
+	timer := time.AfterFunc(d, func() {
+		expired()
+		once.Do(thaw)
+	})
+
+	return func() error {
+		done.Do(func() {
+			if !timer.Stop() {
+				result = errors.Errorf("application was thawed after maxFreezeDuration(%s), before the snapshot is created", d)
+			}
+			once.Do(thaw)
+		})
+		return result
+	}
+}
+
+// getCommands return the freeze and thaw command for the given pod
+func (f *Freezer) getCommands(pod *v1.Pod, mountPath string) ([]string, []string, error) {
+	if f.mode == ModeFsfreeze {
+		if mountPath == "" {
+			return nil, nil, errors.Errorf("fsfreeze is not supported for block volume in pod %s/%s", pod.Namespace, pod.Name)
+		}
+		return []string{"fsfreeze", "--freeze", mountPath}, []string{"fsfreeze", "--unfreeze", mountPath}, nil
+	}
+
+	freezeCmd, err := parseCommand(pod.Annotations[FreezeCommandAnnotation])
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "invalid %s in pod %s/%s", FreezeCommandAnnotation, pod.Namespace, pod.Name)
+	}
+
+	thawCmd, err := parseCommand(pod.Annotations[ThawCommandAnnotation])
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "invalid %s in pod %s/%s", ThawCommandAnnotation, pod.Namespace, pod.Name)
+	}
+
+	if freezeCmd != nil && thawCmd == nil {
+		return nil, nil, errors.Errorf("%s is not set in pod %s/%s", ThawCommandAnnotation, pod.Namespace, pod.Name)
+	}
+	return freezeCmd, thawCmd, nil
+}
+
+// parseCommand parse the command from annotation value, which can be a json array
+// or a string to be executed using shell
+func parseCommand(value string) ([]string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+
+	if !strings.HasPrefix(value, "[") {
+		return []string{"/bin/sh", "-c", value}, nil
+	}
+
+	var cmd []string
+	if err := json.Unmarshal([]byte(value), &cmd); err != nil {
+		return nil, err
+	}
+
+	if len(cmd) == 0 {
+		return nil, errors.New("command is empty")
+	}
+	return cmd, nil
+}
+
+// getVolumeContainer return the container, and mount path, of the given pod using the PVC
+// Mount path is empty for block volume.
+func getVolumeContainer(pod *v1.Pod, pvcName string) (string, string, bool) {
+	var volName string
+	for _, vol := range pod.Spec.Volumes {
+		if vol.PersistentVolumeClaim != nil && vol.PersistentVolumeClaim.ClaimName == pvcName {
+			volName = vol.Name
+			break
+		}
+	}
+
+	if volName == "" {
+		return "", "", false
+	}
+
+	container := pod.Annotations[FreezeContainerAnnotation]
+	for _, c := range pod.Spec.Containers {
+		if container != "" && c.Name != container {
+			continue
+		}
+
+		for _, m := range c.VolumeMounts {
+			if m.Name == volName {
+				return c.Name, m.MountPath, true
+			}
+		}
+
+		for _, d := range c.VolumeDevices {
+			if d.Name == volName {
+				return c.Name, "", true
+			}
+		}
+
+		if container != "" {
+			// container doesn't mount the volume, command can still be executed in it
+			return c.Name, "", true
+		}
+	}
+	return "", "", false
+}
+
+// exec executes the given command in the pod container. Command is cancelled
+// if it doesn't complete within the given timeout.
+func (f *Freezer) exec(ns, pod, container string, cmd []string, timeout time.Duration) error {
+	req := f.k8sClient.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Name(pod).
+		Namespace(ns).
+		SubResource("exec").
+		VersionedParams(&v1.PodExecOptions{
+			Container: container,
+			Command:   cmd,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	transport, upgrader, err := spdy.RoundTripperFor(f.conf)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create transport")
+	}
+
+	executor, err := remotecommand.NewSPDYExecutorForTransports(
+		&contextRoundTripper{RoundTripper: transport, ctx: ctx},
+		&contextUpgrader{Upgrader: upgrader, ctx: ctx},
+		"POST", req.URL(),
+	)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create executor")
+	}
+
+	var stdout, stderr bytes.Buffer
+	errCh := make(chan error, 1)
+
+	go func() {
+		errCh <- executor.Stream(remotecommand.StreamOptions{
+			Stdout: &stdout,
+			Stderr: &stderr,
+		})
+	}()
+
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+		// deferred cancel closes the exec stream, and the stream goroutine returns
+		return errors.Errorf("command %v timed out after %s", cmd, timeout)
+	}
+
+	if err != nil {
+		return errors.Wrapf(err, "command %v failed, stderr: %s", cmd, stderr.String())
+	}
+
+	f.Log.Debugf("Executed command %v in pod %s/%s, stdout: %s", cmd, ns, pod, stdout.String())
+	return nil
+}
+
+// contextRoundTripper sends the exec request with the given context
+type contextRoundTripper struct {
+	http.RoundTripper
+	ctx context.Context
+}
+
+func (c *contextRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return c.RoundTripper.RoundTrip(req.WithContext(c.ctx))
+}
+
+// contextUpgrader closes the exec stream connection when the given context is done.
+// Executor of client-go doesn't support context, closing the connection stops the stream.
+type contextUpgrader struct {
+	spdy.Upgrader
+	ctx context.Context
+}
+
+func (c *contextUpgrader) NewConnection(resp *http.Response) (httpstream.Connection, error) {
+	conn, err := c.Upgrader.NewConnection(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		select {
+		case <-c.ctx.Done():
+			_ = conn.Close()
+		case <-conn.CloseChan():
+		}
+	}()
+	return conn, nil
+}
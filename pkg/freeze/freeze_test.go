@@ -0,0 +1,162 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package freeze
+
+import (
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := map[string]struct {
+		value    string
+		cmd      []string
+		hasError bool
+	}{
+		"empty":             {"", nil, false},
+		"spaces":            {"   ", nil, false},
+		"shell command":     {"mysql -e 'FLUSH TABLES WITH READ LOCK'", []string{"/bin/sh", "-c", "mysql -e 'FLUSH TABLES WITH READ LOCK'"}, false},
+		"trimmed command":   {"  sync  ", []string{"/bin/sh", "-c", "sync"}, false},
+		"json array":        {`["/scripts/pre-backup.sh", "--wait"]`, []string{"/scripts/pre-backup.sh", "--wait"}, false},
+		"empty json array":  {"[]", nil, true},
+		"invalid json":      {`["/scripts/pre-backup.sh"`, nil, true},
+		"json not a string": {`[1, 2]`, nil, true},
+	}
+
+	for name, test := range tests {
+		cmd, err := parseCommand(test.value)
+		if (err != nil) != test.hasError {
+			t.Errorf("%s: unexpected error %v", name, err)
+			continue
+		}
+		if !test.hasError && !reflect.DeepEqual(cmd, test.cmd) {
+			t.Errorf("%s: command is %q, expected %q", name, cmd, test.cmd)
+		}
+	}
+}
+
+func TestNewFreezer(t *testing.T) {
+	tests := map[string]struct {
+		config            map[string]string
+		mode              string
+		maxFreezeDuration time.Duration
+		hasError          bool
+	}{
+		"disabled":              {map[string]string{}, "", DefaultMaxFreezeDuration, false},
+		"fsfreeze":              {map[string]string{AppConsistentMode: ModeFsfreeze}, ModeFsfreeze, DefaultMaxFreezeDuration, false},
+		"command":               {map[string]string{AppConsistentMode: ModeCommand, MaxFreezeDuration: "1m"}, ModeCommand, time.Minute, false},
+		"invalid mode":          {map[string]string{AppConsistentMode: "snapshot"}, "", 0, true},
+		"invalid timeout":       {map[string]string{AppConsistentMode: ModeCommand, FreezeTimeout: "10"}, "", 0, true},
+		"invalid max duration":  {map[string]string{AppConsistentMode: ModeCommand, MaxFreezeDuration: "1h-"}, "", 0, true},
+		"negative max duration": {map[string]string{AppConsistentMode: ModeCommand, MaxFreezeDuration: "-1m"}, "", 0, true},
+	}
+
+	for name, test := range tests {
+		f, err := NewFreezer(logrus.New(), nil, nil, test.config)
+		if (err != nil) != test.hasError {
+			t.Errorf("%s: unexpected error %v", name, err)
+			continue
+		}
+		if test.hasError {
+			continue
+		}
+		if f.mode != test.mode || f.maxFreezeDuration != test.maxFreezeDuration {
+			t.Errorf("%s: mode=%s maxFreezeDuration=%v, expected mode=%s maxFreezeDuration=%v",
+				name, f.mode, f.maxFreezeDuration, test.mode, test.maxFreezeDuration)
+		}
+	}
+}
+
+func TestGetVolumeContainer(t *testing.T) {
+	pod := func(annotations map[string]string) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Annotations: annotations},
+			Spec: v1.PodSpec{
+				Volumes: []v1.Volume{
+					{Name: "data", VolumeSource: v1.VolumeSource{PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: "pvc-data"}}},
+					{Name: "raw", VolumeSource: v1.VolumeSource{PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: "pvc-raw"}}},
+				},
+				Containers: []v1.Container{
+					{Name: "sidecar"},
+					{Name: "db", VolumeMounts: []v1.VolumeMount{{Name: "data", MountPath: "/var/lib/db"}}},
+					{Name: "block", VolumeDevices: []v1.VolumeDevice{{Name: "raw", DevicePath: "/dev/xvda"}}},
+				},
+			},
+		}
+	}
+
+	tests := map[string]struct {
+		pod       *v1.Pod
+		pvc       string
+		container string
+		mountPath string
+		found     bool
+	}{
+		"mounted volume":      {pod(nil), "pvc-data", "db", "/var/lib/db", true},
+		"block volume":        {pod(nil), "pvc-raw", "block", "", true},
+		"other volume":        {pod(nil), "pvc-other", "", "", false},
+		"annotated container": {pod(map[string]string{FreezeContainerAnnotation: "sidecar"}), "pvc-data", "sidecar", "", true},
+		"annotated mounting":  {pod(map[string]string{FreezeContainerAnnotation: "db"}), "pvc-data", "db", "/var/lib/db", true},
+		"missing container":   {pod(map[string]string{FreezeContainerAnnotation: "missing"}), "pvc-data", "", "", false},
+	}
+
+	for name, test := range tests {
+		container, mountPath, found := getVolumeContainer(test.pod, test.pvc)
+		if container != test.container || mountPath != test.mountPath || found != test.found {
+			t.Errorf("%s: got (%s, %s, %v), expected (%s, %s, %v)", name,
+				container, mountPath, found, test.container, test.mountPath, test.found)
+		}
+	}
+}
+
+func TestThawAfter(t *testing.T) {
+	tests := map[string]struct {
+		duration time.Duration
+		wait     time.Duration
+		hasError bool
+	}{
+		"thawed before timeout": {time.Minute, 0, false},
+		"thawed after timeout":  {10 * time.Millisecond, 100 * time.Millisecond, true},
+	}
+
+	for name, test := range tests {
+		var thawed, expired int32
+
+		thaw := thawAfter(test.duration, func() { atomic.AddInt32(&thawed, 1) }, func() { atomic.AddInt32(&expired, 1) })
+		time.Sleep(test.wait)
+
+		// thaw may be called more than once, result doesn't change
+		for i := 0; i < 2; i++ {
+			if err := thaw(); (err != nil) != test.hasError {
+				t.Errorf("%s: unexpected error %v", name, err)
+			}
+		}
+
+		if atomic.LoadInt32(&thawed) != 1 {
+			t.Errorf("%s: thawed %d times, expected once", name, thawed)
+		}
+		if (atomic.LoadInt32(&expired) == 1) != test.hasError {
+			t.Errorf("%s: expired=%d", name, expired)
+		}
+	}
+}
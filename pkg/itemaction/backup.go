@@ -0,0 +1,209 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package itemaction
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/openebs/velero-plugin/pkg/cstor"
+	lvmplugin "github.com/openebs/velero-plugin/pkg/lvm/plugin"
+	"github.com/openebs/velero-plugin/pkg/velero"
+	zfsplugin "github.com/openebs/velero-plugin/pkg/zfs/plugin"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/kuberesource"
+	veleroplugin "github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// ZFSProvider is the name of ZFS-LocalPV volumesnapshotter
+	ZFSProvider = "openebs.io/zfspv-blockstore"
+
+	// LVMProvider is the name of LVM-LocalPV volumesnapshotter
+	LVMProvider = "openebs.io/lvmpv-blockstore"
+)
+
+// BackupAction adds the metadata, required to restore cStor, ZFS-LocalPV and LVM-LocalPV volume,
+// to the PV in velero backup
+type BackupAction struct {
+	Log logrus.FieldLogger
+
+	// K8sClient is used for kubernetes operation
+	K8sClient *kubernetes.Clientset
+
+	// DynClient is used for LVM-LocalPV resources
+	DynClient dynamic.Interface
+}
+
+// NewBackupAction return the BackupAction with initialized clients
+func NewBackupAction(log logrus.FieldLogger) (*BackupAction, error) {
+	conf, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, errors.Wrapf(err, "error fetching cluster config")
+	}
+
+	clientset, err := kubernetes.NewForConfig(conf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating k8s client")
+	}
+
+	dynClient, err := dynamic.NewForConfig(conf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating dynamic client")
+	}
+
+	if err := velero.InitializeClientSet(conf); err != nil {
+		return nil, errors.Wrapf(err, "failed to initialize velero clientSet")
+	}
+
+	return &BackupAction{Log: log, K8sClient: clientset, DynClient: dynClient}, nil
+}
+
+// AppliesTo returns the resources, BackupAction should be executed for
+func (a *BackupAction) AppliesTo() (veleroplugin.ResourceSelector, error) {
+	return veleroplugin.ResourceSelector{
+		IncludedResources: []string{kuberesource.PersistentVolumes.String()},
+	}, nil
+}
+
+// Execute adds the metadata annotation to the cStor, ZFS-LocalPV and LVM-LocalPV PV
+// If PVC can't be fetched then cStor PV is backed up as it is, restore will use the PVC from
+// backup content. ZFS-LocalPV and LVM-LocalPV volume can't be restored without ZFSVolume
+// or LVMVolume, so it fails the backup of PV.
+func (a *BackupAction) Execute(item runtime.Unstructured, backup *velerov1api.Backup) (runtime.Unstructured, []veleroplugin.ResourceIdentifier, error) {
+	var (
+		key        string
+		data       []byte
+		additional []veleroplugin.ResourceIdentifier
+		err        error
+	)
+
+	if backup.Spec.SnapshotVolumes != nil && !*backup.Spec.SnapshotVolumes {
+		return item, nil, nil
+	}
+
+	pv := new(v1.PersistentVolume)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.UnstructuredContent(), pv); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	if pv.Spec.ClaimRef == nil {
+		return item, nil, nil
+	}
+
+	switch {
+	case cstor.IsCStorPV(*pv):
+		key = velero.PVCMetadataAnnotation
+		data, err = a.getPVC(pv)
+		additional = append(additional, veleroplugin.ResourceIdentifier{
+			GroupResource: kuberesource.PersistentVolumeClaims,
+			Namespace:     pv.Spec.ClaimRef.Namespace,
+			Name:          pv.Spec.ClaimRef.Name,
+		})
+	case pv.Spec.CSI != nil && pv.Spec.CSI.Driver == zfsplugin.ZfsDriverName:
+		key = velero.ZFSVolumeMetadataAnnotation
+		data, err = a.getZFSVolume(pv, backup)
+	case pv.Spec.CSI != nil && pv.Spec.CSI.Driver == lvmplugin.LvmDriverName:
+		key = velero.LVMVolumeMetadataAnnotation
+		data, err = a.getLVMVolume(pv, backup)
+	default:
+		return item, nil, nil
+	}
+
+	if err != nil {
+		switch key {
+		case velero.ZFSVolumeMetadataAnnotation:
+			return nil, nil, errors.Wrapf(err, "failed to get zfsvolume for PV{%s}", pv.Name)
+		case velero.LVMVolumeMetadataAnnotation:
+			return nil, nil, errors.Wrapf(err, "failed to get lvmvolume for PV{%s}", pv.Name)
+		}
+		a.Log.Warnf("Failed to get metadata for PV{%s} : %s", pv.Name, err.Error())
+		return item, additional, nil
+	}
+
+	obj := &unstructured.Unstructured{Object: item.UnstructuredContent()}
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[key] = string(data)
+	obj.SetAnnotations(annotations)
+
+	a.Log.Infof("Added %s to PV{%s}", key, pv.Name)
+	return obj, additional, nil
+}
+
+// getPVC return the PVC, of cStor PV, to be created at restore
+func (a *BackupAction) getPVC(pv *v1.PersistentVolume) ([]byte, error) {
+	pvc, err := a.K8sClient.
+		CoreV1().
+		PersistentVolumeClaims(pv.Spec.ClaimRef.Namespace).
+		Get(context.TODO(), pv.Spec.ClaimRef.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get PVC for PV{%s}", pv.Name)
+	}
+
+	cstor.CleanPVCForBackup(pvc)
+	return json.Marshal(pvc)
+}
+
+// getZFSVolume return the ZFSVolume of ZFS-LocalPV PV
+func (a *BackupAction) getZFSVolume(pv *v1.PersistentVolume, backup *velerov1api.Backup) ([]byte, error) {
+	config, err := velero.GetSnapshotLocationConfig(ZFSProvider, backup.Spec.VolumeSnapshotLocations)
+	if err != nil {
+		return nil, err
+	}
+
+	ns, ok := config[zfsplugin.ZfsPvNamespace]
+	if !ok {
+		return nil, errors.New("zfs: namespace not provided for ZFS-LocalPV")
+	}
+
+	vol, err := zfsplugin.GetZFSVolumeForBackup(pv, ns)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(vol)
+}
+
+// getLVMVolume return the LVMVolume of LVM-LocalPV PV
+func (a *BackupAction) getLVMVolume(pv *v1.PersistentVolume, backup *velerov1api.Backup) ([]byte, error) {
+	config, err := velero.GetSnapshotLocationConfig(LVMProvider, backup.Spec.VolumeSnapshotLocations)
+	if err != nil {
+		return nil, err
+	}
+
+	ns, ok := config[lvmplugin.LvmPvNamespace]
+	if !ok {
+		return nil, errors.New("lvm: namespace not provided for LVM-LocalPV")
+	}
+
+	vol, err := lvmplugin.GetLVMVolumeForBackup(a.DynClient, pv, ns)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(vol)
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package itemaction
+
+import (
+	"context"
+
+	"github.com/openebs/velero-plugin/pkg/velero"
+	zfsplugin "github.com/openebs/velero-plugin/pkg/zfs/plugin"
+	"github.com/openebs/zfs-localpv/pkg/builder/volbuilder"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero/pkg/kuberesource"
+	veleroplugin "github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// RestoreAction updates the PV and PVC restored from velero backup
+// - metadata, added by BackupAction, is removed from the PV
+// - node affinity and pool of ZFS-LocalPV PV is set as per the restored ZFSVolume
+// - PVC already created by cStor plugin is skipped
+// StorageClass of PV and PVC is changed by velero change-storage-class action,
+// it is not changed here to avoid applying the mapping twice.
+type RestoreAction struct {
+	Log logrus.FieldLogger
+
+	// K8sClient is used for kubernetes operation
+	K8sClient *kubernetes.Clientset
+}
+
+// NewRestoreAction return the RestoreAction with initialized clients
+func NewRestoreAction(log logrus.FieldLogger) (*RestoreAction, error) {
+	conf, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, errors.Wrapf(err, "error fetching cluster config")
+	}
+
+	clientset, err := kubernetes.NewForConfig(conf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating k8s client")
+	}
+
+	if err := velero.InitializeClientSet(conf); err != nil {
+		return nil, errors.Wrapf(err, "failed to initialize velero clientSet")
+	}
+
+	return &RestoreAction{Log: log, K8sClient: clientset}, nil
+}
+
+// AppliesTo returns the resources, RestoreAction should be executed for
+func (a *RestoreAction) AppliesTo() (veleroplugin.ResourceSelector, error) {
+	return veleroplugin.ResourceSelector{
+		IncludedResources: []string{
+			kuberesource.PersistentVolumes.String(),
+			kuberesource.PersistentVolumeClaims.String(),
+		},
+	}, nil
+}
+
+// Execute performs the restore action for PV and PVC
+func (a *RestoreAction) Execute(input *veleroplugin.RestoreItemActionExecuteInput) (*veleroplugin.RestoreItemActionExecuteOutput, error) {
+	if input.Item.GetObjectKind().GroupVersionKind().Kind == "PersistentVolume" {
+		return a.executePV(input)
+	}
+	return a.executePVC(input)
+}
+
+func (a *RestoreAction) executePV(input *veleroplugin.RestoreItemActionExecuteInput) (*veleroplugin.RestoreItemActionExecuteOutput, error) {
+	pv := new(v1.PersistentVolume)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(input.Item.UnstructuredContent(), pv); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	delete(pv.Annotations, velero.PVCMetadataAnnotation)
+	delete(pv.Annotations, velero.ZFSVolumeMetadataAnnotation)
+	delete(pv.Annotations, velero.LVMVolumeMetadataAnnotation)
+
+	if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == zfsplugin.ZfsDriverName {
+		if err := a.updateZFSPV(pv, input.Restore.Spec.BackupName); err != nil {
+			return nil, err
+		}
+	}
+
+	res, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pv)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return veleroplugin.NewRestoreItemActionExecuteOutput(&unstructured.Unstructured{Object: res}), nil
+}
+
+// updateZFSPV updates the node affinity, pool and capacity of ZFS-LocalPV PV
+// restored from the given backup
+func (a *RestoreAction) updateZFSPV(pv *v1.PersistentVolume, bkpName string) error {
+	backup, err := velero.GetBackup(bkpName)
+	if err != nil {
+		return err
+	}
+
+	config, err := velero.GetSnapshotLocationConfig(ZFSProvider, backup.Spec.VolumeSnapshotLocations)
+	if err != nil {
+		// volume is not restored by plugin
+		a.Log.Warnf("zfs: Skipping topology update for PV{%s} : %s", pv.Name, err.Error())
+		return nil
+	}
+
+	vol, err := volbuilder.NewKubeclient().
+		WithNamespace(config[zfsplugin.ZfsPvNamespace]).
+		Get(pv.Spec.CSI.VolumeHandle, metav1.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			// volume is not restored by plugin
+			return nil
+		}
+		return errors.Wrapf(err, "zfs: failed to fetch volume {%s}", pv.Spec.CSI.VolumeHandle)
+	}
+
+	a.Log.Infof("zfs: Updating PV{%s} with node=%s pool=%s", pv.Name, vol.Spec.OwnerNodeID, vol.Spec.PoolName)
+	zfsplugin.UpdatePVTopology(pv, vol)
+
+	// volume might be restored with larger size
+	size, err := resource.ParseQuantity(vol.Spec.Capacity)
+	if err != nil {
+		return errors.Wrapf(err, "zfs: invalid capacity %s of volume {%s}", vol.Spec.Capacity, vol.Name)
+	}
+
+	if pv.Spec.Capacity == nil {
+		pv.Spec.Capacity = v1.ResourceList{}
+	}
+	pv.Spec.Capacity[v1.ResourceStorage] = size
+	return nil
+}
+
+func (a *RestoreAction) executePVC(input *veleroplugin.RestoreItemActionExecuteInput) (*veleroplugin.RestoreItemActionExecuteOutput, error) {
+	obj := &unstructured.Unstructured{Object: input.Item.UnstructuredContent()}
+
+	ns := obj.GetNamespace()
+	if targetNs, ok := input.Restore.Spec.NamespaceMapping[ns]; ok {
+		ns = targetNs
+	}
+
+	pvc, err := a.K8sClient.
+		CoreV1().
+		PersistentVolumeClaims(ns).
+		Get(context.TODO(), obj.GetName(), metav1.GetOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return nil, errors.Wrapf(err, "failed to get PVC{%s/%s}", ns, obj.GetName())
+	}
+
+	if err == nil && pvc.Annotations[velero.PVCRestoredByPluginAnnotation] == input.Restore.Spec.BackupName {
+		a.Log.Infof("Skipping PVC{%s/%s}, created by plugin", ns, pvc.Name)
+		return veleroplugin.NewRestoreItemActionExecuteOutput(obj).WithoutRestore(), nil
+	}
+
+	return veleroplugin.NewRestoreItemActionExecuteOutput(obj), nil
+}
@@ -0,0 +1,248 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	cloud "github.com/openebs/velero-plugin/pkg/clouduploader"
+	"github.com/openebs/velero-plugin/pkg/mover"
+	"github.com/openebs/velero-plugin/pkg/zfs/utils"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	VeleroBkpKey  = "velero.io/backup"
+	VeleroSchdKey = "velero.io/schedule-name"
+	VeleroVolKey  = "velero.io/volname"
+	VeleroNsKey   = "velero.io/namespace"
+
+	// lvmVolKey is the label of LVMSnapshot having the volume name
+	lvmVolKey = "openebs.io/persistent-volume"
+)
+
+func (p *Plugin) getPV(volumeID string) (*v1.PersistentVolume, error) {
+	return p.K8sClient.
+		CoreV1().
+		PersistentVolumes().
+		Get(context.TODO(), volumeID, metav1.GetOptions{})
+}
+
+func (p *Plugin) getLVMVolume(name string) (*unstructured.Unstructured, error) {
+	return p.dynClient.Resource(lvmVolumeResource).Namespace(p.namespace).
+		Get(context.TODO(), name, metav1.GetOptions{})
+}
+
+// lvmState return the state of LVM-LocalPV resource
+func lvmState(obj *unstructured.Unstructured) string {
+	state, _, _ := unstructured.NestedString(obj.Object, "status", "state")
+	return state
+}
+
+// lvmNode return the owner node of LVMVolume
+func lvmNode(vol *unstructured.Unstructured) string {
+	node, _, _ := unstructured.NestedString(vol.Object, "spec", "ownerNodeID")
+	return node
+}
+
+// lvmDevice return the path of the logical volume on the owner node
+func lvmDevice(vol *unstructured.Unstructured, lvname string) (string, error) {
+	vg, _, _ := unstructured.NestedString(vol.Object, "spec", "volGroup")
+	if vg == "" {
+		return "", errors.Errorf("lvm: volume group not found for volume %s", vol.GetName())
+	}
+	return "/dev/" + vg + "/" + lvname, nil
+}
+
+// lvmCapacity return the capacity, in bytes, of LVMVolume
+func lvmCapacity(vol *unstructured.Unstructured) (int64, error) {
+	capacity, _, _ := unstructured.NestedString(vol.Object, "spec", "capacity")
+	size, err := strconv.ParseInt(capacity, 10, 64)
+	if err != nil {
+		return 0, errors.Errorf("lvm: error parsing the size %s", capacity)
+	}
+	return size, nil
+}
+
+// GetLVMVolumeForBackup return the LVMVolume, from given namespace, for the PV
+func GetLVMVolumeForBackup(dynClient dynamic.Interface, pv *v1.PersistentVolume, ns string) (*unstructured.Unstructured, error) {
+	if pv.Spec.PersistentVolumeSource.CSI == nil {
+		return nil, errors.New("lvm: err not a CSI pv")
+	}
+
+	vol, err := dynClient.Resource(lvmVolumeResource).Namespace(ns).
+		Get(context.TODO(), pv.Spec.PersistentVolumeSource.CSI.VolumeHandle, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	if pv.Spec.ClaimRef == nil {
+		return nil, errors.Errorf("lvm: err pv is not claimed")
+	}
+
+	// add source namespace in the label to filter it at restore time
+	labels := vol.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels[VeleroNsKey] = pv.Spec.ClaimRef.Namespace
+	vol.SetLabels(labels)
+	return vol, nil
+}
+
+// createSnapshot creates the LVMSnapshot of the given volume and waits for it to be ready.
+// Snapshot is created with the size of volume, so that it doesn't get invalidated during the upload.
+func (p *Plugin) createSnapshot(vol *unstructured.Unstructured, name string) error {
+	spec, _, _ := unstructured.NestedMap(vol.Object, "spec")
+
+	snap := &unstructured.Unstructured{}
+	snap.SetAPIVersion(lvmSnapshotResource.GroupVersion().String())
+	snap.SetKind("LVMSnapshot")
+	snap.SetName(name)
+	snap.SetLabels(map[string]string{lvmVolKey: vol.GetName()})
+	snap.Object["spec"] = map[string]interface{}{
+		"ownerNodeId": spec["ownerNodeID"],
+		"volGroup":    spec["volGroup"],
+		"snapSize":    spec["capacity"],
+	}
+	snap.Object["status"] = map[string]interface{}{"state": LvmStatusPending}
+
+	p.Log.Debugf("lvm: creating LVMSnapshot vol = %s snap = %s", vol.GetName(), name)
+
+	_, err := p.dynClient.Resource(lvmSnapshotResource).Namespace(p.namespace).
+		Create(context.TODO(), snap, metav1.CreateOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "lvm: failed to create snapshot %s", name)
+	}
+
+	return p.checkSnapCreation(name)
+}
+
+// checkSnapCreation waits for the LVMSnapshot to be ready, upto lvmStatusTimeout
+func (p *Plugin) checkSnapCreation(name string) error {
+	err := wait.PollImmediate(statusInterval, lvmStatusTimeout, func() (bool, error) {
+		snap, err := p.dynClient.Resource(lvmSnapshotResource).Namespace(p.namespace).
+			Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			p.Log.Errorf("lvm: Failed to fetch snapshot {%s}", name)
+			return false, err
+		}
+
+		switch lvmState(snap) {
+		case LvmStatusReady:
+			return true, nil
+		case LvmStatusFailed:
+			return false, errors.Errorf("lvm: error in creating snapshot %s", name)
+		}
+		return false, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return errors.Errorf("lvm: snapshot %s is not ready in %s", name, lvmStatusTimeout)
+	}
+	return err
+}
+
+// deleteSnapshot deletes the LVMSnapshot created for the upload
+func (p *Plugin) deleteSnapshot(name string) {
+	err := p.dynClient.Resource(lvmSnapshotResource).Namespace(p.namespace).
+		Delete(context.TODO(), name, metav1.DeleteOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		p.Log.Warnf("lvm: Failed to delete the snapshot %s : %s", name, err.Error())
+	}
+}
+
+func (p *Plugin) doBackup(volumeID string, snapname string, schdname string, port int) (string, error) {
+	pv, err := p.getPV(volumeID)
+	if err != nil {
+		p.Log.Errorf("lvm: Failed to get pv %s snap %s schd %s err %v", volumeID, snapname, schdname, err)
+		return "", err
+	}
+
+	vol, err := GetLVMVolumeForBackup(p.dynClient, pv, p.namespace)
+	if err != nil {
+		return "", err
+	}
+
+	filename := p.cl.GenerateRemoteFileWithSchd(volumeID, schdname, snapname)
+	if filename == "" {
+		return "", errors.Errorf("lvm: error creating remote file name for backup")
+	}
+
+	size, err := lvmCapacity(vol)
+	if err != nil {
+		return "", err
+	}
+
+	// name of LVMSnapshot is used as logical volume name by LVM-LocalPV
+	name := utils.GenerateResourceName(vol.GetName(), snapname)
+
+	device, err := lvmDevice(vol, name)
+	if err != nil {
+		return "", err
+	}
+
+	thaw, err := p.freezer.Freeze(pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name)
+	if err != nil {
+		return "", errors.Wrapf(err, "lvm: failed to freeze application")
+	}
+
+	err = p.createSnapshot(vol, name)
+	thawErr := thaw()
+
+	defer p.deleteSnapshot(name)
+
+	if err != nil {
+		p.Log.Errorf("lvm: snapshot failed vol %s snap %s err: %v", volumeID, name, err)
+		return "", err
+	}
+	if thawErr != nil {
+		return "", errors.Wrapf(thawErr, "lvm: snapshot %s is not app-consistent", name)
+	}
+
+	// time of the snapshot, used for point-in-time restore
+	snapTime := time.Now().UTC()
+
+	p.Log.Debugf("lvm: uploading Snapshot %s file %s", snapname, filename)
+
+	err = p.mover.Upload(p.cl, &mover.Transfer{
+		Name:       "lvm-backup",
+		Namespace:  p.namespace,
+		Node:       lvmNode(vol),
+		HostDevice: device,
+		Op:         mover.OpUpload,
+	}, filename, size, port, &cloud.SnapshotManifest{
+		Backup:    snapname,
+		Timestamp: snapTime,
+	})
+	if err != nil {
+		p.Log.Errorf("lvm: backup failed vol %s snap %s err: %v", volumeID, name, err)
+		return "", errors.Wrapf(err, "lvm: failed to upload snapshot %s", name)
+	}
+
+	snapID := utils.GenerateSnapshotID(volumeID, schdname, snapname)
+
+	p.Log.Debugf("lvm: backup done vol %s snap %s snapID %s", volumeID, name, snapID)
+	return snapID, nil
+}
@@ -0,0 +1,323 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"strconv"
+	"time"
+
+	cloud "github.com/openebs/velero-plugin/pkg/clouduploader"
+	"github.com/openebs/velero-plugin/pkg/freeze"
+	"github.com/openebs/velero-plugin/pkg/mover"
+	"github.com/openebs/velero-plugin/pkg/velero"
+	"github.com/openebs/velero-plugin/pkg/zfs/utils"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// LvmPvNamespace config key for OpenEBS namespace
+	LvmPvNamespace = "namespace"
+
+	// LvmDriverName is the LVM-LocalPV csi driver name
+	LvmDriverName = "local.csi.openebs.io"
+
+	// LvmTopologyKey is the node topology key of LVM-LocalPV PV
+	LvmTopologyKey = "openebs.io/nodename"
+
+	// LvmStatusPending is the state of LVM-LocalPV resource yet to be processed
+	LvmStatusPending = "Pending"
+
+	// LvmStatusReady is the state of LVM-LocalPV resource processed successfully
+	LvmStatusReady = "Ready"
+
+	// LvmStatusFailed is the state of LVM-LocalPV resource failed to process
+	LvmStatusFailed = "Failed"
+
+	// LVMRestorePort is the port to connect for restoring the data
+	LVMRestorePort = 9012
+
+	// LVMBackupPort is the port to connect for backup
+	LVMBackupPort = 9013
+
+	// statusInterval is the interval to check the status of LVM-LocalPV resources
+	statusInterval = 5 * time.Second
+
+	// lvmStatusTimeout is the maximum duration to wait for LVM-LocalPV resources to be ready
+	lvmStatusTimeout = 5 * time.Minute
+)
+
+var (
+	// lvmVolumeResource is the LVMVolume resource of LVM-LocalPV
+	lvmVolumeResource = schema.GroupVersionResource{
+		Group:    "local.openebs.io",
+		Version:  "v1alpha1",
+		Resource: "lvmvolumes",
+	}
+
+	// lvmSnapshotResource is the LVMSnapshot resource of LVM-LocalPV
+	lvmSnapshotResource = schema.GroupVersionResource{
+		Group:    "local.openebs.io",
+		Version:  "v1alpha1",
+		Resource: "lvmsnapshots",
+	}
+)
+
+// Plugin is a plugin for containing state for the LVM-LocalPV blockstore
+type Plugin struct {
+	Log logrus.FieldLogger
+
+	// K8sClient is used for kubernetes operation
+	K8sClient *kubernetes.Clientset
+
+	// dynClient is used for LVM-LocalPV resources
+	dynClient dynamic.Interface
+
+	// on this address cloud server will perform data operation(backup/restore)
+	remoteAddr string
+
+	// this is the namespace where all the LVM-LocalPV CRs will be created,
+	// this should be same as what is passed to LVM-LocalPV driver
+	// as env LVM_NAMESPACE while deploying it.
+	namespace string
+
+	// strictVolumeCheck fails the backup of OpenEBS PV which can't be snapshotted
+	strictVolumeCheck bool
+
+	// cl stores cloud connection information
+	cl *cloud.Conn
+
+	// freezer freezes the application, for app-consistent snapshot
+	freezer *freeze.Freezer
+
+	// mover transfers the volume data using helper pod
+	mover *mover.Mover
+}
+
+// Init prepares the VolumeSnapshotter for usage using the provided map of
+// configuration key-value pairs.
+func (p *Plugin) Init(config map[string]string) error {
+	p.Log.Debugf("lvm: Init called %v", config)
+
+	p.remoteAddr, _ = utils.GetServerAddress()
+	if p.remoteAddr == "" {
+		return errors.New("lvm: error fetching Server address")
+	}
+
+	if ns, ok := config[LvmPvNamespace]; ok {
+		p.namespace = ns
+	} else {
+		return errors.New("lvm: namespace not provided for LVM-LocalPV")
+	}
+
+	conf, err := rest.InClusterConfig()
+	if err != nil {
+		p.Log.Errorf("Failed to get cluster config : %s", err.Error())
+		return errors.New("error fetching cluster config")
+	}
+
+	clientset, err := kubernetes.NewForConfig(conf)
+	if err != nil {
+		p.Log.Errorf("Error creating clientset : %s", err.Error())
+		return errors.New("error creating k8s client")
+	}
+	p.K8sClient = clientset
+
+	p.dynClient, err = dynamic.NewForConfig(conf)
+	if err != nil {
+		return errors.Wrapf(err, "lvm: error creating dynamic client")
+	}
+
+	if err := velero.InitializeClientSet(conf); err != nil {
+		return errors.Wrapf(err, "failed to initialize velero clientSet")
+	}
+
+	p.freezer, err = freeze.NewFreezer(p.Log, conf, p.K8sClient, config)
+	if err != nil {
+		return errors.Wrapf(err, "lvm: failed to initialize freezer")
+	}
+
+	if strict, ok := config[velero.StrictVolumeCheck]; ok {
+		p.strictVolumeCheck, err = strconv.ParseBool(strict)
+		if err != nil {
+			return errors.Wrapf(err, "lvm: invalid %s value=%s", velero.StrictVolumeCheck, strict)
+		}
+	}
+
+	p.mover, err = mover.NewMover(p.Log, p.K8sClient, p.remoteAddr, config)
+	if err != nil {
+		return errors.Wrapf(err, "lvm: failed to initialize helper pod config")
+	}
+
+	// data is transferred by helper pod, which doesn't support TLS
+	if secretName, ok := config[cloud.DataTLSSecret]; ok && secretName != "" {
+		return errors.New("lvm: TLS for data server is not supported for LVM-LocalPV")
+	}
+
+	p.cl = &cloud.Conn{Log: p.Log}
+	return p.cl.Init(config)
+}
+
+// CreateVolumeFromSnapshot creates a new volume from the specified snapshot
+func (p *Plugin) CreateVolumeFromSnapshot(snapshotID, volumeType, volumeAZ string, iops *int64) (string, error) {
+	p.Log.Debugf("lvm: CreateVolumeFromSnapshot called snap %s", snapshotID)
+
+	volumeID, err := p.doRestore(snapshotID, LVMRestorePort)
+	if err != nil {
+		p.Log.Errorf("lvm: error CreateVolumeFromSnapshot returning snap %s err %v", snapshotID, err)
+		return "", err
+	}
+
+	p.Log.Infof("lvm: CreateVolumeFromSnapshot returning snap %s vol %s", snapshotID, volumeID)
+	return volumeID, nil
+}
+
+// GetVolumeInfo returns the type and IOPS (if using provisioned IOPS) for
+// the specified volume in the given availability zone.
+func (p *Plugin) GetVolumeInfo(volumeID, volumeAZ string) (string, *int64, error) {
+	return "lvm-localpv", nil, nil
+}
+
+// IsVolumeReady Check if the volume is ready.
+func (p *Plugin) IsVolumeReady(volumeID, volumeAZ string) (ready bool, err error) {
+	vol, err := p.getLVMVolume(volumeID)
+	if err != nil {
+		return false, err
+	}
+	return lvmState(vol) == LvmStatusReady, nil
+}
+
+// CreateSnapshot creates a snapshot of the specified volume, and uploads it to cloud storage
+func (p *Plugin) CreateSnapshot(volumeID, volumeAZ string, tags map[string]string) (string, error) {
+	p.Log.Debugf("lvm: CreateSnapshot called", volumeID, volumeAZ, tags)
+
+	bkpname, ok := tags[VeleroBkpKey]
+	if !ok {
+		return "", errors.New("lvm: error get backup name")
+	}
+
+	// backups are full backups, schedule is used only for the remote file path
+	schdname := tags[VeleroSchdKey]
+
+	snapshotID, err := p.doBackup(volumeID, bkpname, schdname, LVMBackupPort)
+	if err != nil {
+		p.Log.Errorf("lvm: error createBackup %s@%s failed %v", volumeID, bkpname, err)
+		return "", err
+	}
+
+	p.Log.Infof("lvm: CreateSnapshot returning %s", snapshotID)
+	return snapshotID, nil
+}
+
+// DeleteSnapshot deletes the specified volume snapshot from cloud storage
+func (p *Plugin) DeleteSnapshot(snapshotID string) error {
+	p.Log.Debugf("lvm: DeleteSnapshot called %s", snapshotID)
+	if snapshotID == "" {
+		p.Log.Warning("lvm: Empty snapshotID")
+		return nil
+	}
+
+	return mover.DeleteBackup(p.cl, snapshotID)
+}
+
+// GetVolumeID returns the specific identifier for the PersistentVolume.
+func (p *Plugin) GetVolumeID(unstructuredPV runtime.Unstructured) (string, error) {
+	pv := new(v1.PersistentVolume)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(unstructuredPV.UnstructuredContent(), pv); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	// If PV doesn't have sufficient info to consider as LVM-LocalPV Volume
+	// then we will return empty volumeId and error as nil, unless strict check is enabled.
+	if reason := velero.MissingPVInfo(pv); reason != "" {
+		return "", velero.SkipVolume(p.Log, pv, reason, p.strictVolumeCheck)
+	}
+
+	// check if PV is created by LVM driver
+	if pv.Spec.CSI == nil ||
+		pv.Spec.CSI.Driver != LvmDriverName {
+		return "", velero.SkipVolume(p.Log, pv, velero.SkipOtherEngine, p.strictVolumeCheck)
+	}
+
+	if pv.Status.Phase == v1.VolumeReleased ||
+		pv.Status.Phase == v1.VolumeFailed {
+		return "", errors.New("pv is in released state")
+	}
+
+	return pv.Name, nil
+}
+
+// SetVolumeID sets the specific identifier for the PersistentVolume.
+// Node affinity and capacity of the PV are updated as per the restored LVMVolume.
+func (p *Plugin) SetVolumeID(unstructuredPV runtime.Unstructured, volumeID string) (runtime.Unstructured, error) {
+	pv := new(v1.PersistentVolume)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(unstructuredPV.UnstructuredContent(), pv); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	vol, err := p.getLVMVolume(volumeID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set the PV Name and VolumeHandle
+	pv.Name = volumeID
+	pv.Spec.PersistentVolumeSource.CSI.VolumeHandle = volumeID
+	updatePVNode(pv, lvmNode(vol))
+
+	// volume might be restored with larger size
+	size, err := lvmCapacity(vol)
+	if err != nil {
+		return nil, err
+	}
+
+	if pv.Spec.Capacity == nil {
+		pv.Spec.Capacity = v1.ResourceList{}
+	}
+	pv.Spec.Capacity[v1.ResourceStorage] = *resource.NewQuantity(size, resource.BinarySI)
+
+	res, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pv)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &unstructured.Unstructured{Object: res}, nil
+}
+
+// updatePVNode sets the node affinity of the PV to the given node
+func updatePVNode(pv *v1.PersistentVolume, node string) {
+	if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+		return
+	}
+
+	for i := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+		term := &pv.Spec.NodeAffinity.Required.NodeSelectorTerms[i]
+		for j := range term.MatchExpressions {
+			if term.MatchExpressions[j].Key == LvmTopologyKey {
+				term.MatchExpressions[j].Values = []string{node}
+			}
+		}
+	}
+}
@@ -0,0 +1,250 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+
+	"github.com/openebs/velero-plugin/pkg/mover"
+	"github.com/openebs/velero-plugin/pkg/velero"
+	"github.com/openebs/velero-plugin/pkg/zfs/utils"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// getBackupLVMVolume return the LVMVolume of given volume from velero backup content
+func (p *Plugin) getBackupLVMVolume(pvname, bkpname string) (*unstructured.Unstructured, error) {
+	data, err := velero.GetPVMetadata(bkpname, pvname, velero.LVMVolumeMetadataAnnotation)
+	if err != nil {
+		return nil, errors.Wrapf(err, "lvm: failed to get lvmvolume %s from backup %s", pvname, bkpname)
+	}
+
+	vol := &unstructured.Unstructured{}
+	if err := json.Unmarshal(data, &vol.Object); err != nil {
+		return nil, errors.Wrapf(err, "lvm: failed to decode lvmvolume %s from backup %s", pvname, bkpname)
+	}
+	return vol, nil
+}
+
+func (p *Plugin) buildLVMVolume(pvname, bkpname string, bkpVol *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	// get the target namespace
+	ns, err := velero.GetRestoreNamespace(bkpVol.GetLabels()[VeleroNsKey], bkpname, p.Log)
+	if err != nil {
+		p.Log.Errorf("lvm: failed to get target ns for pv=%s, bkpname=%s err: %v", pvname, bkpname, err)
+		return nil, err
+	}
+
+	if err := p.checkRestored(pvname, ns, bkpname); err != nil {
+		return nil, err
+	}
+
+	name, err := p.getRestoreVolName(pvname)
+	if err != nil {
+		return nil, err
+	}
+
+	spec, _, _ := unstructured.NestedMap(bkpVol.Object, "spec")
+	if spec == nil {
+		return nil, errors.Errorf("lvm: spec not found for volume %s", pvname)
+	}
+
+	// get the target node
+	node, _ := spec["ownerNodeID"].(string)
+	tnode, err := velero.GetTargetNode(p.K8sClient, node)
+	if err != nil {
+		return nil, err
+	}
+
+	p.Log.Debugf("lvm: GetTargetNode node %s=>%s", node, tnode)
+	spec["ownerNodeID"] = tnode
+
+	size, err := velero.GetRestoreSize(pvname, bkpname)
+	if err != nil {
+		return nil, err
+	}
+
+	if size != nil {
+		pv, err := velero.GetBackupPV(bkpname, pvname)
+		if err != nil {
+			return nil, errors.Wrapf(err, "lvm: failed to get pv %s from backup %s", pvname, bkpname)
+		}
+
+		capacity, err := restoreCapacity(pvname, bkpVol, pv.Spec.VolumeMode, size)
+		if err != nil {
+			return nil, err
+		}
+
+		p.Log.Debugf("lvm: restore size %s=>%s", spec["capacity"], capacity)
+		spec["capacity"] = capacity
+	}
+
+	rVol := &unstructured.Unstructured{}
+	rVol.SetAPIVersion(lvmVolumeResource.GroupVersion().String())
+	rVol.SetKind("LVMVolume")
+	rVol.SetName(name)
+
+	// add original volume and namespace in the label
+	rVol.SetLabels(map[string]string{VeleroVolKey: pvname, VeleroNsKey: ns})
+	rVol.SetAnnotations(map[string]string{VeleroBkpKey: bkpname})
+	rVol.Object["spec"] = spec
+	rVol.Object["status"] = map[string]interface{}{"state": LvmStatusPending}
+
+	return rVol, nil
+}
+
+// restoreCapacity return the capacity of given volume to be restored with the given size.
+// Filesystem isn't grown by the restore, so it fails for filesystem mode volume if the given size is larger.
+func restoreCapacity(pvname string, vol *unstructured.Unstructured, mode *v1.PersistentVolumeMode, size *resource.Quantity) (string, error) {
+	srcSize, err := lvmCapacity(vol)
+	if err != nil {
+		return "", err
+	}
+
+	if size.Value() < srcSize {
+		return "", errors.Errorf("lvm: restore size %s is less than volume size %d", size.String(), srcSize)
+	}
+
+	if size.Value() > srcSize && (mode == nil || *mode != v1.PersistentVolumeBlock) {
+		return "", errors.Errorf("lvm: restore size is supported only for block mode volume, expand the PVC of %s after restore", pvname)
+	}
+	return strconv.FormatInt(size.Value(), 10), nil
+}
+
+// checkRestored returns error if the given volume has already been restored in the namespace
+func (p *Plugin) checkRestored(pvname, ns, bkpname string) error {
+	filter := metav1.ListOptions{
+		LabelSelector: VeleroVolKey + "=" + pvname + "," + VeleroNsKey + "=" + ns,
+	}
+
+	volList, err := p.dynClient.Resource(lvmVolumeResource).Namespace(p.namespace).
+		List(context.TODO(), filter)
+	if err != nil {
+		p.Log.Errorf("lvm: failed to get source volume failed vol %s snap %s err: %v", pvname, bkpname, err)
+		return err
+	}
+
+	if len(volList.Items) > 0 {
+		return errors.Errorf("lvm: err pv %s has already been restored bkpname %s", pvname, bkpname)
+	}
+	return nil
+}
+
+// getRestoreVolName return the name of volume to be restored for the given pv
+func (p *Plugin) getRestoreVolName(pvname string) (string, error) {
+	// hack(https://github.com/vmware-tanzu/velero/pull/2835): generate a new uuid only if PV exist
+	pv, err := p.getPV(pvname)
+
+	if err == nil && pv != nil {
+		rvol, err := utils.GetRestorePVName()
+		if err != nil {
+			return "", errors.Errorf("lvm: failed to get restore vol name for %s", pvname)
+		}
+		return rvol, nil
+	}
+	return pvname, nil
+}
+
+// createLVMVolume creates the LVMVolume and return it once it is ready, upto lvmStatusTimeout
+func (p *Plugin) createLVMVolume(rVol *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	_, err := p.dynClient.Resource(lvmVolumeResource).Namespace(p.namespace).
+		Create(context.TODO(), rVol, metav1.CreateOptions{})
+	if err != nil {
+		p.Log.Errorf("lvm: create LVMVolume failed vol %s err: %v", rVol.GetName(), err)
+		return nil, err
+	}
+
+	var vol *unstructured.Unstructured
+	err = wait.PollImmediate(statusInterval, lvmStatusTimeout, func() (bool, error) {
+		vol, err = p.getLVMVolume(rVol.GetName())
+		if err != nil {
+			p.Log.Errorf("lvm: Failed to fetch volume {%s}", rVol.GetName())
+			return false, err
+		}
+
+		switch lvmState(vol) {
+		case LvmStatusReady:
+			return true, nil
+		case LvmStatusFailed:
+			return false, errors.Errorf("lvm: error in creating volume %s", rVol.GetName())
+		}
+		return false, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return nil, errors.Errorf("lvm: volume %s is not ready in %s", rVol.GetName(), lvmStatusTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return vol, nil
+}
+
+// dataRestore downloads the uploaded snapshot to the given volume
+func (p *Plugin) dataRestore(vol *unstructured.Unstructured, filename string, port int) error {
+	device, err := lvmDevice(vol, vol.GetName())
+	if err != nil {
+		return err
+	}
+
+	return p.mover.Download(p.cl, &mover.Transfer{
+		Name:       "lvm-restore",
+		Namespace:  p.namespace,
+		Node:       lvmNode(vol),
+		HostDevice: device,
+		Op:         mover.OpDownload,
+	}, filename, port)
+}
+
+func (p *Plugin) doRestore(snapshotID string, port int) (string, error) {
+	pvname, schdname, bkpname, err := utils.GetInfoFromSnapshotID(snapshotID)
+	if err != nil {
+		return "", err
+	}
+
+	filename := p.cl.GenerateRemoteFileWithSchd(pvname, schdname, bkpname)
+	if filename == "" {
+		return "", errors.Errorf("lvm: Error creating remote file name for restore")
+	}
+
+	bkpVol, err := p.getBackupLVMVolume(pvname, bkpname)
+	if err != nil {
+		return "", err
+	}
+
+	rVol, err := p.buildLVMVolume(pvname, bkpname, bkpVol)
+	if err != nil {
+		return "", err
+	}
+
+	vol, err := p.createLVMVolume(rVol)
+	if err != nil {
+		return "", err
+	}
+
+	if err := p.dataRestore(vol, filename, port); err != nil {
+		p.Log.Errorf("lvm: restore failed vol %s snap %s err: %v", pvname, bkpname, err)
+		return "", err
+	}
+
+	p.Log.Debugf("lvm: restore done vol %s => %s bkp %s", pvname, vol.GetName(), bkpname)
+	return vol.GetName(), nil
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynfake "k8s.io/client-go/dynamic/fake"
+)
+
+func newTestLVMVolume(name, node, capacity string) *unstructured.Unstructured {
+	vol := &unstructured.Unstructured{}
+	vol.SetAPIVersion(lvmVolumeResource.GroupVersion().String())
+	vol.SetKind("LVMVolume")
+	vol.SetNamespace("openebs")
+	vol.SetName(name)
+	vol.Object["spec"] = map[string]interface{}{
+		"ownerNodeID": node,
+		"volGroup":    "lvmvg",
+		"capacity":    capacity,
+	}
+	return vol
+}
+
+func TestRestoreCapacity(t *testing.T) {
+	blockMode := v1.PersistentVolumeBlock
+	fsMode := v1.PersistentVolumeFilesystem
+
+	tests := map[string]struct {
+		mode     *v1.PersistentVolumeMode
+		size     string
+		expected string
+		hasError bool
+	}{
+		"same size":              {mode: &fsMode, size: "1Gi", expected: "1073741824"},
+		"block larger size":      {mode: &blockMode, size: "2Gi", expected: "2147483648"},
+		"filesystem larger size": {mode: &fsMode, size: "2Gi", hasError: true},
+		"default mode larger":    {mode: nil, size: "2Gi", hasError: true},
+		"smaller size":           {mode: &blockMode, size: "512Mi", hasError: true},
+	}
+
+	for name, test := range tests {
+		size := resource.MustParse(test.size)
+		capacity, err := restoreCapacity("pv-1", newTestLVMVolume("pv-1", "node-1", "1073741824"), test.mode, &size)
+		if (err != nil) != test.hasError {
+			t.Errorf("%s: unexpected error %v", name, err)
+			continue
+		}
+		if capacity != test.expected {
+			t.Errorf("%s: got capacity %s, expected %s", name, capacity, test.expected)
+		}
+	}
+}
+
+func TestSetVolumeID(t *testing.T) {
+	p := &Plugin{
+		Log:       logrus.New(),
+		namespace: "openebs",
+		dynClient: dynfake.NewSimpleDynamicClient(runtime.NewScheme(),
+			newTestLVMVolume("restored-1", "node-2", "2147483648"),
+		),
+	}
+
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+		Spec: v1.PersistentVolumeSpec{
+			Capacity: v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Gi")},
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: LvmDriverName, VolumeHandle: "pv-1"},
+			},
+			NodeAffinity: &v1.VolumeNodeAffinity{
+				Required: &v1.NodeSelector{
+					NodeSelectorTerms: []v1.NodeSelectorTerm{{
+						MatchExpressions: []v1.NodeSelectorRequirement{{
+							Key: LvmTopologyKey, Operator: v1.NodeSelectorOpIn, Values: []string{"node-1"},
+						}},
+					}},
+				},
+			},
+		},
+	}
+
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pv)
+	if err != nil {
+		t.Fatalf("failed to convert pv : %v", err)
+	}
+
+	res, err := p.SetVolumeID(&unstructured.Unstructured{Object: obj}, "restored-1")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	rpv := new(v1.PersistentVolume)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(res.UnstructuredContent(), rpv); err != nil {
+		t.Fatalf("failed to convert pv : %v", err)
+	}
+
+	if rpv.Name != "restored-1" || rpv.Spec.CSI.VolumeHandle != "restored-1" {
+		t.Errorf("got volume %s/%s, expected restored-1", rpv.Name, rpv.Spec.CSI.VolumeHandle)
+	}
+
+	if node := rpv.Spec.NodeAffinity.Required.NodeSelectorTerms[0].MatchExpressions[0].Values[0]; node != "node-2" {
+		t.Errorf("got node %s, expected node-2", node)
+	}
+
+	size := rpv.Spec.Capacity[v1.ResourceStorage]
+	if expected := resource.MustParse("2Gi"); size.Cmp(expected) != 0 {
+		t.Errorf("got capacity %s, expected %s", size.String(), expected.String())
+	}
+}
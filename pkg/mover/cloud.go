@@ -0,0 +1,129 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mover
+
+import (
+	"strconv"
+	"sync"
+
+	cloud "github.com/openebs/velero-plugin/pkg/clouduploader"
+	"github.com/openebs/velero-plugin/pkg/zfs/utils"
+	"github.com/pkg/errors"
+)
+
+// Upload starts the data server to upload the volume data to the given remote file and runs
+// the helper pod for the transfer. Manifest is written, with the size of uploaded object,
+// once the upload completes.
+func (m *Mover) Upload(cl *cloud.Conn, t *Transfer, filename string, size int64, port int, manifest *cloud.SnapshotManifest) error {
+	uploaded := false
+
+	err := m.transfer(cl, t, port, func() bool {
+		uploaded = cl.Upload(filename, size, port)
+		return uploaded
+	})
+	if err != nil {
+		return err
+	}
+
+	if !uploaded {
+		return errors.Errorf("failed to upload snapshot %s", filename)
+	}
+
+	bkpSize, err := cl.ObjectSize(filename)
+	if err != nil {
+		m.Log.Warnf("Failed to get size of uploaded snapshot %s : %s", filename, err.Error())
+	}
+
+	manifest.Size = bkpSize
+	return cl.WriteManifest(filename, manifest)
+}
+
+// Download starts the data server to download the given remote file and runs the helper pod
+// to write it to the volume
+func (m *Mover) Download(cl *cloud.Conn, t *Transfer, filename string, port int) error {
+	return m.transfer(cl, t, port, func() bool {
+		return cl.Download(filename, port)
+	})
+}
+
+// transfer runs the given data server operation, and the helper pod connecting to it.
+// It returns once the data server exits.
+func (m *Mover) transfer(cl *cloud.Conn, t *Transfer, port int, serve func() bool) error {
+	// reset the connection state
+	cl.ConnStateReset()
+
+	if err := cl.GenerateTransferToken(); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		if !serve() {
+			m.Log.Errorf("Failed to %s the volume data", t.Op)
+			*cl.ConnReady <- false
+		}
+		// done with the channel, close it
+		close(*cl.ConnReady)
+	}()
+
+	// wait for the data server to exit
+	defer func() {
+		cl.SetExitServer(true)
+		wg.Wait()
+		cl.ConnReady = nil
+	}()
+
+	// wait for the connection to be ready
+	if ok := cl.ConnReadyWait(); !ok {
+		return errors.Errorf("data server is not ready to %s the volume data", t.Op)
+	}
+
+	t.Server = m.ServerAddr + ":" + strconv.Itoa(port)
+	t.Annotations = cl.RemoteAnnotations()
+
+	if err := m.Run(t); err != nil {
+		return err
+	}
+
+	// wait for the transfer to finish
+	cl.SetExitServer(true)
+	wg.Wait()
+	return nil
+}
+
+// DeleteBackup deletes the snapshot, uploaded by helper pod, and its manifest from cloud storage
+func DeleteBackup(cl *cloud.Conn, snapshotID string) error {
+	pvname, schdname, bkpname, err := utils.GetInfoFromSnapshotID(snapshotID)
+	if err != nil {
+		return err
+	}
+
+	filename := cl.GenerateRemoteFileWithSchd(pvname, schdname, bkpname)
+	if filename == "" {
+		return errors.Errorf("error creating remote file name for delete")
+	}
+
+	if ok := cl.Delete(filename); !ok {
+		return errors.Errorf("failed to delete snapshot %s", snapshotID)
+	}
+
+	return cl.DeleteManifest(filename)
+}
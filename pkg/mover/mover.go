@@ -0,0 +1,309 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mover
+
+import (
+	"context"
+	"time"
+
+	cloud "github.com/openebs/velero-plugin/pkg/clouduploader"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// HelperImage config key for the image of helper pod transferring the volume data.
+	// Image must have sh and socat.
+	HelperImage = "helperImage"
+
+	// DefaultHelperImage is the default image of helper pod
+	DefaultHelperImage = "alpine/socat:1.7.4.1-r1"
+
+	// HelperStartTimeout config key for the maximum duration helper pod can be pending
+	HelperStartTimeout = "helperStartTimeout"
+
+	// DefaultHelperStartTimeout is the default maximum duration helper pod can be pending
+	DefaultHelperStartTimeout = 10 * time.Minute
+
+	// HelperTimeout config key for the maximum duration of the data transfer by helper pod
+	HelperTimeout = "helperTimeout"
+
+	// DefaultHelperTimeout is the default maximum duration of the data transfer by helper pod
+	DefaultHelperTimeout = 24 * time.Hour
+
+	// HelperPodLabel is set on the helper pods created by plugin
+	HelperPodLabel = "openebs.io/velero-helper"
+
+	// helperStatusInterval is the interval to check the status of helper pod
+	helperStatusInterval = 5 * time.Second
+
+	// devicePath is the path of the volume device in helper pod
+	devicePath = "/dev/xfer"
+
+	// helperContainer is the name of container in helper pod
+	helperContainer = "mover"
+)
+
+// Operation is the data transfer operation of helper pod
+type Operation string
+
+const (
+	// OpUpload reads the device and sends it to the data server
+	OpUpload Operation = "upload"
+
+	// OpDownload receives the data from data server and writes it to the device
+	OpDownload Operation = "download"
+)
+
+// Mover transfers the data of block device between node and the plugin data server, using helper pod
+type Mover struct {
+	Log logrus.FieldLogger
+
+	K8sClient kubernetes.Interface
+
+	// Image of helper pod
+	Image string
+
+	// ServerAddr is the address of plugin data server, helper pod connects to it
+	ServerAddr string
+
+	// StartTimeout is the maximum duration helper pod can be pending
+	StartTimeout time.Duration
+
+	// Timeout is the maximum duration of the data transfer by helper pod
+	Timeout time.Duration
+}
+
+// Transfer describes the data transfer done by helper pod
+type Transfer struct {
+	// Name is the prefix for the name of helper pod
+	Name string
+
+	// Namespace of helper pod
+	Namespace string
+
+	// Node to run the helper pod, if empty then pod is scheduled by kubernetes
+	Node string
+
+	// Volume having the device. If HostDevice is set, then hostPath volume is used.
+	Volume *v1.Volume
+
+	// HostDevice is the path of device on the node
+	HostDevice string
+
+	// Op is the transfer operation
+	Op Operation
+
+	// Server is the address, ip:port, of the data server. It is set by Upload and Download.
+	Server string
+
+	// Annotations are the remote annotations of data server connection. It is set by Upload and Download.
+	Annotations map[string]string
+
+	// Check, if set, is called while the helper pod is pending. Transfer fails if it returns error,
+	// like when the volume of helper pod can't be provisioned.
+	Check func() error
+}
+
+// imagePullFailures are the waiting reasons of helper container, for which helper pod can't be started
+var imagePullFailures = map[string]bool{
+	"ErrImagePull":     true,
+	"ImagePullBackOff": true,
+	"InvalidImageName": true,
+}
+
+// NewMover return the Mover configured using the given volumesnapshotlocation config
+func NewMover(log logrus.FieldLogger, k8sClient kubernetes.Interface, serverAddr string, config map[string]string) (*Mover, error) {
+	m := &Mover{
+		Log:          log,
+		K8sClient:    k8sClient,
+		Image:        DefaultHelperImage,
+		ServerAddr:   serverAddr,
+		StartTimeout: DefaultHelperStartTimeout,
+		Timeout:      DefaultHelperTimeout,
+	}
+
+	if image := config[HelperImage]; image != "" {
+		m.Image = image
+	}
+
+	if timeout, ok := config[HelperStartTimeout]; ok {
+		d, err := time.ParseDuration(timeout)
+		if err != nil || d <= 0 {
+			return nil, errors.Errorf("failed to parse %s=%s (expected positive duration)", HelperStartTimeout, timeout)
+		}
+		m.StartTimeout = d
+	}
+
+	if timeout, ok := config[HelperTimeout]; ok {
+		d, err := time.ParseDuration(timeout)
+		if err != nil || d <= 0 {
+			return nil, errors.Errorf("failed to parse %s=%s (expected positive duration)", HelperTimeout, timeout)
+		}
+		m.Timeout = d
+	}
+	return m, nil
+}
+
+// Run creates the helper pod for the given transfer and waits for its completion.
+// Helper pod is deleted once it completes.
+func (m *Mover) Run(t *Transfer) error {
+	if t.Annotations[cloud.DataTLSAnnotation] != "" {
+		return errors.New("TLS for data server is not supported by helper pod")
+	}
+
+	pod := m.buildPod(t)
+
+	pod, err := m.K8sClient.CoreV1().Pods(t.Namespace).Create(context.TODO(), pod, metav1.CreateOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "failed to create helper pod %s/%s", t.Namespace, t.Name)
+	}
+
+	defer func() {
+		err := m.K8sClient.CoreV1().Pods(pod.Namespace).Delete(context.TODO(), pod.Name, metav1.DeleteOptions{})
+		if err != nil && !k8serrors.IsNotFound(err) {
+			m.Log.Warnf("Failed to delete helper pod %s/%s : %s", pod.Namespace, pod.Name, err.Error())
+		}
+	}()
+
+	m.Log.Infof("Helper pod %s/%s created to %s the volume data", pod.Namespace, pod.Name, t.Op)
+	return m.waitForCompletion(pod.Namespace, pod.Name, t.Check)
+}
+
+// waitForCompletion waits for the helper pod to complete, upto Timeout. It fails if helper pod
+// is pending for more than StartTimeout or its image can't be pulled.
+func (m *Mover) waitForCompletion(ns, name string, check func() error) error {
+	start := time.Now()
+
+	err := wait.PollImmediate(helperStatusInterval, m.Timeout, func() (bool, error) {
+		pod, err := m.K8sClient.CoreV1().Pods(ns).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to fetch helper pod %s/%s", ns, name)
+		}
+
+		switch pod.Status.Phase {
+		case v1.PodSucceeded:
+			return true, nil
+		case v1.PodFailed:
+			return false, errors.Errorf("helper pod %s/%s failed : %s", ns, name, terminationMessage(pod))
+		case v1.PodPending:
+			if reason, msg := waitingReason(pod); imagePullFailures[reason] {
+				return false, errors.Errorf("helper pod %s/%s can't pull image %s : %s %s", ns, name, m.Image, reason, msg)
+			}
+
+			if check != nil {
+				if err := check(); err != nil {
+					return false, errors.Wrapf(err, "helper pod %s/%s can't be started", ns, name)
+				}
+			}
+
+			if time.Since(start) > m.StartTimeout {
+				return false, errors.Errorf("helper pod %s/%s is pending for more than %s : %s", ns, name, m.StartTimeout, pod.Status.Message)
+			}
+		}
+		return false, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return errors.Errorf("helper pod %s/%s didn't complete in %s", ns, name, m.Timeout)
+	}
+	return err
+}
+
+// waitingReason return the reason and message of helper container, if it is waiting
+func waitingReason(pod *v1.Pod) (string, string) {
+	for _, s := range pod.Status.ContainerStatuses {
+		if s.Name == helperContainer && s.State.Waiting != nil {
+			return s.State.Waiting.Reason, s.State.Waiting.Message
+		}
+	}
+	return "", ""
+}
+
+// terminationMessage return the termination message of helper container
+func terminationMessage(pod *v1.Pod) string {
+	for _, s := range pod.Status.ContainerStatuses {
+		if s.Name == helperContainer && s.State.Terminated != nil {
+			return s.State.Terminated.Message
+		}
+	}
+	return pod.Status.Message
+}
+
+// command return the shell command of helper pod for the given operation.
+// Transfer token, if any, is sent before the data.
+func command(op Operation) string {
+	if op == OpUpload {
+		return `{ printf '%s' "$TOKEN"; cat ` + devicePath + `; } | socat -u - TCP:$SERVER`
+	}
+	// keep the connection open for writing, server closes it once data is sent
+	return `printf '%s' "$TOKEN" | socat -t 2147483647 - TCP:$SERVER,shut-none > ` + devicePath
+}
+
+func (m *Mover) buildPod(t *Transfer) *v1.Pod {
+	privileged := true
+	volume := v1.Volume{Name: "device"}
+
+	if t.HostDevice != "" {
+		hostPathType := v1.HostPathBlockDev
+		volume.VolumeSource = v1.VolumeSource{
+			HostPath: &v1.HostPathVolumeSource{
+				Path: t.HostDevice,
+				Type: &hostPathType,
+			},
+		}
+	} else {
+		volume.VolumeSource = t.Volume.VolumeSource
+	}
+
+	container := v1.Container{
+		Name:    helperContainer,
+		Image:   m.Image,
+		Command: []string{"/bin/sh", "-c", command(t.Op)},
+		Env: []v1.EnvVar{
+			{Name: "SERVER", Value: t.Server},
+			{Name: "TOKEN", Value: t.Annotations[cloud.DataTransferTokenAnnotation]},
+		},
+		TerminationMessagePolicy: v1.TerminationMessageFallbackToLogsOnError,
+	}
+
+	if t.HostDevice != "" {
+		// device from host is accessed as a file
+		container.SecurityContext = &v1.SecurityContext{Privileged: &privileged}
+		container.VolumeMounts = []v1.VolumeMount{{Name: volume.Name, MountPath: devicePath}}
+	} else {
+		container.VolumeDevices = []v1.VolumeDevice{{Name: volume.Name, DevicePath: devicePath}}
+	}
+
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: t.Name + "-",
+			Namespace:    t.Namespace,
+			Labels:       map[string]string{HelperPodLabel: "true"},
+		},
+		Spec: v1.PodSpec{
+			NodeName:      t.Node,
+			RestartPolicy: v1.RestartPolicyNever,
+			Containers:    []v1.Container{container},
+			Volumes:       []v1.Volume{volume},
+		},
+	}
+}
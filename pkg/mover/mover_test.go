@@ -0,0 +1,112 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mover
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNewMover(t *testing.T) {
+	tests := map[string]struct {
+		config       map[string]string
+		startTimeout time.Duration
+		timeout      time.Duration
+		hasError     bool
+	}{
+		"default":          {config: map[string]string{}, startTimeout: DefaultHelperStartTimeout, timeout: DefaultHelperTimeout},
+		"configured":       {config: map[string]string{HelperStartTimeout: "1m", HelperTimeout: "2h"}, startTimeout: time.Minute, timeout: 2 * time.Hour},
+		"invalid timeout":  {config: map[string]string{HelperTimeout: "forever"}, hasError: true},
+		"negative timeout": {config: map[string]string{HelperStartTimeout: "-1m"}, hasError: true},
+	}
+
+	for name, test := range tests {
+		m, err := NewMover(logrus.New(), fake.NewSimpleClientset(), "10.0.0.1", test.config)
+		if (err != nil) != test.hasError {
+			t.Errorf("%s: unexpected error %v", name, err)
+			continue
+		}
+		if test.hasError {
+			continue
+		}
+		if m.StartTimeout != test.startTimeout || m.Timeout != test.timeout {
+			t.Errorf("%s: got timeouts %s/%s, expected %s/%s", name, m.StartTimeout, m.Timeout, test.startTimeout, test.timeout)
+		}
+	}
+}
+
+func TestWaitForCompletion(t *testing.T) {
+	pod := func(phase v1.PodPhase, waiting string) *v1.Pod {
+		p := &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "helper", Namespace: "openebs"},
+			Status:     v1.PodStatus{Phase: phase},
+		}
+		if waiting != "" {
+			p.Status.ContainerStatuses = []v1.ContainerStatus{{
+				Name:  helperContainer,
+				State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: waiting}},
+			}}
+		}
+		return p
+	}
+
+	tests := map[string]struct {
+		pod   *v1.Pod
+		check func() error
+		err   string
+	}{
+		"succeeded":          {pod: pod(v1.PodSucceeded, "")},
+		"failed":             {pod: pod(v1.PodFailed, ""), err: "failed"},
+		"image pull error":   {pod: pod(v1.PodPending, "ErrImagePull"), err: "can't pull image"},
+		"image pull backoff": {pod: pod(v1.PodPending, "ImagePullBackOff"), err: "can't pull image"},
+		"pending":            {pod: pod(v1.PodPending, "ContainerCreating"), err: "is pending for more than"},
+		"rejected volume": {
+			pod:   pod(v1.PodPending, ""),
+			check: func() error { return errors.New("clone pvc is rejected by the provisioner") },
+			err:   "clone pvc is rejected by the provisioner",
+		},
+	}
+
+	for name, test := range tests {
+		m := &Mover{
+			Log:          logrus.New(),
+			K8sClient:    fake.NewSimpleClientset(test.pod),
+			Image:        DefaultHelperImage,
+			StartTimeout: time.Nanosecond,
+			Timeout:      time.Minute,
+		}
+
+		err := m.waitForCompletion(test.pod.Namespace, test.pod.Name, test.check)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", name, err)
+			}
+			continue
+		}
+
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected error %q, got %v", name, test.err, err)
+		}
+	}
+}
@@ -0,0 +1,417 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package velero
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// PVCMetadataAnnotation is added to cStor PV, in velero backup, having the PVC to be created at restore
+	PVCMetadataAnnotation = "openebs.io/velero-pvc"
+
+	// ZFSVolumeMetadataAnnotation is added to ZFS-LocalPV PV, in velero backup, having the ZFSVolume
+	ZFSVolumeMetadataAnnotation = "openebs.io/velero-zfsvolume"
+
+	// LVMVolumeMetadataAnnotation is added to LVM-LocalPV PV, in velero backup, having the LVMVolume
+	LVMVolumeMetadataAnnotation = "openebs.io/velero-lvmvolume"
+
+	// PVCRestoredByPluginAnnotation is added to PVC created by plugin, value is the backup name
+	PVCRestoredByPluginAnnotation = "openebs.io/velero-restored-from"
+
+	// BackupChainKey is the label, or annotation, of velero backup having the name of incremental backup chain.
+	// Backups having the same chain name are incremental to the previous backup of the chain, as in schedule.
+	BackupChainKey = "openebs.io/backup-chain"
+
+	// OffloadBackupKey is the label, or annotation, of velero backup having the name of local backup.
+	// Snapshots created by the local backup are uploaded by the velero backup, instead of creating new snapshots.
+	OffloadBackupKey = "openebs.io/offload-local-backup"
+
+	// InsecureSkipTLSVerify is the config key of backupstoragelocation to skip the TLS verification
+	InsecureSkipTLSVerify = "insecureSkipTLSVerify"
+
+	// DownloadRequestTimeout defines timeout for processing of DownloadRequest by velero
+	DownloadRequestTimeout = time.Minute
+)
+
+// GetBackup return the velero backup having the given name
+func GetBackup(bkpName string) (*velerov1api.Backup, error) {
+	if clientSet == nil {
+		return nil, errors.New("velero clientset is not initialized")
+	}
+
+	bkp, err := clientSet.VeleroV1().Backups(veleroNs).Get(context.TODO(), bkpName, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get backup %s", bkpName)
+	}
+	return bkp, nil
+}
+
+// BackupChain return the incremental backup chain configured for the given backup,
+// using label or annotation BackupChainKey. It returns empty string if chain is not configured.
+func BackupChain(bkp *velerov1api.Backup) string {
+	if chain := bkp.Labels[BackupChainKey]; chain != "" {
+		return chain
+	}
+	return bkp.Annotations[BackupChainKey]
+}
+
+// OffloadBackup return the local backup, whose snapshots are to be uploaded by the given backup,
+// using label or annotation OffloadBackupKey. It returns empty string if it is not configured.
+func OffloadBackup(bkp *velerov1api.Backup) string {
+	if local := bkp.Labels[OffloadBackupKey]; local != "" {
+		return local
+	}
+	return bkp.Annotations[OffloadBackupKey]
+}
+
+// BackupSchedule return the schedule of the given backup, using label velero.io/schedule-name.
+// It returns empty string if backup is not created by schedule.
+func BackupSchedule(bkp *velerov1api.Backup) string {
+	return bkp.Labels[velerov1api.ScheduleNameLabel]
+}
+
+// backupContents caches the items of a velero backup content, so that the content
+// is downloaded once for all the volumes of the backup. Velero runs one restore at a time,
+// so items of the last used backup are kept. Cache is keyed by the UID of backup, so that
+// a backup deleted and created again with the same name is downloaded again.
+type backupContents struct {
+	sync.Mutex
+
+	// uid of the backup
+	uid types.UID
+
+	// resources loaded in items
+	resources map[string]bool
+
+	// items of the loaded resources, key is the path of item in backup content
+	items map[string][]byte
+}
+
+var contents = &backupContents{}
+
+// cachedResources are loaded along with the requested resource, restore of a volume
+// reads the PV and PVC from the backup content
+var cachedResources = []string{"persistentvolumes", "persistentvolumeclaims"}
+
+// GetBackupItem return the given resource item from the content of velero backup
+// For cluster scoped resource, ns should be empty.
+func GetBackupItem(bkpName, resource, ns, name string) ([]byte, error) {
+	if clientSet == nil {
+		return nil, errors.New("velero clientset is not initialized")
+	}
+
+	itemPath := path.Join(velerov1api.ResourcesDir, resource, velerov1api.ClusterScopedDir, name+".json")
+	if ns != "" {
+		itemPath = path.Join(velerov1api.ResourcesDir, resource, velerov1api.NamespaceScopedDir, ns, name+".json")
+	}
+
+	bkp, err := GetBackup(bkpName)
+	if err != nil {
+		return nil, err
+	}
+
+	contents.Lock()
+	defer contents.Unlock()
+
+	if contents.uid != bkp.UID {
+		contents.uid = bkp.UID
+		contents.resources = map[string]bool{}
+		contents.items = map[string][]byte{}
+	}
+
+	if !contents.resources[resource] {
+		resources := append([]string{resource}, cachedResources...)
+		if err := contents.load(bkp, resources); err != nil {
+			return nil, err
+		}
+	}
+
+	data, ok := contents.items[itemPath]
+	if !ok {
+		return nil, errors.Errorf("%s not found in backup %s", itemPath, bkpName)
+	}
+	return data, nil
+}
+
+// load downloads the content of given backup and loads the items of given resources
+func (c *backupContents) load(bkp *velerov1api.Backup, resources []string) error {
+	body, err := downloadBackupContent(bkp)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	items, err := readBackupItems(body, resources)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read content of backup %s", bkp.Name)
+	}
+
+	for k, v := range items {
+		c.items[k] = v
+	}
+	for _, r := range resources {
+		c.resources[r] = true
+	}
+	return nil
+}
+
+// downloadBackupContent return the gzipped tarball of given backup content
+func downloadBackupContent(bkp *velerov1api.Backup) (io.ReadCloser, error) {
+	bkpName := bkp.Name
+
+	client, err := getDownloadClient(bkp)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &velerov1api.DownloadRequest{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: bkpName + "-",
+			Namespace:    veleroNs,
+		},
+		Spec: velerov1api.DownloadRequestSpec{
+			Target: velerov1api.DownloadTarget{
+				Kind: velerov1api.DownloadTargetKindBackupContents,
+				Name: bkpName,
+			},
+		},
+	}
+
+	req, err = clientSet.VeleroV1().DownloadRequests(veleroNs).Create(context.TODO(), req, metav1.CreateOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create downloadrequest for backup %s", bkpName)
+	}
+
+	defer func() {
+		_ = clientSet.VeleroV1().DownloadRequests(veleroNs).Delete(context.TODO(), req.Name, metav1.DeleteOptions{})
+	}()
+
+	var url string
+	err = wait.PollImmediate(time.Second, DownloadRequestTimeout, func() (bool, error) {
+		obj, err := clientSet.VeleroV1().DownloadRequests(veleroNs).Get(context.TODO(), req.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		url = obj.Status.DownloadURL
+		return obj.Status.Phase == velerov1api.DownloadRequestPhaseProcessed && url != "", nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to process downloadrequest %s", req.Name)
+	}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to download content of backup %s", bkpName)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.Errorf("failed to download content of backup %s, status=%s", bkpName, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// getDownloadClient return the http client to download the content of given backup.
+// TLS is configured as per the caCert and insecureSkipTLSVerify of backup storage location.
+func getDownloadClient(bkp *velerov1api.Backup) (*http.Client, error) {
+	bsl, err := clientSet.VeleroV1().BackupStorageLocations(veleroNs).Get(context.TODO(), bkp.Spec.StorageLocation, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get backupstoragelocation %s", bkp.Spec.StorageLocation)
+	}
+
+	return newDownloadClient(bsl)
+}
+
+// newDownloadClient return the http client for the given backup storage location
+func newDownloadClient(bsl *velerov1api.BackupStorageLocation) (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+
+	if val, ok := bsl.Spec.Config[InsecureSkipTLSVerify]; ok {
+		insecure, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, errors.Errorf("failed to parse %s=%s of backupstoragelocation %s", InsecureSkipTLSVerify, val, bsl.Name)
+		}
+		/* #nosec */
+		tlsConfig.InsecureSkipVerify = insecure
+	}
+
+	if bsl.Spec.ObjectStorage != nil && len(bsl.Spec.ObjectStorage.CACert) != 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(bsl.Spec.ObjectStorage.CACert) {
+			return nil, errors.Errorf("failed to parse caCert of backupstoragelocation %s", bsl.Name)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
+
+// readBackupItems return the items of given resources from the gzipped tarball of backup content,
+// key is the path of item in the content
+func readBackupItems(r io.Reader, resources []string) (map[string][]byte, error) {
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gzr.Close()
+
+	items := map[string][]byte{}
+
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return items, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := path.Clean(hdr.Name)
+		for _, resource := range resources {
+			if !strings.HasPrefix(name, path.Join(velerov1api.ResourcesDir, resource)+"/") {
+				continue
+			}
+
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+			items[name] = data
+			break
+		}
+	}
+}
+
+// GetBackupPV return the PV from the content of velero backup
+func GetBackupPV(bkpName, pvName string) (*v1.PersistentVolume, error) {
+	data, err := GetBackupItem(bkpName, "persistentvolumes", "", pvName)
+	if err != nil {
+		return nil, err
+	}
+
+	pv := &v1.PersistentVolume{}
+	if err := json.Unmarshal(data, pv); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode pv %s from backup %s", pvName, bkpName)
+	}
+	return pv, nil
+}
+
+// GetBackupPVC return the PVC, of the given PV, from the content of velero backup
+func GetBackupPVC(bkpName, pvName string) (*v1.PersistentVolumeClaim, error) {
+	pv, err := GetBackupPV(bkpName, pvName)
+	if err != nil {
+		return nil, err
+	}
+
+	if pv.Spec.ClaimRef == nil {
+		return nil, errors.Errorf("pv %s in backup %s is not claimed", pvName, bkpName)
+	}
+
+	data, err := GetBackupItem(bkpName, "persistentvolumeclaims", pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	pvc := &v1.PersistentVolumeClaim{}
+	if err := json.Unmarshal(data, pvc); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode pvc of pv %s from backup %s", pvName, bkpName)
+	}
+	return pvc, nil
+}
+
+// GetPVMetadata return the value of given metadata annotation from the PV in velero backup
+func GetPVMetadata(bkpName, pvName, key string) ([]byte, error) {
+	pv, err := GetBackupPV(bkpName, pvName)
+	if err != nil {
+		return nil, err
+	}
+
+	val, ok := pv.Annotations[key]
+	if !ok {
+		return nil, errors.Errorf("pv %s in backup %s doesn't have %s", pvName, bkpName, key)
+	}
+	return []byte(val), nil
+}
+
+// GetSnapshotLocationConfig return the config of volumesnapshotlocation for given provider,
+// from the given locations of the backup. If the backup refers multiple locations of the provider
+// then first one is used. If locations are not given, provider must have only one location.
+func GetSnapshotLocationConfig(provider string, locations []string) (map[string]string, error) {
+	if clientSet == nil {
+		return nil, errors.New("velero clientset is not initialized")
+	}
+
+	list, err := clientSet.VeleroV1().VolumeSnapshotLocations(veleroNs).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get list of volumesnapshotlocation")
+	}
+
+	var configs []map[string]string
+	for _, vsl := range list.Items {
+		if vsl.Spec.Provider != provider {
+			continue
+		}
+
+		if len(locations) == 0 {
+			configs = append(configs, vsl.Spec.Config)
+			continue
+		}
+
+		for _, l := range locations {
+			if l == vsl.Name {
+				return vsl.Spec.Config, nil
+			}
+		}
+	}
+
+	switch {
+	case len(locations) != 0:
+		return nil, errors.Errorf("volumesnapshotlocation of provider %s not found in %v", provider, locations)
+	case len(configs) == 0:
+		return nil, errors.Errorf("volumesnapshotlocation not found for provider %s", provider)
+	case len(configs) > 1:
+		return nil, errors.Errorf("found more than one volumesnapshotlocation for provider %s", provider)
+	}
+	return configs[0], nil
+}
@@ -0,0 +1,246 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package velero
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/generated/clientset/versioned/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func newTestVSL(name, provider string) *velerov1api.VolumeSnapshotLocation {
+	return &velerov1api.VolumeSnapshotLocation{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: veleroNs},
+		Spec: velerov1api.VolumeSnapshotLocationSpec{
+			Provider: provider,
+			Config:   map[string]string{"bucket": name},
+		},
+	}
+}
+
+func TestGetSnapshotLocationConfig(t *testing.T) {
+	veleroNs = "velero"
+	defer func() { clientSet = nil }()
+
+	tests := map[string]struct {
+		vsls      []runtime.Object
+		locations []string
+		expected  string
+		hasError  bool
+	}{
+		"single location": {
+			vsls:     []runtime.Object{newTestVSL("zfs-1", "openebs.io/zfspv-blockstore")},
+			expected: "zfs-1",
+		},
+		"no location": {
+			vsls:     []runtime.Object{newTestVSL("cstor-1", "openebs.io/cstor-blockstore")},
+			hasError: true,
+		},
+		"multiple locations without backup locations": {
+			vsls: []runtime.Object{
+				newTestVSL("zfs-1", "openebs.io/zfspv-blockstore"),
+				newTestVSL("zfs-2", "openebs.io/zfspv-blockstore"),
+			},
+			hasError: true,
+		},
+		"location of backup": {
+			vsls: []runtime.Object{
+				newTestVSL("zfs-1", "openebs.io/zfspv-blockstore"),
+				newTestVSL("zfs-2", "openebs.io/zfspv-blockstore"),
+				newTestVSL("cstor-1", "openebs.io/cstor-blockstore"),
+			},
+			locations: []string{"cstor-1", "zfs-2"},
+			expected:  "zfs-2",
+		},
+		"backup location of other provider": {
+			vsls: []runtime.Object{
+				newTestVSL("zfs-1", "openebs.io/zfspv-blockstore"),
+				newTestVSL("cstor-1", "openebs.io/cstor-blockstore"),
+			},
+			locations: []string{"cstor-1"},
+			hasError:  true,
+		},
+	}
+
+	for name, test := range tests {
+		clientSet = fake.NewSimpleClientset(test.vsls...)
+
+		config, err := GetSnapshotLocationConfig("openebs.io/zfspv-blockstore", test.locations)
+		if (err != nil) != test.hasError {
+			t.Errorf("%s: unexpected error %v", name, err)
+			continue
+		}
+		if !test.hasError && !reflect.DeepEqual(config, map[string]string{"bucket": test.expected}) {
+			t.Errorf("%s: invalid config %v, expected location %s", name, config, test.expected)
+		}
+	}
+}
+
+func newTestBackupContent(t *testing.T, files map[string]string) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	gzw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gzw)
+
+	for name, data := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))}); err != nil {
+			t.Fatalf("failed to write header of %s : %v", name, err)
+		}
+		if _, err := tw.Write([]byte(data)); err != nil {
+			t.Fatalf("failed to write %s : %v", name, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close tar : %v", err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatalf("failed to close gzip : %v", err)
+	}
+	return buf
+}
+
+func TestReadBackupItems(t *testing.T) {
+	content := newTestBackupContent(t, map[string]string{
+		"metadata/version": "1",
+		"resources/persistentvolumes/cluster/pv-1.json":                 "pv-1",
+		"resources/persistentvolumeclaims/namespaces/app/pvc-1.json":    "pvc-1",
+		"resources/persistentvolumeclaims.v1/namespaces/app/pvc-2.json": "pvc-2",
+		"./resources/pods/namespaces/app/pod-1.json":                    "pod-1",
+		"resources/pods/namespaces/app/pod-2.json":                      "pod-2",
+	})
+
+	items, err := readBackupItems(content, []string{"persistentvolumes", "persistentvolumeclaims"})
+	if err != nil {
+		t.Fatalf("failed to read backup items : %v", err)
+	}
+
+	expected := map[string][]byte{
+		"resources/persistentvolumes/cluster/pv-1.json":              []byte("pv-1"),
+		"resources/persistentvolumeclaims/namespaces/app/pvc-1.json": []byte("pvc-1"),
+	}
+	if !reflect.DeepEqual(items, expected) {
+		t.Errorf("invalid items %v, expected %v", items, expected)
+	}
+
+	if _, err := readBackupItems(bytes.NewBufferString("invalid"), []string{"persistentvolumes"}); err == nil {
+		t.Errorf("expected error for invalid content")
+	}
+}
+
+func TestNewDownloadClient(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	caCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+	tests := map[string]struct {
+		config   map[string]string
+		caCert   []byte
+		hasError bool
+		connects bool
+	}{
+		"default":         {connects: false},
+		"ca cert":         {caCert: caCert, connects: true},
+		"insecure":        {config: map[string]string{InsecureSkipTLSVerify: "true"}, connects: true},
+		"secure":          {config: map[string]string{InsecureSkipTLSVerify: "false"}, connects: false},
+		"invalid ca cert": {caCert: []byte("invalid"), hasError: true},
+		"invalid config":  {config: map[string]string{InsecureSkipTLSVerify: "yes please"}, hasError: true},
+	}
+
+	for name, test := range tests {
+		bsl := &velerov1api.BackupStorageLocation{
+			ObjectMeta: metav1.ObjectMeta{Name: "default"},
+			Spec: velerov1api.BackupStorageLocationSpec{
+				Config: test.config,
+				StorageType: velerov1api.StorageType{
+					ObjectStorage: &velerov1api.ObjectStorageLocation{Bucket: "bucket", CACert: test.caCert},
+				},
+			},
+		}
+
+		client, err := newDownloadClient(bsl)
+		if (err != nil) != test.hasError {
+			t.Errorf("%s: unexpected error %v", name, err)
+			continue
+		}
+		if test.hasError {
+			continue
+		}
+
+		resp, err := client.Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err == nil) != test.connects {
+			t.Errorf("%s: connected=%v, expected %v : %v", name, err == nil, test.connects, err)
+		}
+	}
+}
+
+func TestGetBackupItemCache(t *testing.T) {
+	veleroNs = "velero"
+	defer func() {
+		clientSet = nil
+		contents = &backupContents{}
+	}()
+
+	itemPath := "resources/persistentvolumes/cluster/pv-1.json"
+
+	tests := map[string]struct {
+		uid      string
+		expected string
+		hasError bool
+	}{
+		"same backup": {uid: "uid-1", expected: "pv-1"},
+		// backup is created again with the same name, content is downloaded again
+		// and it fails as backupstoragelocation doesn't exist
+		"recreated backup": {uid: "uid-2", hasError: true},
+	}
+
+	for name, test := range tests {
+		contents = &backupContents{
+			uid:       "uid-1",
+			resources: map[string]bool{"persistentvolumes": true},
+			items:     map[string][]byte{itemPath: []byte("pv-1")},
+		}
+		clientSet = fake.NewSimpleClientset(&velerov1api.Backup{
+			ObjectMeta: metav1.ObjectMeta{Name: "bkp", Namespace: veleroNs, UID: types.UID(test.uid)},
+		})
+
+		data, err := GetBackupItem("bkp", "persistentvolumes", "", "pv-1")
+		if (err != nil) != test.hasError {
+			t.Errorf("%s: unexpected error %v", name, err)
+			continue
+		}
+		if !test.hasError && string(data) != test.expected {
+			t.Errorf("%s: got %s, expected %s", name, data, test.expected)
+		}
+	}
+}
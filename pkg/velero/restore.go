@@ -19,10 +19,12 @@ package velero
 import (
 	"context"
 	"sort"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	velerov1api "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 )
@@ -40,41 +42,134 @@ import (
 //		  backup for that restore matches with the backup name from snapshotID
 // Above approach works because velero support sequential restore
 func GetRestoreNamespace(ns, bkpName string, log logrus.FieldLogger) (string, error) {
+	r, err := getInProgressRestore(bkpName)
+	if err != nil {
+		return "", err
+	}
+
+	targetedNs, ok := r.Spec.NamespaceMapping[ns]
+	if ok {
+		return targetedNs, nil
+	}
+	return ns, nil
+}
+
+// GetRestoreSize return the size requested, through restore annotation, for the given volume
+// RestoreSizeAnnotation+"-"+pvName takes precedence over RestoreSizeAnnotation.
+// If size is not requested then it will return nil.
+func GetRestoreSize(pvName, bkpName string) (*resource.Quantity, error) {
+	r, err := getInProgressRestore(bkpName)
+	if err != nil {
+		return nil, err
+	}
+
+	val, ok := r.Annotations[RestoreSizeAnnotation+"-"+pvName]
+	if !ok {
+		val, ok = r.Annotations[RestoreSizeAnnotation]
+	}
+
+	if !ok {
+		return nil, nil
+	}
+
+	size, err := resource.ParseQuantity(val)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid restore size %s for volume %s", val, pvName)
+	}
+	return &size, nil
+}
+
+// GetRestorePointInTime return the point-in-time requested, through restore annotation, for the given backup
+// If point-in-time is not requested then it will return nil.
+func GetRestorePointInTime(bkpName string) (*time.Time, error) {
+	r, err := getInProgressRestore(bkpName)
+	if err != nil {
+		return nil, err
+	}
+
+	val, ok := r.Annotations[RestorePointInTimeAnnotation]
+	if !ok {
+		return nil, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, val)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid point-in-time %s, expected format RFC3339", val)
+	}
+	return &t, nil
+}
+
+// getInProgressRestore return the in-progress restore for the given backup
+// velero doesn't pass the restore name to plugin, refer GetRestoreNamespace
+func getInProgressRestore(bkpName string) (*velerov1api.Restore, error) {
 	listOpts := metav1.ListOptions{}
 	list, err := clientSet.VeleroV1().Restores(veleroNs).List(context.TODO(), listOpts)
 	if err != nil {
-		return "", errors.Wrapf(err, "failed to get list of restore")
+		return nil, errors.Wrapf(err, "failed to get list of restore")
 	}
 
 	sort.Sort(sort.Reverse(RestoreByCreationTimestamp(list.Items)))
 
 	for _, r := range list.Items {
 		if r.Status.Phase == velerov1api.RestorePhaseInProgress && r.Spec.BackupName == bkpName {
-			targetedNs, ok := r.Spec.NamespaceMapping[ns]
-			if ok {
-				return targetedNs, nil
-			}
-			return ns, nil
+			restore := r
+			return &restore, nil
 		}
 	}
-	return "", errors.Errorf("restore not found for backup %s", bkpName)
+	return nil, errors.Errorf("restore not found for backup %s", bkpName)
 }
 
+const (
+	// NodeMappingAction is the velero action name for node mapping configmap
+	NodeMappingAction = "velero.io/change-pvc-node-selector"
+
+	// StorageClassMappingAction is the velero action name for storageclass mapping configmap
+	StorageClassMappingAction = "velero.io/change-storage-class"
+
+	// PoolMappingAction is the action name for ZFS-LocalPV pool mapping configmap
+	PoolMappingAction = "openebs.io/change-zfs-pool"
+
+	// RestoreSizeAnnotation is added to velero restore to restore the volumes with given size
+	RestoreSizeAnnotation = "openebs.io/restore-size"
+
+	// RestorePointInTimeAnnotation is added to velero restore to restore the volumes
+	// from the latest backup, of the schedule, created at or before given time(RFC3339)
+	RestorePointInTimeAnnotation = "openebs.io/restore-point-in-time"
+)
+
 // GetTargetNode return the node mapping for the given node
 // if node mapping not found then it will return the same nodename in which backup was created
 // if node mapping found then it will return the mapping/target nodename
-func GetTargetNode(k8s *kubernetes.Clientset, node string) (string, error) {
+func GetTargetNode(k8s kubernetes.Interface, node string) (string, error) {
+	return getMapping(k8s, NodeMappingAction, node)
+}
+
+// GetTargetPool return the pool mapping for the given ZFS-LocalPV pool
+// if pool mapping not found then it will return the same pool
+func GetTargetPool(k8s kubernetes.Interface, pool string) (string, error) {
+	return getMapping(k8s, PoolMappingAction, pool)
+}
+
+// GetTargetStorageClass return the storageclass mapping for the given storageclass
+// if storageclass mapping not found then it will return the same storageclass
+func GetTargetStorageClass(k8s kubernetes.Interface, sc string) (string, error) {
+	return getMapping(k8s, StorageClassMappingAction, sc)
+}
+
+// getMapping return the value of given key from the plugin configmap of given action
+// if configmap or key doesn't exist then it will return the key
+func getMapping(k8s kubernetes.Interface, action, key string) (string, error) {
 	opts := metav1.ListOptions{
-		LabelSelector: "velero.io/plugin-config,velero.io/change-pvc-node-selector=RestoreItemAction",
+		LabelSelector: "velero.io/plugin-config," + action + "=RestoreItemAction",
 	}
 
 	list, err := k8s.CoreV1().ConfigMaps(veleroNs).List(context.TODO(), opts)
 	if err != nil {
-		return "", errors.Wrapf(err, "failed to get list of node mapping configmap")
+		return "", errors.Wrapf(err, "failed to get list of %s configmap", action)
 	}
 
 	if len(list.Items) == 0 {
-		return node, nil
+		return key, nil
 	}
 
 	if len(list.Items) > 1 {
@@ -87,10 +182,10 @@ func GetTargetNode(k8s *kubernetes.Clientset, node string) (string, error) {
 
 	config := list.Items[0]
 
-	tnode, ok := config.Data[node]
+	val, ok := config.Data[key]
 	if !ok {
-		return node, nil
+		return key, nil
 	}
 
-	return tnode, nil
+	return val, nil
 }
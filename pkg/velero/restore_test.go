@@ -0,0 +1,92 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package velero
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newMappingConfigMap(name, action string, data map[string]string) *v1.ConfigMap {
+	return &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: veleroNs,
+			Labels: map[string]string{
+				"velero.io/plugin-config": "",
+				action:                    "RestoreItemAction",
+			},
+		},
+		Data: data,
+	}
+}
+
+func TestGetMapping(t *testing.T) {
+	veleroNs = "velero"
+
+	tests := map[string]struct {
+		configs  []runtime.Object
+		key      string
+		expected string
+		hasError bool
+	}{
+		"no configmap": {
+			key:      "node-1",
+			expected: "node-1",
+		},
+		"mapped": {
+			configs:  []runtime.Object{newMappingConfigMap("node-map", NodeMappingAction, map[string]string{"node-1": "node-2"})},
+			key:      "node-1",
+			expected: "node-2",
+		},
+		"key not mapped": {
+			configs:  []runtime.Object{newMappingConfigMap("node-map", NodeMappingAction, map[string]string{"node-3": "node-2"})},
+			key:      "node-1",
+			expected: "node-1",
+		},
+		"configmap of other action": {
+			configs:  []runtime.Object{newMappingConfigMap("pool-map", PoolMappingAction, map[string]string{"node-1": "node-2"})},
+			key:      "node-1",
+			expected: "node-1",
+		},
+		"multiple configmaps": {
+			configs: []runtime.Object{
+				newMappingConfigMap("node-map-1", NodeMappingAction, map[string]string{"node-1": "node-2"}),
+				newMappingConfigMap("node-map-2", NodeMappingAction, map[string]string{"node-1": "node-3"}),
+			},
+			key:      "node-1",
+			hasError: true,
+		},
+	}
+
+	for name, test := range tests {
+		k8s := fake.NewSimpleClientset(test.configs...)
+
+		got, err := GetTargetNode(k8s, test.key)
+		if (err != nil) != test.hasError {
+			t.Errorf("%s: unexpected error %v", name, err)
+			continue
+		}
+		if got != test.expected {
+			t.Errorf("%s: mapping of %s is %s, expected %s", name, test.key, got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package velero
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// StrictVolumeCheck config key to fail the backup of OpenEBS volume which can't be snapshotted
+	StrictVolumeCheck = "strictVolumeCheck"
+
+	// openebsCASTypeLabel is the label of OpenEBS PV having the storage engine
+	openebsCASTypeLabel = "openebs.io/cas-type"
+
+	// openebsDomain is the suffix of OpenEBS CSI driver and provisioner names
+	openebsDomain = "openebs.io"
+
+	// provisionedByAnnotation is the annotation of PV having the provisioner name
+	provisionedByAnnotation = "pv.kubernetes.io/provisioned-by"
+)
+
+// SkipReason is the reason for not taking the snapshot of PV
+type SkipReason string
+
+const (
+	// SkipMissingName is set if PV doesn't have name
+	SkipMissingName SkipReason = "MissingName"
+
+	// SkipMissingStorageClass is set if PV doesn't have storage class
+	SkipMissingStorageClass SkipReason = "MissingStorageClass"
+
+	// SkipMissingClaimNamespace is set if claimRef of PV doesn't have namespace
+	SkipMissingClaimNamespace SkipReason = "MissingClaimNamespace"
+
+	// SkipNotClaimed is set if PV is not bound to any PVC
+	SkipNotClaimed SkipReason = "NotClaimed"
+
+	// SkipOtherEngine is set if PV doesn't belong to the storage engine of plugin
+	SkipOtherEngine SkipReason = "OtherEngine"
+)
+
+// MissingPVInfo return the reason if PV doesn't have sufficient info to take the snapshot.
+// It returns empty reason if PV has required info.
+func MissingPVInfo(pv *v1.PersistentVolume) SkipReason {
+	switch {
+	case pv.Name == "":
+		return SkipMissingName
+	case pv.Spec.StorageClassName == "":
+		return SkipMissingStorageClass
+	case pv.Spec.ClaimRef != nil && pv.Spec.ClaimRef.Namespace == "":
+		return SkipMissingClaimNamespace
+	}
+	return ""
+}
+
+// IsOpenEBSVolume checks if the given PV is provisioned by OpenEBS,
+// using cas-type label, CSI driver or provisioner name
+func IsOpenEBSVolume(pv *v1.PersistentVolume) bool {
+	if _, ok := pv.Labels[openebsCASTypeLabel]; ok {
+		return true
+	}
+
+	if pv.Spec.CSI != nil && strings.HasSuffix(pv.Spec.CSI.Driver, openebsDomain) {
+		return true
+	}
+
+	return strings.HasSuffix(pv.Annotations[provisionedByAnnotation], openebsDomain)
+}
+
+// SkipVolume logs the PV skipped by the plugin, with the reason. OpenEBS PV missing
+// the info required for snapshot is logged at warning level, OpenEBS PV of other engine,
+// which is left for the respective provider, is logged at info level and non-OpenEBS PVs
+// are logged at debug level.
+// If strict is set, it returns error for OpenEBS PV missing the info required for snapshot.
+func SkipVolume(log logrus.FieldLogger, pv *v1.PersistentVolume, reason SkipReason, strict bool) error {
+	isOpenEBS := IsOpenEBSVolume(pv)
+	entry := log.WithFields(logrus.Fields{
+		"pv":      pv.Name,
+		"reason":  reason,
+		"openebs": isOpenEBS,
+	})
+
+	if !isOpenEBS {
+		entry.Debugf("Skipping snapshot of PV{%s} : %s", pv.Name, reason)
+		return nil
+	}
+
+	if reason == SkipOtherEngine {
+		entry.Infof("Skipping snapshot of PV{%s} : %s", pv.Name, reason)
+		return nil
+	}
+
+	entry.Warnf("Skipping snapshot of PV{%s} : %s", pv.Name, reason)
+	if strict {
+		return errors.Errorf("snapshot of OpenEBS PV{%s} can't be taken : %s", pv.Name, reason)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package velero
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSkipVolume(t *testing.T) {
+	jivaPV := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-1", Labels: map[string]string{openebsCASTypeLabel: "jiva"}},
+	}
+	nfsPV := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-2"},
+	}
+
+	tests := map[string]struct {
+		pv       *v1.PersistentVolume
+		reason   SkipReason
+		strict   bool
+		level    logrus.Level
+		hasError bool
+	}{
+		"openebs pv of other engine":  {pv: jivaPV, reason: SkipOtherEngine, strict: true, level: logrus.InfoLevel},
+		"openebs pv missing info":     {pv: jivaPV, reason: SkipMissingStorageClass, level: logrus.WarnLevel},
+		"strict openebs pv":           {pv: jivaPV, reason: SkipMissingStorageClass, strict: true, level: logrus.WarnLevel, hasError: true},
+		"non-openebs pv":              {pv: nfsPV, reason: SkipOtherEngine, strict: true, level: logrus.DebugLevel},
+		"non-openebs pv missing info": {pv: nfsPV, reason: SkipMissingStorageClass, strict: true, level: logrus.DebugLevel},
+	}
+
+	for name, test := range tests {
+		log, hook := logtest.NewNullLogger()
+		log.SetLevel(logrus.DebugLevel)
+
+		err := SkipVolume(log, test.pv, test.reason, test.strict)
+		if (err != nil) != test.hasError {
+			t.Errorf("%s: unexpected error %v", name, err)
+		}
+
+		entry := hook.LastEntry()
+		if entry == nil || entry.Level != test.level {
+			t.Errorf("%s: expected log at %s level, got %v", name, test.level, entry)
+		}
+	}
+}
@@ -18,12 +18,12 @@ package plugin
 
 import (
 	"context"
-	"encoding/json"
-	"sort"
+	"fmt"
 	"strconv"
 	"sync"
 	"time"
 
+	cloud "github.com/openebs/velero-plugin/pkg/clouduploader"
 	"github.com/openebs/velero-plugin/pkg/zfs/utils"
 	apis "github.com/openebs/zfs-localpv/pkg/apis/openebs.io/zfs/v1"
 	"github.com/openebs/zfs-localpv/pkg/builder/bkpbuilder"
@@ -47,19 +47,6 @@ func (p *Plugin) getPV(volumeID string) (*v1.PersistentVolume, error) {
 		Get(context.TODO(), volumeID, metav1.GetOptions{})
 }
 
-func (p *Plugin) uploadZFSVolume(vol *apis.ZFSVolume, filename string) error {
-	data, err := json.MarshalIndent(vol, "", "\t")
-	if err != nil {
-		return errors.New("zfs: error doing json parsing")
-	}
-
-	if ok := p.cl.Write(data, filename+".zfsvol"); !ok {
-		return errors.New("zfs: failed to upload ZFSVolume")
-	}
-
-	return nil
-}
-
 // deleteBackup deletes the backup resource
 func (p *Plugin) deleteBackup(snapshotID string) error {
 	pvname, _, snapname, err := utils.GetInfoFromSnapshotID(snapshotID)
@@ -76,53 +63,108 @@ func (p *Plugin) deleteBackup(snapshotID string) error {
 	return err
 }
 
-func (p *Plugin) getPrevSnap(volname, schdname string) (string, error) {
-	if p.incremental < 1 || len(schdname) == 0 {
+// lastBackup return the snapshot of the latest successful backup, from the given list.
+// Backups are ordered by creation time, as backup name may not have the timestamp.
+func lastBackup(backups []apis.ZFSBackup) string {
+	var last *apis.ZFSBackup
+
+	for i, bkp := range backups {
+		if bkp.Status != apis.BKPZFSStatusDone {
+			continue
+		}
+
+		if last == nil || last.CreationTimestamp.Before(&bkp.CreationTimestamp) ||
+			(last.CreationTimestamp.Equal(&bkp.CreationTimestamp) && last.Spec.SnapName < bkp.Spec.SnapName) {
+			last = &backups[i]
+		}
+	}
+
+	if last == nil {
+		return ""
+	}
+	return last.Spec.SnapName
+}
+
+// getPrevSnap return the previous snapshot for incremental backup, and the backup policy applied.
+// Full backup is taken, i.e. empty previous snapshot is returned, if the incremental chain has
+// incrBackupCount incremental backups, if full backup of the chain is older than fullBackupInterval
+// or if size of incremental backups in the chain exceeds fullBackupSizePercent of the volume size.
+func (p *Plugin) getPrevSnap(vol *apis.ZFSVolume, schdname string) (string, string, error) {
+	policy := p.backupPolicy()
+	if !policy.enabled() || len(schdname) == 0 {
 		// not an incremental backup, take the full backup
-		return "", nil
+		return "", "full backup, incremental backup not configured", nil
 	}
 
 	listOptions := metav1.ListOptions{
-		LabelSelector: VeleroSchdKey + "=" + schdname + "," + VeleroVolKey + "=" + volname,
+		LabelSelector: VeleroSchdKey + "=" + schdname + "," + VeleroVolKey + "=" + vol.Name,
 	}
 
 	bkpList, err := bkpbuilder.NewKubeclient().
 		WithNamespace(p.namespace).List(listOptions)
 
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
-	var backups []string
+	prevSnap := lastBackup(bkpList.Items)
+	if prevSnap == "" {
+		return "", "full backup, no previous backup found", nil
+	}
+
+	filename := func(backup string) string {
+		return p.cl.GenerateRemoteFileWithSchd(vol.Name, schdname, backup)
+	}
 
-	size := len(bkpList.Items)
-	count := p.incremental + 1
+	chain, err := p.cl.ResolveChain(prevSnap, filename)
+	if err != nil {
+		p.Log.Warnf("zfs: failed to resolve snapshot chain of %s : %s", prevSnap, err.Error())
+		return "", "full backup, snapshot chain of previous backup can't be resolved", nil
+	}
 
-	if uint64(size)%count == 0 {
-		// have to start the next snapshot incremental group, take the full backup
-		return "", nil
+	if chain == nil {
+		// previous backup is created by older plugin, without manifest, use the count of backups
+		if p.incremental < 1 || uint64(len(bkpList.Items))%(p.incremental+1) == 0 {
+			// have to start the next snapshot incremental group, take the full backup
+			return "", "full backup, snapshot chain of previous backup is not recorded", nil
+		}
+		return prevSnap, fmt.Sprintf("incremental backup, incrBackupCount(%d) not reached", p.incremental), nil
 	}
 
-	/*
-	 * Backup names are in the form of <schdeule>-<yyyymmddhhmmss>
-	 * to get the last snapshot, sort the list of successful backups,
-	 * the previous snapshot will be the last element in the sorted list
-	 */
-	if len(bkpList.Items) > 0 {
-		for _, bkp := range bkpList.Items {
-			if bkp.Status == apis.BKPZFSStatusDone {
-				backups = append(backups, bkp.Spec.SnapName)
-			}
+	var manifests []*cloud.SnapshotManifest
+	for _, bkp := range chain {
+		m, err := p.cl.ReadManifest(filename(bkp))
+		if err != nil {
+			return "", "", err
 		}
-		size := len(backups)
-		sort.Strings(backups)
-		return backups[size-1], nil
+		manifests = append(manifests, m)
+	}
+
+	volSize, err := strconv.ParseInt(vol.Spec.Capacity, 10, 64)
+	if err != nil {
+		return "", "", errors.Errorf("zfs: error parsing the size %s", vol.Spec.Capacity)
 	}
 
-	return "", nil
+	full, applied := policy.decide(manifests, volSize, time.Now())
+	if full {
+		return "", applied, nil
+	}
+	return prevSnap, applied, nil
 }
 
-func (p *Plugin) createBackup(vol *apis.ZFSVolume, schdname, snapname string, port int) (string, error) {
+// backupPolicy return the policy for full backup of the schedule
+func (p *Plugin) backupPolicy() backupPolicy {
+	return backupPolicy{
+		incremental:           p.incremental,
+		fullBackupInterval:    p.fullBackupInterval,
+		fullBackupSizePercent: p.fullBackupSizePercent,
+	}
+}
+
+// buildBackup builds the ZFSBackup for the given volume
+// It returns the ZFSBackup, previous snapshot used for incremental backup
+// and the backup policy applied.
+func (p *Plugin) buildBackup(vol *apis.ZFSVolume, schdname, snapname string, port int) (*apis.ZFSBackup, string, string, error) {
 	bkpname := utils.GenerateResourceName(vol.Name, snapname)
 
 	p.Log.Debugf("zfs: creating ZFSBackup vol = %s bkp = %s schd = %s", vol.Name, bkpname, schdname)
@@ -130,16 +172,19 @@ func (p *Plugin) createBackup(vol *apis.ZFSVolume, schdname, snapname string, po
 	var err error
 	labels := map[string]string{}
 	prevSnap := ""
+	policy := "full backup, not a scheduled backup"
 
 	if len(schdname) > 0 {
 		// add schdeule name as label
 		labels[VeleroSchdKey] = schdname
 		labels[VeleroVolKey] = vol.Name
-		prevSnap, err = p.getPrevSnap(vol.Name, schdname)
+
+		prevSnap, policy, err = p.getPrevSnap(vol, schdname)
 		if err != nil {
 			p.Log.Errorf("zfs: Failed to get prev snapshot bkp %s err: {%v}", snapname, err)
-			return "", err
+			return nil, "", "", err
 		}
+		p.Log.Infof("zfs: backup vol=%s snap=%s policy: %s", vol.Name, snapname, policy)
 	}
 
 	p.Log.Debugf("zfs: backup incr(%d) schd=%s snap=%s prevsnap=%s vol=%s", p.incremental, schdname, snapname, prevSnap, vol.Name)
@@ -158,14 +203,13 @@ func (p *Plugin) createBackup(vol *apis.ZFSVolume, schdname, snapname string, po
 		Build()
 
 	if err != nil {
-		return "", err
-	}
-	_, err = bkpbuilder.NewKubeclient().WithNamespace(p.namespace).Create(bkp)
-	if err != nil {
-		return "", err
+		return nil, "", "", err
 	}
 
-	return bkpname, nil
+	// pass the data server settings to the node agent
+	bkp.Annotations = p.cl.RemoteAnnotations()
+
+	return bkp, prevSnap, policy, nil
 }
 
 func (p *Plugin) checkBackupStatus(bkpname string) error {
@@ -202,46 +246,50 @@ func (p *Plugin) doUpload(wg *sync.WaitGroup, filename string, size int64, port
 	close(*p.cl.ConnReady)
 }
 
-func (p *Plugin) doBackup(volumeID string, snapname string, schdname string, port int) (string, error) {
-	pv, err := p.getPV(volumeID)
-	if err != nil {
-		p.Log.Errorf("zfs: Failed to get pv %s snap %s schd %s err %v", volumeID, snapname, schdname, err)
-		return "", err
-	}
-
+// GetZFSVolumeForBackup return the ZFSVolume, from given namespace, for the PV
+func GetZFSVolumeForBackup(pv *v1.PersistentVolume, ns string) (*apis.ZFSVolume, error) {
 	if pv.Spec.PersistentVolumeSource.CSI == nil {
-		return "", errors.New("zfs: err not a CSI pv")
+		return nil, errors.New("zfs: err not a CSI pv")
 	}
 
 	volHandle := pv.Spec.PersistentVolumeSource.CSI.VolumeHandle
 
 	getOptions := metav1.GetOptions{}
 	vol, err := volbuilder.NewKubeclient().
-		WithNamespace(p.namespace).Get(volHandle, getOptions)
+		WithNamespace(ns).Get(volHandle, getOptions)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	if pv.Spec.ClaimRef != nil {
-		// add source namespace in the label to filter it at restore time
-		if vol.Labels == nil {
-			vol.Labels = map[string]string{}
-		}
-		vol.Labels[VeleroNsKey] = pv.Spec.ClaimRef.Namespace
-	} else {
-		return "", errors.Errorf("zfs: err pv is not claimed")
+	if pv.Spec.ClaimRef == nil {
+		return nil, errors.Errorf("zfs: err pv is not claimed")
 	}
 
-	filename := p.cl.GenerateRemoteFileWithSchd(volumeID, schdname, snapname)
-	if filename == "" {
-		return "", errors.Errorf("zfs: error creating remote file name for backup")
+	// add source namespace in the label to filter it at restore time
+	if vol.Labels == nil {
+		vol.Labels = map[string]string{}
+	}
+	vol.Labels[VeleroNsKey] = pv.Spec.ClaimRef.Namespace
+	return vol, nil
+}
+
+func (p *Plugin) doBackup(volumeID string, snapname string, schdname string, port int) (string, error) {
+	pv, err := p.getPV(volumeID)
+	if err != nil {
+		p.Log.Errorf("zfs: Failed to get pv %s snap %s schd %s err %v", volumeID, snapname, schdname, err)
+		return "", err
 	}
 
-	err = p.uploadZFSVolume(vol, filename)
+	vol, err := GetZFSVolumeForBackup(pv, p.namespace)
 	if err != nil {
 		return "", err
 	}
 
+	filename := p.cl.GenerateRemoteFileWithSchd(volumeID, schdname, snapname)
+	if filename == "" {
+		return "", errors.Errorf("zfs: error creating remote file name for backup")
+	}
+
 	size, err := strconv.ParseInt(vol.Spec.Capacity, 10, 64)
 	if err != nil {
 		return "", errors.Errorf("zfs: error parsing the size %s", vol.Spec.Capacity)
@@ -252,6 +300,16 @@ func (p *Plugin) doBackup(volumeID string, snapname string, schdname string, por
 	// reset the connection state
 	p.cl.ConnStateReset()
 
+	if err := p.cl.GenerateTransferToken(); err != nil {
+		return "", err
+	}
+
+	// previous snapshot is resolved from the cloud, before the application is frozen
+	bkp, prevSnap, policy, err := p.buildBackup(vol, schdname, snapname, port)
+	if err != nil {
+		return "", err
+	}
+
 	var wg sync.WaitGroup
 
 	wg.Add(1)
@@ -259,9 +317,10 @@ func (p *Plugin) doBackup(volumeID string, snapname string, schdname string, por
 
 	// wait for the upload server to exit
 	defer func() {
-		p.cl.ExitServer = true
+		p.cl.SetExitServer(true)
 		wg.Wait()
 		p.cl.ConnReady = nil
+		p.cl.OnTransferStart = nil
 	}()
 
 	// wait for the connection to be ready
@@ -270,22 +329,63 @@ func (p *Plugin) doBackup(volumeID string, snapname string, schdname string, por
 		return "", errors.New("zfs: error in uploading snapshot")
 	}
 
-	bkpname, err := p.createBackup(vol, schdname, snapname, port)
+	thaw, err := p.freezer.Freeze(pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name)
 	if err != nil {
-		return "", err
+		return "", errors.Wrapf(err, "zfs: failed to freeze application")
 	}
+	defer func() { _ = thaw() }()
+
+	// node agent creates the snapshot before it connects for the data transfer,
+	// application is thawed once the connection is accepted
+	p.cl.OnTransferStart = func() { go func() { _ = thaw() }() }
 
-	err = p.checkBackupStatus(bkpname)
+	_, err = bkpbuilder.NewKubeclient().WithNamespace(p.namespace).Create(bkp)
 	if err != nil {
-		p.deleteBackup(bkpname)
-		p.Log.Errorf("zfs: backup failed vol %s snap %s bkpname %s err: %v", volumeID, snapname, bkpname, err)
 		return "", err
 	}
 
-	// generate the snapID
+	// node agent creates the snapshot as soon as it gets the ZFSBackup,
+	// this time is used for point-in-time restore
+	snapTime := time.Now().UTC()
+
 	snapID := utils.GenerateSnapshotID(volumeID, schdname, snapname)
 
-	p.Log.Debugf("zfs: backup done vol %s bkp %s snapID %s", volumeID, bkpname, snapID)
+	err = p.checkBackupStatus(bkp.Name)
+	if err == nil {
+		// application is already thawed, result tells if it was thawed before the snapshot
+		if thawErr := thaw(); thawErr != nil {
+			err = errors.Wrapf(thawErr, "zfs: snapshot %s is not app-consistent", snapname)
+		}
+	}
+
+	if err != nil {
+		_ = p.deleteBackup(snapID)
+		p.Log.Errorf("zfs: backup failed vol %s snap %s bkpname %s err: %v", volumeID, snapname, bkp.Name, err)
+		return "", err
+	}
+
+	// wait for the upload to finish, size of uploaded snapshot is used by the full backup policy
+	p.cl.SetExitServer(true)
+	wg.Wait()
+
+	bkpSize, err := p.cl.ObjectSize(filename)
+	if err != nil {
+		p.Log.Warnf("zfs: failed to get size of uploaded snapshot %s : %s", filename, err.Error())
+	}
+
+	// record the previous snapshot to build the restore chain
+	if err := p.cl.WriteManifest(filename, &cloud.SnapshotManifest{
+		Backup:    snapname,
+		Parent:    prevSnap,
+		Timestamp: snapTime,
+		Size:      bkpSize,
+		Policy:    policy,
+		Chain:     schdname,
+	}); err != nil {
+		return "", err
+	}
+
+	p.Log.Debugf("zfs: backup done vol %s bkp %s snapID %s", volumeID, bkp.Name, snapID)
 
 	return snapID, nil
 }
@@ -0,0 +1,69 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	apis "github.com/openebs/zfs-localpv/pkg/apis/openebs.io/zfs/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestLastBackup(t *testing.T) {
+	now := time.Now()
+	backup := func(snap string, age time.Duration, status apis.ZFSBackupStatus) apis.ZFSBackup {
+		return apis.ZFSBackup{
+			ObjectMeta: metav1.ObjectMeta{CreationTimestamp: metav1.NewTime(now.Add(-age))},
+			Spec:       apis.ZFSBackupSpec{SnapName: snap},
+			Status:     status,
+		}
+	}
+	done := apis.BKPZFSStatusDone
+
+	tests := map[string]struct {
+		backups []apis.ZFSBackup
+		last    string
+	}{
+		"no backup": {nil, ""},
+		"no successful backup": {
+			[]apis.ZFSBackup{backup("schd-1", time.Hour, apis.BKPZFSStatusFailed)}, "",
+		},
+		"latest by creation time": {
+			[]apis.ZFSBackup{
+				backup("nightly-20200101000000", 2*time.Hour, done),
+				backup("adhoc-b", time.Hour, done),
+				backup("nightly-20200102000000", 3*time.Hour, done),
+			}, "adhoc-b",
+		},
+		"skip failed backup": {
+			[]apis.ZFSBackup{
+				backup("ci-1", 2*time.Hour, done),
+				backup("ci-2", time.Hour, apis.BKPZFSStatusFailed),
+			}, "ci-1",
+		},
+		"same creation time": {
+			[]apis.ZFSBackup{backup("ci-2", time.Hour, done), backup("ci-1", time.Hour, done)}, "ci-2",
+		},
+	}
+
+	for name, test := range tests {
+		if last := lastBackup(test.backups); last != test.last {
+			t.Errorf("%s: last backup is %s, expected %s", name, last, test.last)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"fmt"
+	"time"
+
+	cloud "github.com/openebs/velero-plugin/pkg/clouduploader"
+)
+
+// backupPolicy defines when the full backup is taken for the scheduled backups.
+// Each of the limits is evaluated independently, 0 disables the limit.
+type backupPolicy struct {
+	// incremental is the max number of incremental backups in the chain
+	incremental uint64
+
+	// fullBackupInterval is the max age of full backup in the chain
+	fullBackupInterval time.Duration
+
+	// fullBackupSizePercent is the max size, as percentage of volume size,
+	// of incremental backups in the chain
+	fullBackupSizePercent uint64
+}
+
+// enabled returns true if incremental backups are configured
+func (bp backupPolicy) enabled() bool {
+	return bp.incremental > 0 || bp.fullBackupInterval > 0 || bp.fullBackupSizePercent > 0
+}
+
+// decide checks if the next backup should be full or incremental to the given chain.
+// chain has the manifests of the backups in the incremental chain, full backup first,
+// ending with the previous backup. It returns true, with the policy applied, if full backup
+// should be taken.
+func (bp backupPolicy) decide(chain []*cloud.SnapshotManifest, volSize int64, now time.Time) (bool, string) {
+	if !bp.enabled() {
+		return true, "full backup, incremental backup not configured"
+	}
+
+	if len(chain) == 0 {
+		return true, "full backup, no previous backup found"
+	}
+
+	incrCount := uint64(len(chain) - 1)
+	if bp.incremental > 0 && incrCount >= bp.incremental {
+		return true, fmt.Sprintf("full backup, incrBackupCount(%d) reached", bp.incremental)
+	}
+
+	base := chain[0]
+	if bp.fullBackupInterval > 0 {
+		if age := now.Sub(base.Timestamp); age >= bp.fullBackupInterval {
+			return true, fmt.Sprintf("full backup, full backup %s is older(%s) than fullBackupInterval(%s)",
+				base.Backup, age.Round(time.Second), bp.fullBackupInterval)
+		}
+	}
+
+	var incrSize int64
+	for _, m := range chain[1:] {
+		incrSize += m.Size
+	}
+
+	if bp.fullBackupSizePercent > 0 && volSize > 0 {
+		if uint64(incrSize)*100 >= bp.fullBackupSizePercent*uint64(volSize) {
+			return true, fmt.Sprintf("full backup, size(%d) of incremental backups exceeds fullBackupSizePercent(%d) of volume size(%d)",
+				incrSize, bp.fullBackupSizePercent, volSize)
+		}
+	}
+
+	return false, fmt.Sprintf("incremental backup, %d incremental backups of size(%d) on full backup %s",
+		incrCount, incrSize, base.Backup)
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	cloud "github.com/openebs/velero-plugin/pkg/clouduploader"
+)
+
+// newChain return the manifests of chain having a full backup, of given age,
+// and incremental backups of given sizes
+func newChain(now time.Time, age time.Duration, sizes ...int64) []*cloud.SnapshotManifest {
+	chain := []*cloud.SnapshotManifest{
+		{Backup: "schd-0", Timestamp: now.Add(-age), Size: 1000},
+	}
+	for i, size := range sizes {
+		chain = append(chain, &cloud.SnapshotManifest{
+			Backup:    fmt.Sprintf("schd-%d", i+1),
+			Parent:    chain[i].Backup,
+			Timestamp: now.Add(-age).Add(time.Duration(i+1) * time.Hour),
+			Size:      size,
+		})
+	}
+	return chain
+}
+
+func TestBackupPolicyDecide(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+	volSize := int64(1000)
+
+	tests := map[string]struct {
+		policy backupPolicy
+		chain  []*cloud.SnapshotManifest
+		full   bool
+		reason string
+	}{
+		"not configured": {
+			backupPolicy{}, newChain(now, day, 10), true, "not configured",
+		},
+		"no previous backup": {
+			backupPolicy{incremental: 3}, nil, true, "no previous backup",
+		},
+		"count not reached": {
+			backupPolicy{incremental: 3}, newChain(now, day, 10, 10), false, "2 incremental backups",
+		},
+		"count reached": {
+			backupPolicy{incremental: 3}, newChain(now, day, 10, 10, 10), true, "incrBackupCount(3)",
+		},
+		"only full backup in chain": {
+			backupPolicy{incremental: 0, fullBackupSizePercent: 50}, newChain(now, day), false, "0 incremental backups",
+		},
+		"interval without count": {
+			backupPolicy{fullBackupInterval: 7 * day}, newChain(now, 8*day, 10), true, "fullBackupInterval",
+		},
+		"interval not reached without count": {
+			backupPolicy{fullBackupInterval: 7 * day}, newChain(now, 6*day, 10, 10, 10, 10, 10), false, "5 incremental backups",
+		},
+		"interval before count": {
+			backupPolicy{incremental: 10, fullBackupInterval: 7 * day}, newChain(now, 8*day, 10), true, "fullBackupInterval",
+		},
+		"size without count": {
+			backupPolicy{fullBackupSizePercent: 50}, newChain(now, day, 200, 300), true, "fullBackupSizePercent",
+		},
+		"size not reached without count": {
+			backupPolicy{fullBackupSizePercent: 50}, newChain(now, day, 200, 200), false, "size(400)",
+		},
+		"size before interval": {
+			backupPolicy{incremental: 10, fullBackupInterval: 7 * day, fullBackupSizePercent: 50},
+			newChain(now, day, 600), true, "fullBackupSizePercent",
+		},
+		"all limits within": {
+			backupPolicy{incremental: 10, fullBackupInterval: 7 * day, fullBackupSizePercent: 50},
+			newChain(now, day, 100, 100), false, "incremental backup",
+		},
+	}
+
+	for name, test := range tests {
+		full, reason := test.policy.decide(test.chain, volSize, now)
+		if full != test.full {
+			t.Errorf("%s: full=%v, expected %v, policy: %s", name, full, test.full, reason)
+		}
+		if !strings.Contains(reason, test.reason) {
+			t.Errorf("%s: policy %q doesn't have %q", name, reason, test.reason)
+		}
+	}
+}
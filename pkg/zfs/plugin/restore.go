@@ -30,6 +30,8 @@ import (
 	"github.com/openebs/zfs-localpv/pkg/builder/volbuilder"
 	"github.com/openebs/zfs-localpv/pkg/zfs"
 	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -37,6 +39,25 @@ const (
 	restoreStatusInterval = 5
 )
 
+// restoreCapacity return the capacity of given volume to be restored with the given size.
+// Quota of dataset is set on receive, but zvol is received with the size of backed-up volume,
+// so it fails for zvol if the given size is larger.
+func restoreCapacity(pvname string, vol *apis.ZFSVolume, size *resource.Quantity) (string, error) {
+	srcSize, err := strconv.ParseInt(vol.Spec.Capacity, 10, 64)
+	if err != nil {
+		return "", errors.Errorf("zfs: error parsing the size %s", vol.Spec.Capacity)
+	}
+
+	if size.Value() < srcSize {
+		return "", errors.Errorf("zfs: restore size %s is less than volume size %d", size.String(), srcSize)
+	}
+
+	if size.Value() > srcSize && vol.Spec.VolumeType != zfs.VolTypeDataset {
+		return "", errors.Errorf("zfs: restore size is supported only for dataset, expand the PVC of zvol %s after restore", pvname)
+	}
+	return strconv.FormatInt(size.Value(), 10), nil
+}
+
 func (p *Plugin) buildZFSVolume(pvname string, bkpname string, bkpZV *apis.ZFSVolume) (*apis.ZFSVolume, error) {
 	// get the target namespace
 	ns, err := velero.GetRestoreNamespace(bkpZV.Labels[VeleroNsKey], bkpname, p.Log)
@@ -46,33 +67,15 @@ func (p *Plugin) buildZFSVolume(pvname string, bkpname string, bkpZV *apis.ZFSVo
 		return nil, err
 	}
 
-	filter := metav1.ListOptions{
-		LabelSelector: VeleroVolKey + "=" + pvname + "," + VeleroNsKey + "=" + ns,
-	}
-	volList, err := volbuilder.NewKubeclient().WithNamespace(p.namespace).List(filter)
-
-	if err != nil {
-		p.Log.Errorf("zfs: failed to get source volume failed vol %s snap %s err: %v", pvname, bkpname, err)
+	if err := p.checkRestored(pvname, ns, bkpname); err != nil {
 		return nil, err
 	}
 
-	if len(volList.Items) > 0 {
-		return nil, errors.Errorf("zfs: err pv %s has already been restored bkpname %s", pvname, bkpname)
-	}
-
 	// this is first full restore, go ahead and create the volume
 	rZV := &apis.ZFSVolume{}
-	// hack(https://github.com/vmware-tanzu/velero/pull/2835): generate a new uuid only if PV exist
-	pv, err := p.getPV(pvname)
-
-	if err == nil && pv != nil {
-		rvol, err := utils.GetRestorePVName()
-		if err != nil {
-			return nil, errors.Errorf("zfs: failed to get restore vol name for %s", pvname)
-		}
-		rZV.Name = rvol
-	} else {
-		rZV.Name = pvname
+	rZV.Name, err = p.getRestoreVolName(pvname)
+	if err != nil {
+		return nil, err
 	}
 
 	rZV.Spec = bkpZV.Spec
@@ -90,6 +93,31 @@ func (p *Plugin) buildZFSVolume(pvname string, bkpname string, bkpZV *apis.ZFSVo
 	p.Log.Debugf("zfs: GetTargetNode node %s=>%s", rZV.Spec.OwnerNodeID, tnode)
 	rZV.Spec.OwnerNodeID = tnode
 
+	// get the target pool
+	tpool, err := velero.GetTargetPool(p.K8sClient, rZV.Spec.PoolName)
+	if err != nil {
+		return nil, err
+	}
+
+	p.Log.Debugf("zfs: GetTargetPool pool %s=>%s", rZV.Spec.PoolName, tpool)
+	rZV.Spec.PoolName = tpool
+
+	// size is validated before creating the volume so that shrinking fails without any data transfer
+	size, err := velero.GetRestoreSize(pvname, bkpname)
+	if err != nil {
+		return nil, err
+	}
+
+	if size != nil {
+		capacity, err := restoreCapacity(pvname, rZV, size)
+		if err != nil {
+			return nil, err
+		}
+
+		p.Log.Debugf("zfs: restore size %s=>%s", rZV.Spec.Capacity, capacity)
+		rZV.Spec.Capacity = capacity
+	}
+
 	// set the volume status as pending
 	rZV.Status.State = zfs.ZFSStatusPending
 
@@ -100,6 +128,81 @@ func (p *Plugin) buildZFSVolume(pvname string, bkpname string, bkpZV *apis.ZFSVo
 	return rZV, nil
 }
 
+// checkRestored returns error if the given volume has already been restored in the namespace
+func (p *Plugin) checkRestored(pvname, ns, bkpname string) error {
+	filter := metav1.ListOptions{
+		LabelSelector: VeleroVolKey + "=" + pvname + "," + VeleroNsKey + "=" + ns,
+	}
+	volList, err := volbuilder.NewKubeclient().WithNamespace(p.namespace).List(filter)
+
+	if err != nil {
+		p.Log.Errorf("zfs: failed to get source volume failed vol %s snap %s err: %v", pvname, bkpname, err)
+		return err
+	}
+
+	if len(volList.Items) > 0 {
+		return errors.Errorf("zfs: err pv %s has already been restored bkpname %s", pvname, bkpname)
+	}
+	return nil
+}
+
+// getRestoreVolName return the name of volume to be restored for the given pv
+func (p *Plugin) getRestoreVolName(pvname string) (string, error) {
+	// hack(https://github.com/vmware-tanzu/velero/pull/2835): generate a new uuid only if PV exist
+	pv, err := p.getPV(pvname)
+
+	if err == nil && pv != nil {
+		rvol, err := utils.GetRestorePVName()
+		if err != nil {
+			return "", errors.Errorf("zfs: failed to get restore vol name for %s", pvname)
+		}
+		return rvol, nil
+	}
+	return pvname, nil
+}
+
+// UpdatePVTopology sets the node affinity and pool of the PV as per the given ZFSVolume
+// Node selector requirements, other than ZFSTopologyKey, are preserved.
+func UpdatePVTopology(pv *v1.PersistentVolume, vol *apis.ZFSVolume) {
+	if pv.Spec.CSI != nil {
+		if _, ok := pv.Spec.CSI.VolumeAttributes[zfs.PoolNameKey]; ok {
+			pv.Spec.CSI.VolumeAttributes[zfs.PoolNameKey] = vol.Spec.PoolName
+		}
+	}
+
+	if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+		return
+	}
+
+	nodeExpr := v1.NodeSelectorRequirement{
+		Key:      zfs.ZFSTopologyKey,
+		Operator: v1.NodeSelectorOpIn,
+		Values:   []string{vol.Spec.OwnerNodeID},
+	}
+
+	terms := pv.Spec.NodeAffinity.Required.NodeSelectorTerms
+	for i := range terms {
+		found := false
+		for j := range terms[i].MatchExpressions {
+			if terms[i].MatchExpressions[j].Key == zfs.ZFSTopologyKey {
+				terms[i].MatchExpressions[j] = nodeExpr
+				found = true
+			}
+		}
+
+		if !found {
+			terms[i].MatchExpressions = append(terms[i].MatchExpressions, nodeExpr)
+		}
+	}
+
+	if len(terms) == 0 {
+		terms = append(terms, v1.NodeSelectorTerm{
+			MatchExpressions: []v1.NodeSelectorRequirement{nodeExpr},
+		})
+	}
+	pv.Spec.NodeAffinity.Required.NodeSelectorTerms = terms
+}
+
 func (p *Plugin) createZFSVolume(rZV *apis.ZFSVolume) error {
 
 	_, err := volbuilder.NewKubeclient().WithNamespace(p.namespace).Create(rZV)
@@ -117,20 +220,18 @@ func (p *Plugin) createZFSVolume(rZV *apis.ZFSVolume) error {
 	return nil
 }
 
-func (p *Plugin) getZFSVolume(pvname, schdname, bkpname string) (*apis.ZFSVolume, error) {
+// getZFSVolume return the ZFSVolume for given volume from velero backup
+func (p *Plugin) getZFSVolume(pvname, bkpname string) (*apis.ZFSVolume, error) {
 	bkpZV := &apis.ZFSVolume{}
 
-	filename := p.cl.GenerateRemoteFileWithSchd(pvname, schdname, bkpname)
-
-	data, ok := p.cl.Read(filename + ".zfsvol")
-	if !ok {
-		return nil, errors.Errorf("zfs: failed to download ZFSVolume file=%s", filename+".zfsvol")
+	data, err := velero.GetPVMetadata(bkpname, pvname, velero.ZFSVolumeMetadataAnnotation)
+	if err != nil {
+		return nil, errors.Wrapf(err, "zfs: failed to get zfsvolume %s from backup %s", pvname, bkpname)
 	}
 
-	if err := json.Unmarshal(data, bkpZV); err != nil {
-		return nil, errors.Errorf("zfs: failed to decode zfsvolume file=%s", filename+".zfsvol")
+	if err = json.Unmarshal(data, bkpZV); err != nil {
+		return nil, errors.Wrapf(err, "zfs: failed to decode zfsvolume %s from backup %s", pvname, bkpname)
 	}
-
 	return p.buildZFSVolume(pvname, bkpname, bkpZV)
 }
 
@@ -197,7 +298,6 @@ func (p *Plugin) checkVolCreation(volname string) error {
 		}
 		time.Sleep(restoreStatusInterval * time.Second)
 	}
-	return nil
 }
 
 // startRestore creates the ZFSRestore CR to start downloading the data and returns ZFSRestore CR name
@@ -220,6 +320,9 @@ func (p *Plugin) startRestore(zv *apis.ZFSVolume, bkpname string, port int) (str
 		return "", err
 	}
 
+	// pass the data server settings to the node agent
+	rstr.Annotations = p.cl.RemoteAnnotations()
+
 	_, err = restorebuilder.NewKubeclient().WithNamespace(p.namespace).Create(rstr)
 
 	if err != nil {
@@ -249,6 +352,10 @@ func (p *Plugin) dataRestore(zv *apis.ZFSVolume, pvname, schdname, bkpname strin
 	// reset the connection state
 	p.cl.ConnStateReset()
 
+	if err := p.cl.GenerateTransferToken(); err != nil {
+		return err
+	}
+
 	var wg sync.WaitGroup
 
 	wg.Add(1)
@@ -256,7 +363,7 @@ func (p *Plugin) dataRestore(zv *apis.ZFSVolume, pvname, schdname, bkpname strin
 
 	// wait for the download server to exit
 	defer func() {
-		p.cl.ExitServer = true
+		p.cl.SetExitServer(true)
 		wg.Wait()
 		p.cl.ConnReady = nil
 	}()
@@ -283,10 +390,29 @@ func (p *Plugin) dataRestore(zv *apis.ZFSVolume, pvname, schdname, bkpname strin
 	return nil
 }
 
+// getSnapList return the list of backups, from full backup to the given backup, to be restored
+// List is built from the parent links recorded in manifest. For backups created by older
+// plugin, it is computed from incrBackupCount.
 func (p *Plugin) getSnapList(pvname, schdname, bkpname string) ([]string, error) {
 	list := []string{bkpname}
 
-	if p.incremental < 1 || len(schdname) == 0 {
+	if len(schdname) == 0 {
+		// not an incremental backup, return the list having bkpname
+		return list, nil
+	}
+
+	chain, err := p.cl.ResolveChain(bkpname, func(backup string) string {
+		return p.cl.GenerateRemoteFileWithSchd(pvname, schdname, backup)
+	})
+	if err != nil {
+		return list, err
+	}
+
+	if chain != nil {
+		return chain, nil
+	}
+
+	if p.incremental < 1 {
 		// not an incremental backup, return the list having bkpname
 		return list, nil
 	}
@@ -324,13 +450,63 @@ func (p *Plugin) getSnapList(pvname, schdname, bkpname string) ([]string, error)
 	return list, nil
 }
 
+// selectPointInTime return the latest backup, of the schedule, created at or before the given time
+func (p *Plugin) selectPointInTime(pvname, schdname string, t time.Time) (string, error) {
+	var backups []string
+
+	filename := p.cl.GetFileNameWithSchd(pvname, schdname)
+
+	list, err := p.cl.GetChainBackups(filename, schdname, func(backup string) string {
+		return p.cl.GenerateRemoteFileWithSchd(pvname, schdname, backup)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// only ZFSVolume file may exist for failed backup
+	for _, bkp := range list {
+		exists, err := p.cl.Exists(p.cl.GenerateRemoteFileWithSchd(pvname, schdname, bkp))
+		if err == nil && exists {
+			backups = append(backups, bkp)
+		}
+	}
+
+	selected, err := p.cl.SelectPointInTime(backups, t, func(backup string) string {
+		return p.cl.GenerateRemoteFileWithSchd(pvname, schdname, backup)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	p.Log.Infof("zfs: selected backup %s for point-in-time %s", selected, t.Format(time.RFC3339))
+	return selected, nil
+}
+
 func (p *Plugin) doRestore(snapshotID string, port int) (string, error) {
 	pvname, schdname, bkpname, err := utils.GetInfoFromSnapshotID(snapshotID)
 	if err != nil {
 		return "", err
 	}
 
-	bkpList, err := p.getSnapList(pvname, schdname, bkpname)
+	target := bkpname
+
+	pointInTime, err := velero.GetRestorePointInTime(bkpname)
+	if err != nil {
+		return "", err
+	}
+
+	if pointInTime != nil {
+		if len(schdname) == 0 {
+			return "", errors.Errorf("zfs: point-in-time restore is supported for scheduled backup only, bkp %s", bkpname)
+		}
+
+		target, err = p.selectPointInTime(pvname, schdname, *pointInTime)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	bkpList, err := p.getSnapList(pvname, schdname, target)
 	if err != nil {
 		return "", err
 	}
@@ -341,12 +517,14 @@ func (p *Plugin) doRestore(snapshotID string, port int) (string, error) {
 
 	p.Log.Debugf("zfs: backup list for restore %v", bkpList)
 
-	zv, err := p.getZFSVolume(pvname, schdname, bkpname)
+	zv, err := p.getZFSVolume(pvname, bkpname)
 	if err != nil {
 		p.Log.Errorf("zfs: restore ZFSVolume failed vol %s bkp %s err %v", pvname, bkpname, err)
 		return "", err
 	}
 
+	var replayed []string
+
 	// attempt the incremental restore, will resote single backup if it is not a incremental backup
 	for _, bkp := range bkpList {
 		err = p.dataRestore(zv, pvname, schdname, bkp, port)
@@ -355,8 +533,11 @@ func (p *Plugin) doRestore(snapshotID string, port int) (string, error) {
 			p.Log.Errorf("zfs: error doRestore returning snap %s err %v", snapshotID, err)
 			return "", err
 		}
+		replayed = append(replayed, p.cl.GenerateRemoteFileWithSchd(pvname, schdname, bkp))
 	}
 
+	p.Log.Infof("zfs: volume %s restored from snapshots %v", zv.Name, replayed)
+
 	// restore done, create the ZFSVolume
 	err = p.createZFSVolume(zv)
 	if err != nil {
@@ -0,0 +1,132 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"reflect"
+	"testing"
+
+	apis "github.com/openebs/zfs-localpv/pkg/apis/openebs.io/zfs/v1"
+	"github.com/openebs/zfs-localpv/pkg/zfs"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func nodeTerm(exprs ...v1.NodeSelectorRequirement) v1.NodeSelectorTerm {
+	return v1.NodeSelectorTerm{MatchExpressions: exprs}
+}
+
+func nodeExpr(key string, values ...string) v1.NodeSelectorRequirement {
+	return v1.NodeSelectorRequirement{Key: key, Operator: v1.NodeSelectorOpIn, Values: values}
+}
+
+func TestUpdatePVTopology(t *testing.T) {
+	vol := &apis.ZFSVolume{}
+	vol.Spec.OwnerNodeID = "node-2"
+	vol.Spec.PoolName = "pool-2"
+
+	zone := nodeExpr("topology.kubernetes.io/zone", "zone-1")
+
+	tests := map[string]struct {
+		terms    []v1.NodeSelectorTerm
+		expected []v1.NodeSelectorTerm
+	}{
+		"replace node": {
+			terms:    []v1.NodeSelectorTerm{nodeTerm(nodeExpr(zfs.ZFSTopologyKey, "node-1"))},
+			expected: []v1.NodeSelectorTerm{nodeTerm(nodeExpr(zfs.ZFSTopologyKey, "node-2"))},
+		},
+		"keep other keys": {
+			terms:    []v1.NodeSelectorTerm{nodeTerm(zone, nodeExpr(zfs.ZFSTopologyKey, "node-1"))},
+			expected: []v1.NodeSelectorTerm{nodeTerm(zone, nodeExpr(zfs.ZFSTopologyKey, "node-2"))},
+		},
+		"term without node": {
+			terms: []v1.NodeSelectorTerm{
+				nodeTerm(nodeExpr(zfs.ZFSTopologyKey, "node-1")),
+				nodeTerm(zone),
+			},
+			expected: []v1.NodeSelectorTerm{
+				nodeTerm(nodeExpr(zfs.ZFSTopologyKey, "node-2")),
+				nodeTerm(zone, nodeExpr(zfs.ZFSTopologyKey, "node-2")),
+			},
+		},
+		"no terms": {
+			expected: []v1.NodeSelectorTerm{nodeTerm(nodeExpr(zfs.ZFSTopologyKey, "node-2"))},
+		},
+	}
+
+	for name, test := range tests {
+		pv := &v1.PersistentVolume{
+			Spec: v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{
+						VolumeAttributes: map[string]string{zfs.PoolNameKey: "pool-1"},
+					},
+				},
+				NodeAffinity: &v1.VolumeNodeAffinity{
+					Required: &v1.NodeSelector{NodeSelectorTerms: test.terms},
+				},
+			},
+		}
+
+		UpdatePVTopology(pv, vol)
+
+		if got := pv.Spec.NodeAffinity.Required.NodeSelectorTerms; !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%s: invalid node affinity %v, expected %v", name, got, test.expected)
+		}
+		if pool := pv.Spec.CSI.VolumeAttributes[zfs.PoolNameKey]; pool != "pool-2" {
+			t.Errorf("%s: invalid pool %s", name, pool)
+		}
+	}
+
+	// pv without node affinity is left as is
+	pv := &v1.PersistentVolume{}
+	UpdatePVTopology(pv, vol)
+	if pv.Spec.NodeAffinity != nil {
+		t.Errorf("node affinity is added to pv without affinity")
+	}
+}
+
+func TestRestoreCapacity(t *testing.T) {
+	tests := map[string]struct {
+		volType  string
+		size     string
+		expected string
+		hasError bool
+	}{
+		"dataset same size":   {volType: zfs.VolTypeDataset, size: "1Gi", expected: "1073741824"},
+		"dataset larger size": {volType: zfs.VolTypeDataset, size: "2Gi", expected: "2147483648"},
+		"dataset smaller":     {volType: zfs.VolTypeDataset, size: "512Mi", hasError: true},
+		"zvol same size":      {volType: zfs.VolTypeZVol, size: "1Gi", expected: "1073741824"},
+		"zvol larger size":    {volType: zfs.VolTypeZVol, size: "2Gi", hasError: true},
+	}
+
+	for name, test := range tests {
+		vol := &apis.ZFSVolume{}
+		vol.Spec.Capacity = "1073741824"
+		vol.Spec.VolumeType = test.volType
+
+		size := resource.MustParse(test.size)
+		capacity, err := restoreCapacity("pv-1", vol, &size)
+		if (err != nil) != test.hasError {
+			t.Errorf("%s: unexpected error %v", name, err)
+			continue
+		}
+		if capacity != test.expected {
+			t.Errorf("%s: got capacity %s, expected %s", name, capacity, test.expected)
+		}
+	}
+}
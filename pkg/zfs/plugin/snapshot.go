@@ -0,0 +1,187 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"time"
+
+	"github.com/openebs/velero-plugin/pkg/velero"
+	"github.com/openebs/velero-plugin/pkg/zfs/utils"
+	apis "github.com/openebs/zfs-localpv/pkg/apis/openebs.io/zfs/v1"
+	"github.com/openebs/zfs-localpv/pkg/builder/snapbuilder"
+	"github.com/openebs/zfs-localpv/pkg/zfs"
+	"github.com/pkg/errors"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	snapshotStatusInterval = 5
+)
+
+// doSnapshot creates the ZFSSnapshot of the given volume for local backup
+func (p *Plugin) doSnapshot(volumeID string, snapname string, schdname string) (string, error) {
+	pv, err := p.getPV(volumeID)
+	if err != nil {
+		p.Log.Errorf("zfs: Failed to get pv %s snap %s err %v", volumeID, snapname, err)
+		return "", err
+	}
+
+	vol, err := GetZFSVolumeForBackup(pv, p.namespace)
+	if err != nil {
+		return "", err
+	}
+
+	name := utils.GenerateResourceName(vol.Name, snapname)
+
+	snap, err := snapbuilder.NewBuilder().
+		WithName(name).
+		WithLabels(map[string]string{
+			zfs.ZFSVolKey: vol.Name,
+			VeleroBkpKey:  snapname,
+			VeleroNsKey:   pv.Spec.ClaimRef.Namespace,
+		}).
+		Build()
+	if err != nil {
+		return "", err
+	}
+
+	snap.Spec = vol.Spec
+	snap.Status.State = zfs.ZFSStatusPending
+
+	thaw, err := p.freezer.Freeze(pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name)
+	if err != nil {
+		return "", errors.Wrapf(err, "zfs: failed to freeze application")
+	}
+
+	p.Log.Debugf("zfs: creating ZFSSnapshot vol = %s snap = %s", vol.Name, name)
+
+	_, err = snapbuilder.NewKubeclient().WithNamespace(p.namespace).Create(snap)
+	if err != nil {
+		_ = thaw()
+		return "", errors.Wrapf(err, "zfs: failed to create snapshot %s", name)
+	}
+
+	err = p.checkSnapCreation(name)
+	thawErr := thaw()
+	if err != nil {
+		p.Log.Errorf("zfs: snapshot failed vol %s snap %s err: %v", volumeID, name, err)
+		return "", err
+	}
+	if thawErr != nil {
+		_ = p.deleteSnapshot(utils.GenerateSnapshotID(volumeID, schdname, snapname))
+		return "", errors.Wrapf(thawErr, "zfs: snapshot %s is not app-consistent", name)
+	}
+
+	snapID := utils.GenerateSnapshotID(volumeID, schdname, snapname)
+
+	p.Log.Debugf("zfs: snapshot done vol %s snap %s snapID %s", volumeID, name, snapID)
+	return snapID, nil
+}
+
+func (p *Plugin) checkSnapCreation(name string) error {
+	for {
+		getOptions := metav1.GetOptions{}
+		snap, err := snapbuilder.NewKubeclient().
+			WithNamespace(p.namespace).Get(name, getOptions)
+
+		if err != nil {
+			p.Log.Errorf("zfs: Failed to fetch snapshot {%s}", name)
+			return err
+		}
+
+		switch snap.Status.State {
+		case zfs.ZFSStatusReady:
+			return nil
+		case zfs.ZFSStatusFailed:
+			return errors.Errorf("zfs: error in creating snapshot %s", name)
+		}
+		time.Sleep(snapshotStatusInterval * time.Second)
+	}
+}
+
+// deleteSnapshot deletes the ZFSSnapshot created for local backup
+func (p *Plugin) deleteSnapshot(snapshotID string) error {
+	pvname, _, snapname, err := utils.GetInfoFromSnapshotID(snapshotID)
+	if err != nil {
+		return err
+	}
+
+	name := utils.GenerateResourceName(pvname, snapname)
+	err = snapbuilder.NewKubeclient().WithNamespace(p.namespace).Delete(name)
+	if err != nil && !k8serrors.IsNotFound(err) {
+		p.Log.Errorf("zfs: Failed to delete the snapshot %s", snapshotID)
+		return err
+	}
+
+	return nil
+}
+
+// doLocalRestore creates a new volume, by cloning the ZFSSnapshot of local backup,
+// on the same node and pool
+func (p *Plugin) doLocalRestore(snapshotID string) (string, error) {
+	pvname, _, bkpname, err := utils.GetInfoFromSnapshotID(snapshotID)
+	if err != nil {
+		return "", err
+	}
+
+	name := utils.GenerateResourceName(pvname, bkpname)
+
+	snap, err := snapbuilder.NewKubeclient().
+		WithNamespace(p.namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return "", errors.Wrapf(err, "zfs: failed to get snapshot %s", name)
+	}
+
+	if snap.Status.State != zfs.ZFSStatusReady {
+		return "", errors.Errorf("zfs: snapshot %s is not ready, status:{%s}", name, snap.Status.State)
+	}
+
+	// get the target namespace
+	ns, err := velero.GetRestoreNamespace(snap.Labels[VeleroNsKey], bkpname, p.Log)
+	if err != nil {
+		p.Log.Errorf("zfs: failed to get target ns for pv=%s, bkpname=%s err: %v", pvname, bkpname, err)
+		return "", err
+	}
+
+	if err := p.checkRestored(pvname, ns, bkpname); err != nil {
+		return "", err
+	}
+
+	rZV := &apis.ZFSVolume{}
+	rZV.Name, err = p.getRestoreVolName(pvname)
+	if err != nil {
+		return "", err
+	}
+
+	// clone is created on the node and pool having the snapshot
+	rZV.Spec = snap.Spec
+	rZV.Spec.SnapName = pvname + "@" + name
+	rZV.Status.State = zfs.ZFSStatusPending
+
+	// add original volume and schedule name in the label
+	rZV.Labels = map[string]string{VeleroVolKey: pvname, VeleroNsKey: ns}
+	rZV.Annotations = map[string]string{VeleroBkpKey: bkpname}
+
+	if err := p.createZFSVolume(rZV); err != nil {
+		p.Log.Errorf("zfs: can not create ZFS Volume, snap %s err %v", snapshotID, err)
+		return "", err
+	}
+
+	p.Log.Infof("zfs: volume %s cloned from snapshot %s", rZV.Name, rZV.Spec.SnapName)
+	return rZV.Name, nil
+}
@@ -18,16 +18,15 @@ package plugin
 
 import (
 	"strconv"
+	"time"
 
 	cloud "github.com/openebs/velero-plugin/pkg/clouduploader"
+	"github.com/openebs/velero-plugin/pkg/freeze"
 	"github.com/openebs/velero-plugin/pkg/velero"
 	"github.com/openebs/velero-plugin/pkg/zfs/utils"
-	"github.com/openebs/zfs-localpv/pkg/builder/volbuilder"
-	"github.com/openebs/zfs-localpv/pkg/zfs"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	v1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
@@ -38,9 +37,20 @@ const (
 	// ZfsPvNamespace config key for OpenEBS namespace
 	ZfsPvNamespace = "namespace"
 
+	// ZfsPvLocal config key for local snapshot
+	ZfsPvLocal = "local"
+
 	// ZfsPvIncr config key for providing count of incremental backups
 	ZfsPvIncr = "incrBackupCount"
 
+	// ZfsPvFullBackupInterval config key for providing the max age of full backup,
+	// after which next scheduled backup will be a full backup
+	ZfsPvFullBackupInterval = "fullBackupInterval"
+
+	// ZfsPvFullBackupSizePercent config key for providing the max size, as percentage of volume size,
+	// of incremental backups after which next scheduled backup will be a full backup
+	ZfsPvFullBackupSizePercent = "fullBackupSizePercent"
+
 	// zfs csi driver name
 	ZfsDriverName = "zfs.csi.openebs.io"
 
@@ -69,11 +79,27 @@ type Plugin struct {
 	// as env OPENEBS_NAMESPACE while deploying it.
 	namespace string
 
+	// local is true if the backups are ZFSSnapshots, on the same node, and not uploaded
+	local bool
+
+	// strictVolumeCheck fails the backup of OpenEBS PV which can't be snapshotted
+	strictVolumeCheck bool
+
 	// This specifies how many incremental backup we have to keep
 	incremental uint64
 
+	// fullBackupInterval is the max age of full backup in incremental chain
+	fullBackupInterval time.Duration
+
+	// fullBackupSizePercent is the max size, as percentage of volume size,
+	// of incremental backups in the chain
+	fullBackupSizePercent uint64
+
 	// cl stores cloud connection information
 	cl *cloud.Conn
+
+	// freezer freezes the application, for app-consistent snapshot
+	freezer *freeze.Freezer
 }
 
 // Init prepares the VolumeSnapshotter for usage using the provided map of
@@ -102,6 +128,22 @@ func (p *Plugin) Init(config map[string]string) error {
 		p.incremental = incr
 	}
 
+	if interval, ok := config[ZfsPvFullBackupInterval]; ok {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			return errors.Wrapf(err, "zfs: invalid fullBackupInterval value=%s", interval)
+		}
+		p.fullBackupInterval = d
+	}
+
+	if percent, ok := config[ZfsPvFullBackupSizePercent]; ok {
+		pc, err := strconv.ParseUint(percent, 10, 64)
+		if err != nil {
+			return errors.Wrapf(err, "zfs: invalid fullBackupSizePercent value=%s", percent)
+		}
+		p.fullBackupSizePercent = pc
+	}
+
 	conf, err := rest.InClusterConfig()
 	if err != nil {
 		p.Log.Errorf("Failed to get cluster config : %s", err.Error())
@@ -120,15 +162,59 @@ func (p *Plugin) Init(config map[string]string) error {
 
 	p.K8sClient = clientset
 
+	p.freezer, err = freeze.NewFreezer(p.Log, conf, p.K8sClient, config)
+	if err != nil {
+		return errors.Wrapf(err, "zfs: failed to initialize freezer")
+	}
+
+	if strict, ok := config[velero.StrictVolumeCheck]; ok {
+		p.strictVolumeCheck, err = strconv.ParseBool(strict)
+		if err != nil {
+			return errors.Wrapf(err, "zfs: invalid %s value=%s", velero.StrictVolumeCheck, strict)
+		}
+	}
+
+	if local, ok := config[ZfsPvLocal]; ok {
+		p.local, err = strconv.ParseBool(local)
+		if err != nil {
+			return errors.Wrapf(err, "zfs: invalid local value=%s", local)
+		}
+	}
+
+	if p.local {
+		return nil
+	}
+
 	p.cl = &cloud.Conn{Log: p.Log}
-	return p.cl.Init(config)
+	if err := p.cl.Init(config); err != nil {
+		return err
+	}
+
+	if secretName, ok := config[cloud.DataTLSSecret]; ok && secretName != "" {
+		secret, err := velero.GetSecret(p.K8sClient, secretName)
+		if err != nil {
+			return err
+		}
+
+		if err := p.cl.InitTLS(secret, config); err != nil {
+			return errors.Wrapf(err, "zfs: failed to initialize TLS for data server")
+		}
+	}
+	return nil
 }
 
 // CreateVolumeFromSnapshot creates a new volume from the specified snapshot
 func (p *Plugin) CreateVolumeFromSnapshot(snapshotID, volumeType, volumeAZ string, iops *int64) (string, error) {
 	p.Log.Debugf("zfs: CreateVolumeFromSnapshot called snap %s", snapshotID)
 
-	volumeID, err := p.doRestore(snapshotID, ZFSRestorePort)
+	var volumeID string
+	var err error
+
+	if p.local {
+		volumeID, err = p.doLocalRestore(snapshotID)
+	} else {
+		volumeID, err = p.doRestore(snapshotID, ZFSRestorePort)
+	}
 	if err != nil {
 		p.Log.Errorf("zfs: error CreateVolumeFromSnapshot returning snap %s err %v", snapshotID, err)
 		return "", err
@@ -164,7 +250,20 @@ func (p *Plugin) CreateSnapshot(volumeID, volumeAZ string, tags map[string]strin
 
 	schdname := tags[VeleroSchdKey]
 
-	snapshotID, err := p.doBackup(volumeID, bkpname, schdname, ZFSBackupPort)
+	// backup chain, if configured, is used as schedule for incremental backup
+	bkp, err := velero.GetBackup(bkpname)
+	if err != nil {
+		p.Log.Warnf("zfs: failed to get backup chain for backup=%s : %s", bkpname, err.Error())
+	} else if chain := velero.BackupChain(bkp); chain != "" {
+		schdname = chain
+	}
+
+	var snapshotID string
+	if p.local {
+		snapshotID, err = p.doSnapshot(volumeID, bkpname, schdname)
+	} else {
+		snapshotID, err = p.doBackup(volumeID, bkpname, schdname, ZFSBackupPort)
+	}
 
 	if err != nil {
 		p.Log.Errorf("zfs: error createBackup %s@%s failed %v", volumeID, bkpname, err)
@@ -183,6 +282,10 @@ func (p *Plugin) DeleteSnapshot(snapshotID string) error {
 		return nil
 	}
 
+	if p.local {
+		return p.deleteSnapshot(snapshotID)
+	}
+
 	return p.deleteBackup(snapshotID)
 }
 
@@ -196,18 +299,16 @@ func (p *Plugin) GetVolumeID(unstructuredPV runtime.Unstructured) (string, error
 	}
 
 	// If PV doesn't have sufficient info to consider as ZFS-LocalPV Volume
-	// then we will return empty volumeId and error as nil.
-	if pv.Name == "" ||
-		pv.Spec.StorageClassName == "" ||
-		(pv.Spec.ClaimRef != nil && pv.Spec.ClaimRef.Namespace == "") {
-		return "", nil
+	// then we will return empty volumeId and error as nil, unless strict check is enabled.
+	if reason := velero.MissingPVInfo(pv); reason != "" {
+		return "", velero.SkipVolume(p.Log, pv, reason, p.strictVolumeCheck)
 	}
 
 	// check if PV is created by ZFS driver
 
 	if pv.Spec.CSI == nil ||
 		pv.Spec.CSI.Driver != ZfsDriverName {
-		return "", nil
+		return "", velero.SkipVolume(p.Log, pv, velero.SkipOtherEngine, p.strictVolumeCheck)
 	}
 
 	if pv.Status.Phase == v1.VolumeReleased ||
@@ -219,6 +320,7 @@ func (p *Plugin) GetVolumeID(unstructuredPV runtime.Unstructured) (string, error
 }
 
 // SetVolumeID sets the specific identifier for the PersistentVolume.
+// Node affinity and pool of the PV are updated by the restore item action.
 func (p *Plugin) SetVolumeID(unstructuredPV runtime.Unstructured, volumeID string) (runtime.Unstructured, error) {
 	p.Log.Debugf("zfs: SetVolumeID called %v %s", unstructuredPV, volumeID)
 
@@ -231,34 +333,6 @@ func (p *Plugin) SetVolumeID(unstructuredPV runtime.Unstructured, volumeID strin
 	pv.Name = volumeID
 	pv.Spec.PersistentVolumeSource.CSI.VolumeHandle = volumeID
 
-	// set the node affinity
-	if pv.Spec.NodeAffinity != nil && pv.Spec.NodeAffinity.Required != nil {
-		vol, err := volbuilder.NewKubeclient().
-			WithNamespace(p.namespace).Get(volumeID, metav1.GetOptions{})
-		if err != nil {
-			p.Log.Errorf("zfs: Failed to fetch volume {%s}", volumeID)
-			return nil, err
-		}
-
-		var expr []v1.NodeSelectorRequirement
-		expr = append(expr, v1.NodeSelectorRequirement{
-			Key:      zfs.ZFSTopologyKey,
-			Operator: v1.NodeSelectorOpIn,
-			Values:   []string{vol.Spec.OwnerNodeID},
-		})
-
-		var terms []v1.NodeSelectorTerm
-		terms = append(terms, v1.NodeSelectorTerm{
-			MatchExpressions: expr,
-		})
-
-		pv.Spec.NodeAffinity = &v1.VolumeNodeAffinity{
-			Required: &v1.NodeSelector{
-				NodeSelectorTerms: terms,
-			},
-		}
-	}
-
 	res, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pv)
 	if err != nil {
 		return nil, errors.WithStack(err)
@@ -93,7 +93,9 @@ func GetRestorePVName() (string, error) {
 }
 
 // GetScheduleName return the schedule name for the given backup
-// It will check if backup name have 'bkp-20060102150405' format
+// It checks if backup name have 'bkp-20060102150405' format. This is used only
+// for old snapshot ids, new snapshot ids carry the schedule name from the
+// velero schedule label.
 func GetScheduleName(backupName string) string {
 	// for non-scheduled backup, we are considering backup name as schedule name only
 	schdName := ""
@@ -0,0 +1,77 @@
+/*
+Copyright 2020 The OpenEBS Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import "testing"
+
+func TestGetInfoFromSnapshotID(t *testing.T) {
+	tests := map[string]struct {
+		snapshotID string
+		volumeID   string
+		schdname   string
+		backupName string
+		isErr      bool
+	}{
+		"old scheduled backup": {
+			snapshotID: "pvc-1.x-20240101000000",
+			volumeID:   "pvc-1",
+			schdname:   "x",
+			backupName: "x-20240101000000",
+		},
+		"old manual backup": {
+			snapshotID: "pvc-1.bkp",
+			volumeID:   "pvc-1",
+			schdname:   "",
+			backupName: "bkp",
+		},
+		"new backup": {
+			snapshotID: "pvc-1.daily.x-20240101000000",
+			volumeID:   "pvc-1",
+			schdname:   "daily",
+			backupName: "x-20240101000000",
+		},
+		"new manual backup": {
+			snapshotID: "pvc-1..x-20240101000000",
+			volumeID:   "pvc-1",
+			schdname:   "",
+			backupName: "x-20240101000000",
+		},
+		"invalid id": {
+			snapshotID: "pvc-1",
+			isErr:      true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			volumeID, schdname, backupName, err := GetInfoFromSnapshotID(test.snapshotID)
+			if test.isErr {
+				if err == nil {
+					t.Fatalf("expected error for %s", test.snapshotID)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if volumeID != test.volumeID || schdname != test.schdname || backupName != test.backupName {
+				t.Fatalf("got (%s, %s, %s), expected (%s, %s, %s)",
+					volumeID, schdname, backupName, test.volumeID, test.schdname, test.backupName)
+			}
+		})
+	}
+}
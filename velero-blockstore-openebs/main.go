@@ -17,6 +17,9 @@ limitations under the License.
 package main
 
 import (
+	csisnap "github.com/openebs/velero-plugin/pkg/csi/snapshot"
+	"github.com/openebs/velero-plugin/pkg/itemaction"
+	lvmsnap "github.com/openebs/velero-plugin/pkg/lvm/snapshot"
 	snap "github.com/openebs/velero-plugin/pkg/snapshot"
 	zfssnap "github.com/openebs/velero-plugin/pkg/zfs/snapshot"
 	"github.com/sirupsen/logrus"
@@ -29,6 +32,10 @@ func main() {
 		BindFlags(pflag.CommandLine).
 		RegisterVolumeSnapshotter("openebs.io/cstor-blockstore", openebsSnapPlugin).
 		RegisterVolumeSnapshotter("openebs.io/zfspv-blockstore", zfsSnapPlugin).
+		RegisterVolumeSnapshotter("openebs.io/lvmpv-blockstore", lvmSnapPlugin).
+		RegisterVolumeSnapshotter("openebs.io/csi-blockstore", csiSnapPlugin).
+		RegisterBackupItemAction("openebs.io/pv-backup-action", pvBackupAction).
+		RegisterRestoreItemAction("openebs.io/pv-restore-action", pvRestoreAction).
 		Serve()
 }
 
@@ -39,3 +46,19 @@ func openebsSnapPlugin(logger logrus.FieldLogger) (interface{}, error) {
 func zfsSnapPlugin(logger logrus.FieldLogger) (interface{}, error) {
 	return &zfssnap.BlockStore{Log: logger}, nil
 }
+
+func lvmSnapPlugin(logger logrus.FieldLogger) (interface{}, error) {
+	return &lvmsnap.BlockStore{Log: logger}, nil
+}
+
+func csiSnapPlugin(logger logrus.FieldLogger) (interface{}, error) {
+	return &csisnap.BlockStore{Log: logger}, nil
+}
+
+func pvBackupAction(logger logrus.FieldLogger) (interface{}, error) {
+	return itemaction.NewBackupAction(logger)
+}
+
+func pvRestoreAction(logger logrus.FieldLogger) (interface{}, error) {
+	return itemaction.NewRestoreAction(logger)
+}